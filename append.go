@@ -0,0 +1,371 @@
+package fastzip
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zip"
+)
+
+const (
+	directoryEndSignature      = 0x06054b50
+	directory64LocSignature    = 0x07064b50
+	directory64EndSignature    = 0x06064b50
+	directoryEndLen            = 22
+	directory64LocLen          = 20
+	directory64EndLen          = 56
+	uint16max                  = (1 << 16) - 1
+	uint32max                  = (1 << 32) - 1
+	maxDirectoryEndCommentSize = uint16max
+)
+
+// directoryEnd is the end of central directory record, with the values of the
+// Zip64 end of central directory record used in place of any that overflow.
+// The disk numbers and number of records on the last disk are only non-zero,
+// and differ from the total, for split archives. zip64 is whether the Zip64
+// end of central directory record is present, or is to be written even if no
+// value overflows.
+type directoryEnd struct {
+	zip64       bool
+	disk        uint32
+	dirDisk     uint32
+	diskRecords uint64
+	records     uint64
+	size        uint64
+	offset      uint64
+	comment     string
+}
+
+// appendState is the state of an archive being appended to.
+type appendState struct {
+	f          *os.File
+	base       int64
+	end        directoryEnd
+	dir        []byte
+	forceZip64 bool
+}
+
+// NewArchiverAppend returns a new Archiver that appends entries to the
+// existing archive filename. The existing entries are left untouched: new
+// entries overwrite the archive's central directory, and Close writes a new
+// central directory listing both the existing and new entries. The archive's
+// comment is preserved, unless WithArchiverComment is used.
+//
+// WithArchiverOffset has no effect, as the offset is determined by the existing
+// archive. If archiving fails, or Close is not called, the archive is left
+// without a valid central directory.
+func NewArchiverAppend(filename, chroot string, opts ...ArchiverOption) (*Archiver, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := newArchiverAppend(f, chroot, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func newArchiverAppend(f *os.File, chroot string, opts []ArchiverOption) (*Archiver, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &appendState{f: f}
+	state.end, state.base, err = readDirectoryEnd(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	state.dir = make([]byte, state.end.size)
+	if _, err := f.ReadAt(state.dir, state.base+int64(state.end.offset)); err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(state.base+int64(state.end.offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	a, err := NewArchiver(f, chroot, append(opts, WithArchiverOffset(int64(state.end.offset)))...)
+	if err != nil {
+		return nil, err
+	}
+	if a.options.comment == "" {
+		if err := a.zw.SetComment(state.end.comment); err != nil {
+			return nil, err
+		}
+	}
+	a.appending = state
+	state.forceZip64 = a.options.forceZip64
+
+	return a, nil
+}
+
+// close closes the zip writer, and then replaces the central directory it
+// wrote, which only lists new entries, with one that lists both existing and
+// new entries.
+func (s *appendState) close(zw *zip.Writer) (err error) {
+	defer dclose(s.f, &err)
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	size, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// remove any of the original archive that extends past what was written,
+	// so that the directory end record written by the zip writer is found
+	if err := s.f.Truncate(size); err != nil {
+		return err
+	}
+
+	end, _, err := readDirectoryEnd(s.f, size)
+	if err != nil {
+		return err
+	}
+
+	dir := make([]byte, end.size)
+	if _, err := s.f.ReadAt(dir, s.base+int64(end.offset)); err != nil {
+		return err
+	}
+
+	if _, err := s.f.Seek(s.base+int64(end.offset), io.SeekStart); err != nil {
+		return err
+	}
+
+	dir = append(s.dir, dir...)
+	if s.forceZip64 {
+		if dir, err = forceZip64Directory(dir); err != nil {
+			return err
+		}
+	}
+	if _, err := s.f.Write(dir); err != nil {
+		return err
+	}
+
+	records := s.end.records + end.records
+	err = writeDirectoryEnd(s.f, directoryEnd{
+		zip64:       s.forceZip64,
+		diskRecords: records,
+		records:     records,
+		size:        uint64(len(dir)),
+		offset:      end.offset,
+		comment:     end.comment,
+	}, uint64(s.base)+end.offset+uint64(len(dir)))
+	if err != nil {
+		return err
+	}
+
+	size, err = s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	return s.f.Truncate(size)
+}
+
+// readDirectoryEnd reads the end of central directory record, and the Zip64
+// end of central directory record if present. The base offset is the offset
+// of the beginning of the zip data, which is non-zero if data has been
+// prepended to the archive.
+//
+// https://github.com/golang/go/blob/go1.20/src/archive/zip/reader.go#L506
+func readDirectoryEnd(r io.ReaderAt, size int64) (d directoryEnd, baseOffset int64, err error) {
+	blen := int64(directoryEndLen + maxDirectoryEndCommentSize)
+	if blen > size {
+		blen = size
+	}
+
+	buf := make([]byte, blen)
+	if _, err := r.ReadAt(buf, size-blen); err != nil && err != io.EOF {
+		return d, 0, err
+	}
+
+	p := findDirectoryEnd(buf)
+	if p < 0 {
+		return d, 0, zip.ErrFormat
+	}
+	directoryEndOffset := size - blen + int64(p)
+
+	b := buf[p+4:]
+	d.disk = uint32(binary.LittleEndian.Uint16(b))
+	d.dirDisk = uint32(binary.LittleEndian.Uint16(b[2:]))
+	d.diskRecords = uint64(binary.LittleEndian.Uint16(b[4:]))
+	d.records = uint64(binary.LittleEndian.Uint16(b[6:]))
+	d.size = uint64(binary.LittleEndian.Uint32(b[8:]))
+	d.offset = uint64(binary.LittleEndian.Uint32(b[12:]))
+	d.comment = string(b[18 : 18+int(binary.LittleEndian.Uint16(b[16:]))])
+
+	// the Zip64 records are required if a value overflows, but can be written
+	// regardless, in which case they're used if they're valid
+	if d.records == uint16max || d.size == uint32max || d.offset == uint32max || d.disk == uint16max || d.dirDisk == uint16max {
+		p, err := readDirectory64End(r, directoryEndOffset, &d)
+		if err != nil {
+			return d, 0, err
+		}
+		directoryEndOffset = p
+	} else if d64 := d; hasDirectory64Loc(r, directoryEndOffset) {
+		if p, err := readDirectory64End(r, directoryEndOffset, &d64); err == nil {
+			d, directoryEndOffset = d64, p
+		}
+	}
+
+	// the central directory of a split archive can begin on an earlier disk,
+	// so the base offset can't be determined
+	if d.disk != 0 {
+		return d, 0, nil
+	}
+
+	baseOffset = directoryEndOffset - int64(d.size) - int64(d.offset)
+	if o := baseOffset + int64(d.offset); o < 0 || o >= size {
+		return d, 0, zip.ErrFormat
+	}
+
+	return d, baseOffset, nil
+}
+
+func findDirectoryEnd(b []byte) int {
+	for i := len(b) - directoryEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(b[i:]) != directoryEndSignature {
+			continue
+		}
+
+		n := int(binary.LittleEndian.Uint16(b[i+directoryEndLen-2:]))
+		if n+directoryEndLen+i <= len(b) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasDirectory64Loc returns whether the Zip64 end of central directory locator
+// precedes the end of central directory record.
+func hasDirectory64Loc(r io.ReaderAt, directoryEndOffset int64) bool {
+	if directoryEndOffset < directory64LocLen {
+		return false
+	}
+
+	b := make([]byte, 4)
+	if _, err := r.ReadAt(b, directoryEndOffset-directory64LocLen); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(b) == directory64LocSignature
+}
+
+// readDirectory64End reads the Zip64 end of central directory record, located
+// using the locator that precedes the end of central directory record, and
+// returns its offset.
+func readDirectory64End(r io.ReaderAt, directoryEndOffset int64, d *directoryEnd) (int64, error) {
+	locOffset := directoryEndOffset - directory64LocLen
+	if locOffset < 0 {
+		return 0, zip.ErrFormat
+	}
+
+	buf := make([]byte, directory64EndLen)
+	if _, err := r.ReadAt(buf[:directory64LocLen], locOffset); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(buf) != directory64LocSignature {
+		return 0, zip.ErrFormat
+	}
+
+	p := int64(binary.LittleEndian.Uint64(buf[8:]))
+	if _, err := r.ReadAt(buf, p); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(buf) != directory64EndSignature {
+		return 0, zip.ErrFormat
+	}
+
+	d.zip64 = true
+	d.disk = binary.LittleEndian.Uint32(buf[16:])
+	d.dirDisk = binary.LittleEndian.Uint32(buf[20:])
+	d.diskRecords = binary.LittleEndian.Uint64(buf[24:])
+	d.records = binary.LittleEndian.Uint64(buf[32:])
+	d.size = binary.LittleEndian.Uint64(buf[40:])
+	d.offset = binary.LittleEndian.Uint64(buf[48:])
+
+	return p, nil
+}
+
+// writeDirectoryEnd writes the end of central directory record, preceded by
+// the Zip64 end of central directory record and locator if any value
+// overflows it or d.zip64 is set. The Zip64 end of central directory record is written at
+// end64Offset, which unlike the other offsets is not relative to the base
+// offset, but is relative to the start of the last disk of split archives.
+//
+// https://github.com/golang/go/blob/go1.20/src/archive/zip/writer.go#L145
+func writeDirectoryEnd(w io.Writer, d directoryEnd, end64Offset uint64) error {
+	if len(d.comment) > uint16max {
+		return errors.New("zip: comment too long")
+	}
+
+	disk, dirDisk := d.disk, d.dirDisk
+	diskRecords, records, size, offset := d.diskRecords, d.records, d.size, d.offset
+	var buf []byte
+
+	if d.zip64 || records >= uint16max || diskRecords >= uint16max || size >= uint32max || offset >= uint32max || disk >= uint16max || dirDisk >= uint16max {
+		buf = make([]byte, directory64EndLen+directory64LocLen)
+
+		b := buf
+		binary.LittleEndian.PutUint32(b, directory64EndSignature)
+		binary.LittleEndian.PutUint64(b[4:], directory64EndLen-12) // length minus signature (uint32) and length fields (uint64)
+		binary.LittleEndian.PutUint16(b[12:], 45)                  // version made by
+		binary.LittleEndian.PutUint16(b[14:], 45)                  // version needed to extract
+		binary.LittleEndian.PutUint32(b[16:], disk)                // number of this disk
+		binary.LittleEndian.PutUint32(b[20:], dirDisk)             // number of the disk with the start of the central directory
+		binary.LittleEndian.PutUint64(b[24:], diskRecords)         // total number of entries this disk
+		binary.LittleEndian.PutUint64(b[32:], records)             // total number of entries overall
+		binary.LittleEndian.PutUint64(b[40:], size)                // size of directory
+		binary.LittleEndian.PutUint64(b[48:], offset)              // start of directory
+
+		b = b[directory64EndLen:]
+		binary.LittleEndian.PutUint32(b, directory64LocSignature)
+		binary.LittleEndian.PutUint32(b[4:], disk)        // number of the disk with the Zip64 end of central directory record
+		binary.LittleEndian.PutUint64(b[8:], end64Offset) // location of the Zip64 end of central directory record
+		binary.LittleEndian.PutUint32(b[16:], disk+1)     // total number of disks
+
+		disk, dirDisk = minUint32(disk, uint16max), minUint32(dirDisk, uint16max)
+		diskRecords, records = minUint64(diskRecords, uint16max), minUint64(records, uint16max)
+		size, offset = minUint64(size, uint32max), minUint64(offset, uint32max)
+	}
+
+	end := make([]byte, directoryEndLen)
+	binary.LittleEndian.PutUint32(end, directoryEndSignature)
+	binary.LittleEndian.PutUint16(end[4:], uint16(disk))
+	binary.LittleEndian.PutUint16(end[6:], uint16(dirDisk))
+	binary.LittleEndian.PutUint16(end[8:], uint16(diskRecords))
+	binary.LittleEndian.PutUint16(end[10:], uint16(records))
+	binary.LittleEndian.PutUint32(end[12:], uint32(size))
+	binary.LittleEndian.PutUint32(end[16:], uint32(offset))
+	binary.LittleEndian.PutUint16(end[20:], uint16(len(d.comment)))
+
+	buf = append(buf, end...)
+	buf = append(buf, d.comment...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func minUint32(x, y uint32) uint32 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func minUint64(x, y uint64) uint64 {
+	if x < y {
+		return x
+	}
+	return y
+}
@@ -2,10 +2,12 @@ package fastzip
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -15,6 +17,7 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zip"
 	"github.com/klauspost/compress/zstd"
 	"github.com/saracen/fastzip/internal/filepool"
@@ -24,10 +27,16 @@ import (
 
 const irregularModes = os.ModeSocket | os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe
 
-var bufioReaderPool = sync.Pool{
-	New: func() interface{} {
-		return bufio.NewReaderSize(nil, 32*1024)
-	},
+const defaultArchiverReadBufferSize = 32 * 1024
+
+var bufioReaderPool = newBufioReaderPool(defaultArchiverReadBufferSize)
+
+func newBufioReaderPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return bufio.NewReaderSize(nil, size)
+		},
+	}
 }
 
 var (
@@ -52,9 +61,15 @@ type Archiver struct {
 	m       sync.Mutex
 
 	compressors map[uint16]zip.Compressor
+	bufPool     *sync.Pool
+	appending   *appendState
+	splitting   *splitWriter
+	zip64       *zip64Writer
 }
 
-// NewArchiver returns a new Archiver.
+// NewArchiver returns a new Archiver that writes the archive to w. Each entry
+// is written with a data descriptor, so w does not need to be seekable and can
+// be a network stream or pipe.
 func NewArchiver(w io.Writer, chroot string, opts ...ArchiverOption) (*Archiver, error) {
 	var err error
 	if chroot, err = filepath.Abs(chroot); err != nil {
@@ -67,9 +82,14 @@ func NewArchiver(w io.Writer, chroot string, opts ...ArchiverOption) (*Archiver,
 	}
 
 	a.options.method = zip.Deflate
+	a.options.compressLevel = flate.DefaultCompression
 	a.options.concurrency = runtime.GOMAXPROCS(0)
 	a.options.stageDir = chroot
 	a.options.bufferSize = -1
+	a.options.readBufferSize = defaultArchiverReadBufferSize
+	a.options.modifiedEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+	a.options.storeEmptyDirs = true
+	a.options.utf8Names = true
 	for _, o := range opts {
 		err := o(&a.options)
 		if err != nil {
@@ -77,18 +97,45 @@ func NewArchiver(w io.Writer, chroot string, opts ...ArchiverOption) (*Archiver,
 		}
 	}
 
+	// adaptive compression stores files that don't compress enough only when
+	// they're staged, which depends on the concurrency, so it's disabled
+	if a.options.deterministic {
+		a.options.adaptiveCompression = false
+	}
+
+	a.bufPool = bufioReaderPool
+	if a.options.readBufferSize != defaultArchiverReadBufferSize {
+		a.bufPool = newBufioReaderPool(a.options.readBufferSize)
+	}
+
+	if a.options.forceZip64 {
+		a.zip64 = &zip64Writer{w: w}
+		w = a.zip64
+	}
+
 	a.zw = zip.NewWriter(w)
 	a.zw.SetOffset(a.options.offset)
+	if a.options.comment != "" {
+		if err := a.zw.SetComment(a.options.comment); err != nil {
+			return nil, err
+		}
+	}
 
 	// register flate compressor
-	a.RegisterCompressor(zip.Deflate, defaultCompressor)
+	if a.options.compressLevel == flate.DefaultCompression {
+		a.RegisterCompressor(zip.Deflate, defaultCompressor)
+	} else {
+		a.RegisterCompressor(zip.Deflate, FlateCompressor(a.options.compressLevel))
+	}
 	a.RegisterCompressor(zstd.ZipMethodWinZip, defaultZstdCompressor)
 
 	return a, nil
 }
 
 // RegisterCompressor registers custom compressors for a specified method ID.
-// The common methods Store and Deflate are built in.
+// The common methods Store, Deflate and Zstd are built in. A method set by
+// WithArchiverMethod must have a registered compressor before archiving, or
+// archiving fails with an error wrapping zip.ErrAlgorithm.
 func (a *Archiver) RegisterCompressor(method uint16, comp zip.Compressor) {
 	a.zw.RegisterCompressor(method, comp)
 	a.compressors[method] = comp
@@ -96,16 +143,45 @@ func (a *Archiver) RegisterCompressor(method uint16, comp zip.Compressor) {
 
 // Close closes the underlying ZipWriter.
 func (a *Archiver) Close() error {
+	if a.appending != nil {
+		return a.appending.close(a.zw)
+	}
+	if a.splitting != nil {
+		return a.splitting.close(a.zw)
+	}
+	if a.zip64 != nil {
+		return a.zip64.close(a.zw, a.options.offset)
+	}
 	return a.zw.Close()
 }
 
+// Chroot returns the absolute path of the directory files are archived from.
+func (a *Archiver) Chroot() string {
+	return a.chroot
+}
+
+// Concurrency returns the maximum number of files compressed concurrently.
+func (a *Archiver) Concurrency() int {
+	return a.options.concurrency
+}
+
+// String returns a summary of the archiver's configuration.
+func (a *Archiver) String() string {
+	return fmt.Sprintf("Archiver{chroot: %q, concurrency: %d, method: %d}", a.chroot, a.options.concurrency, a.options.method)
+}
+
 // Written returns how many bytes and entries have been written to the archive.
 // Written can be called whilst archiving is in progress.
 func (a *Archiver) Written() (bytes, entries int64) {
 	return atomic.LoadInt64(&a.written), atomic.LoadInt64(&a.entries)
 }
 
-// Archive archives all files, symlinks and directories.
+// Archive archives all files, symlinks and directories. Files are compressed
+// concurrently, but entries are always written in name order.
+//
+// If ctx is cancelled, Archive stops compressing and writing files and returns
+// ctx.Err(). The entries written so far are left in the output, and it is up
+// to the caller to remove it.
 func (a *Archiver) Archive(ctx context.Context, files map[string]os.FileInfo) (err error) {
 	names := make([]string, 0, len(files))
 	for name := range files {
@@ -113,11 +189,194 @@ func (a *Archiver) Archive(ctx context.Context, files map[string]os.FileInfo) (e
 	}
 	sort.Strings(names)
 
+	entries := make([]archiveEntry, 0, len(names))
+	for _, name := range names {
+		fi := files[name]
+		if fi.Mode()&irregularModes != 0 {
+			if err := a.unsupported(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		path, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(path, a.chroot+string(filepath.Separator)) && path != a.chroot {
+			return fmt.Errorf("%s cannot be archived from outside of chroot (%s)", name, a.chroot)
+		}
+
+		base := a.chroot
+		if a.options.baseDir != "" {
+			base = a.options.baseDir
+			if !strings.HasPrefix(path, base+string(filepath.Separator)) && path != base {
+				return fmt.Errorf("%s cannot be archived from outside of base directory (%s)", name, base)
+			}
+		}
+
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, archiveEntry{name: rel, path: path, fi: fi})
+	}
+
+	if a.options.followSymlinks {
+		if entries, err = a.followSymlinks(entries); err != nil {
+			return err
+		}
+	}
+
+	if a.options.nameFunc != nil {
+		if entries, err = a.rename(entries); err != nil {
+			return err
+		}
+	}
+
+	return a.archive(ctx, entries)
+}
+
+// ArchiveFiles archives the files provided, where each key is the name the
+// file is archived as and each value is the path of the file to archive,
+// allowing for a layout that differs from the filesystem's. Names use forward
+// slashes, must be relative and cannot reference parent directories. The
+// chroot is not used, and the function set by WithArchiverNameFunc is not
+// called.
+//
+// Parent directories of each name are archived too. If a parent directory is
+// not itself one of the files provided, it is archived with a mode of 0755
+// and the current time.
+func (a *Archiver) ArchiveFiles(ctx context.Context, files map[string]string) error {
+	entries := make(map[string]archiveEntry)
+	for name, src := range files {
+		name = path.Clean(name)
+		if name == "." || !validName(name) {
+			return fmt.Errorf("%s is not a valid archive name", name)
+		}
+
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		entries[name] = archiveEntry{name: filepath.FromSlash(name), path: src, fi: fi}
+	}
+
+	list, err := withParents(entries)
+	if err != nil {
+		return err
+	}
+
+	if a.options.followSymlinks {
+		if list, err = a.followSymlinks(list); err != nil {
+			return err
+		}
+	}
+
+	return a.archive(ctx, list)
+}
+
+// rename renames entries using the function set by WithArchiverNameFunc,
+// skipping those it returns an empty name for and adding any parent
+// directories that the new names imply.
+func (a *Archiver) rename(entries []archiveEntry) ([]archiveEntry, error) {
+	renamed := make(map[string]archiveEntry)
+	for _, entry := range entries {
+		name, err := a.options.nameFunc(filepath.ToSlash(entry.name))
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+
+		name = path.Clean(name)
+		if !validName(name) {
+			return nil, fmt.Errorf("%s cannot be archived as %s, it is not a valid archive name", entry.name, name)
+		}
+		if existing, ok := renamed[name]; ok {
+			return nil, fmt.Errorf("%s and %s cannot both be archived as %s", existing.path, entry.path, name)
+		}
+
+		entry.name = filepath.FromSlash(name)
+		renamed[name] = entry
+	}
+
+	return withParents(renamed)
+}
+
+// validName returns whether a cleaned name is relative and within the
+// archive's root.
+func validName(name string) bool {
+	return name != ".." && !strings.HasPrefix(name, "../") && !path.IsAbs(name)
+}
+
+// withParents returns the entries in name order, with any parent directories
+// that are missing added with a mode of 0755 and the current time. The map's
+// keys are the names of the entries, using forward slashes.
+func withParents(entries map[string]archiveEntry) ([]archiveEntry, error) {
+	now := time.Now()
+
+	for name := range entries {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := entries[dir]; !ok {
+				entries[dir] = archiveEntry{name: filepath.FromSlash(dir), fi: impliedDir{path.Base(dir), now}}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		if dir := path.Dir(name); dir != "." && !entries[dir].fi.IsDir() {
+			return nil, fmt.Errorf("%s cannot be archived, %s is not a directory", name, dir)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]archiveEntry, 0, len(names))
+	for _, name := range names {
+		list = append(list, entries[name])
+	}
+
+	return list, nil
+}
+
+// archiveEntry is a file to be archived. The name is relative and uses the
+// platform's separator. Parent directories implied by ArchiveFiles have no
+// path.
+type archiveEntry struct {
+	name string
+	path string
+	fi   os.FileInfo
+}
+
+// impliedDir is the os.FileInfo of a parent directory that was not explicitly
+// provided to ArchiveFiles.
+type impliedDir struct {
+	name    string
+	modTime time.Time
+}
+
+func (d impliedDir) Name() string       { return d.name }
+func (d impliedDir) Size() int64        { return 0 }
+func (d impliedDir) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d impliedDir) ModTime() time.Time { return d.modTime }
+func (d impliedDir) IsDir() bool        { return true }
+func (d impliedDir) Sys() interface{}   { return nil }
+
+func (a *Archiver) archive(ctx context.Context, entries []archiveEntry) (err error) {
+	if _, ok := a.compressors[a.options.method]; !ok && a.options.method != zip.Store {
+		return fmt.Errorf("method %d has no registered compressor: %w", a.options.method, zip.ErrAlgorithm)
+	}
+
 	var fp *filepool.FilePool
 
 	concurrency := a.options.concurrency
-	if len(files) < concurrency {
-		concurrency = len(files)
+	if len(entries) < concurrency {
+		concurrency = len(entries)
 	}
 	if concurrency > 1 {
 		fp, err = filepool.New(a.options.stageDir, concurrency, a.options.bufferSize)
@@ -134,54 +393,95 @@ func (a *Archiver) Archive(ctx context.Context, files map[string]os.FileInfo) (e
 		}
 	}()
 
-	hdrs := make([]zip.FileHeader, len(names))
+	hdrs := make([]zip.FileHeader, len(entries))
 
-	for i, name := range names {
-		fi := files[name]
+	// entries are sequenced so that they're written in name order, even when
+	// compressed concurrently
+	last := &sequence{done: make(chan struct{})}
+	close(last.done)
+
+	for i, entry := range entries {
+		rel, path, fi := entry.name, entry.path, entry.fi
 		if fi.Mode()&irregularModes != 0 {
+			if err := a.unsupported(rel); err != nil {
+				return err
+			}
 			continue
 		}
 
-		path, err := filepath.Abs(name)
-		if err != nil {
-			return err
+		if a.excluded(filepath.ToSlash(rel)) {
+			continue
 		}
 
-		if !strings.HasPrefix(path, a.chroot+string(filepath.Separator)) && path != a.chroot {
-			return fmt.Errorf("%s cannot be archived from outside of chroot (%s)", name, a.chroot)
+		if fi.IsDir() && !a.options.storeEmptyDirs {
+			continue
 		}
 
-		rel, err := filepath.Rel(a.chroot, path)
-		if err != nil {
-			return err
+		if !a.modifiedAfter(fi) {
+			continue
 		}
 
 		hdr := &hdrs[i]
 		fileInfoHeader(rel, fi, hdr)
+		if a.options.deterministic {
+			hdr.Modified = a.options.modifiedEpoch
+		}
+		if a.options.commentFunc != nil {
+			hdr.Comment = a.options.commentFunc(filepath.ToSlash(rel))
+		}
+		hdr.NonUTF8 = !a.options.utf8Names
+
+		if a.options.storeAccessTime && !a.options.deterministic && path != "" {
+			atime, ctime, err := fileTimes(path, fi)
+			if err != nil {
+				return err
+			}
+			hdr.Extra = append(hdr.Extra, zipextra.NewNTFS(zipextra.NTFSTimeAttribute{MTime: fi.ModTime(), ATime: atime, CTime: ctime}).Encode()...)
+		}
+
+		if a.options.storeXattrs && path != "" {
+			attrs, err := listXattrs(path)
+			if err != nil {
+				return err
+			}
+			hdr.Extra = append(hdr.Extra, encodeXattrs(attrs)...)
+		}
+
+		if a.options.storeFlags && path != "" && fi.Mode()&os.ModeSymlink == 0 {
+			flags, err := getFileFlags(path)
+			if err != nil {
+				return err
+			}
+			hdr.Extra = append(hdr.Extra, encodeFileFlags(flags)...)
+		}
 
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
 
+		seq := last.next()
+		last = seq
 		switch {
 		case hdr.Mode()&os.ModeSymlink != 0:
-			err = a.createSymlink(path, fi, hdr)
+			err = a.createSymlink(ctx, path, fi, hdr, seq)
 
 		case hdr.Mode().IsDir():
-			err = a.createDirectory(fi, hdr)
+			err = a.createDirectory(ctx, fi, hdr, seq)
 
 		default:
 			if hdr.UncompressedSize64 > 0 {
-				hdr.Method = a.options.method
+				if hdr.Method, err = a.method(rel, fi); err != nil {
+					return err
+				}
 			}
 
 			if fp == nil {
-				err = a.createFile(ctx, path, fi, hdr, nil)
+				err = a.createFile(ctx, path, fi, hdr, seq, nil)
 				incOnSuccess(&a.entries, err)
 			} else {
 				f := fp.Get()
 				wg.Go(func() error {
-					err := a.createFile(ctx, path, fi, hdr, f)
+					err := a.createFile(ctx, path, fi, hdr, seq, f)
 					fp.Put(f)
 					incOnSuccess(&a.entries, err)
 					return err
@@ -197,6 +497,60 @@ func (a *Archiver) Archive(ctx context.Context, files map[string]os.FileInfo) (e
 	return wg.Wait()
 }
 
+// unsupported returns an error for a file that cannot be archived, unless the
+// unsupported type policy is to skip it.
+func (a *Archiver) unsupported(name string) error {
+	if a.options.unsupportedTypePolicy == UnsupportedTypeError {
+		return fmt.Errorf("%s cannot be archived: %w", name, ErrUnsupportedType)
+	}
+	return nil
+}
+
+// modifiedAfter returns whether fi is to be archived according to
+// WithArchiverModifiedAfter.
+func (a *Archiver) modifiedAfter(fi os.FileInfo) bool {
+	return a.options.modifiedAfter.IsZero() || !fi.Mode().IsRegular() || fi.ModTime().After(a.options.modifiedAfter)
+}
+
+// excluded returns whether a relative path, or any of its parent directories,
+// matches an exclude pattern. Patterns without a separator are matched against
+// the base name, otherwise they're matched against the whole relative path.
+func (a *Archiver) excluded(rel string) bool {
+	for ; rel != "." && rel != "/"; rel = path.Dir(rel) {
+		for _, pattern := range a.options.excludes {
+			name := rel
+			if !strings.Contains(pattern, "/") {
+				name = path.Base(rel)
+			}
+
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// method returns the method to be used for a file.
+func (a *Archiver) method(name string, fi os.FileInfo) (uint16, error) {
+	if a.options.methodFunc != nil {
+		method := a.options.methodFunc(filepath.ToSlash(name), fi)
+		if method != MethodDefault {
+			if _, ok := a.compressors[method]; !ok && method != zip.Store {
+				return 0, fmt.Errorf("%s cannot use method %d: %w", name, method, zip.ErrAlgorithm)
+			}
+			return method, nil
+		}
+	}
+
+	if _, ok := a.options.storeExts[strings.ToLower(filepath.Ext(name))]; ok {
+		return zip.Store, nil
+	}
+
+	return a.options.method, nil
+}
+
 func fileInfoHeader(name string, fi os.FileInfo, hdr *zip.FileHeader) {
 	hdr.Name = filepath.ToSlash(name)
 	hdr.UncompressedSize64 = uint64(fi.Size())
@@ -205,6 +559,8 @@ func fileInfoHeader(name string, fi os.FileInfo, hdr *zip.FileHeader) {
 
 	if hdr.Mode().IsDir() {
 		hdr.Name += "/"
+		hdr.Method = zip.Store
+		hdr.UncompressedSize64 = 0
 	}
 
 	const uint32max = (1 << 32) - 1
@@ -215,18 +571,54 @@ func fileInfoHeader(name string, fi os.FileInfo, hdr *zip.FileHeader) {
 	}
 }
 
-func (a *Archiver) createDirectory(fi os.FileInfo, hdr *zip.FileHeader) error {
+// sequence orders writes to the archive. Each entry waits for the entry before
+// it to be written before writing itself.
+type sequence struct {
+	prev <-chan struct{}
+	done chan struct{}
+}
+
+// next returns the sequence of the entry that follows s.
+func (s *sequence) next() *sequence {
+	return &sequence{prev: s.done, done: make(chan struct{})}
+}
+
+// lock waits for the previous entry in the sequence to be written, then locks
+// the archive for writing.
+func (a *Archiver) lock(ctx context.Context, seq *sequence) error {
+	select {
+	case <-seq.prev:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
 	a.m.Lock()
-	defer a.m.Unlock()
+	return nil
+}
+
+// unlock unlocks the archive and allows the next entry in the sequence to be
+// written.
+func (a *Archiver) unlock(seq *sequence) {
+	a.m.Unlock()
+	close(seq.done)
+}
+
+func (a *Archiver) createDirectory(ctx context.Context, fi os.FileInfo, hdr *zip.FileHeader, seq *sequence) error {
+	if err := a.lock(ctx, seq); err != nil {
+		return err
+	}
+	defer a.unlock(seq)
 
 	_, err := a.createHeader(fi, hdr)
 	incOnSuccess(&a.entries, err)
 	return err
 }
 
-func (a *Archiver) createSymlink(path string, fi os.FileInfo, hdr *zip.FileHeader) error {
-	a.m.Lock()
-	defer a.m.Unlock()
+func (a *Archiver) createSymlink(ctx context.Context, path string, fi os.FileInfo, hdr *zip.FileHeader, seq *sequence) error {
+	if err := a.lock(ctx, seq); err != nil {
+		return err
+	}
+	defer a.unlock(seq)
 
 	w, err := a.createHeader(fi, hdr)
 	if err != nil {
@@ -243,14 +635,21 @@ func (a *Archiver) createSymlink(path string, fi os.FileInfo, hdr *zip.FileHeade
 	return err
 }
 
-func (a *Archiver) createFile(ctx context.Context, path string, fi os.FileInfo, hdr *zip.FileHeader, tmp *filepool.File) error {
+func (a *Archiver) createFile(ctx context.Context, path string, fi os.FileInfo, hdr *zip.FileHeader, seq *sequence, tmp *filepool.File) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	return a.compressFile(ctx, f, fi, hdr, tmp)
+	var r io.Reader = f
+	if a.options.contentFunc != nil {
+		if r, err = a.options.contentFunc(hdr.Name, f); err != nil {
+			return err
+		}
+	}
+
+	return a.compressFile(ctx, r, fi, hdr, seq, tmp)
 }
 
 // compressFile pre-compresses the file first to a file from the filepool,
@@ -258,13 +657,26 @@ func (a *Archiver) createFile(ctx context.Context, path string, fi os.FileInfo,
 // compressed and then added to the zip file when ready.
 // If no filepool file is available (when using a concurrency of 1) or the
 // compressed file is larger than the uncompressed version, the file is moved
-// to the zip file using the conventional zip.CreateHeader.
-func (a *Archiver) compressFile(ctx context.Context, f *os.File, fi os.FileInfo, hdr *zip.FileHeader, tmp *filepool.File) error {
+// to the zip file using the conventional zip.CreateHeader. The file's content
+// is read from r, which is only read again to store it uncompressed if it can
+// be seeked.
+func (a *Archiver) compressFile(ctx context.Context, r io.Reader, fi os.FileInfo, hdr *zip.FileHeader, seq *sequence, tmp *filepool.File) error {
+	if a.options.adaptiveCompression && hdr.Method != zip.Store {
+		var compressible bool
+		var err error
+		if r, compressible, err = a.sampleCompression(r, hdr.Method); err != nil {
+			return err
+		}
+		if !compressible {
+			hdr.Method = zip.Store
+		}
+	}
+
 	comp, ok := a.compressors[hdr.Method]
 	// if we don't have the registered compressor, it most likely means Store is
 	// being used, so we revert to non-concurrent behaviour
 	if !ok || tmp == nil {
-		return a.compressFileSimple(ctx, f, fi, hdr)
+		return a.compressFileSimple(ctx, r, fi, hdr, seq)
 	}
 
 	fw, err := comp(tmp)
@@ -272,27 +684,38 @@ func (a *Archiver) compressFile(ctx context.Context, f *os.File, fi os.FileInfo,
 		return err
 	}
 
-	br := bufioReaderPool.Get().(*bufio.Reader)
-	defer bufioReaderPool.Put(br)
-	br.Reset(f)
+	br := a.bufPool.Get().(*bufio.Reader)
+	defer a.bufPool.Put(br)
+	br.Reset(r)
 
-	_, err = io.Copy(io.MultiWriter(fw, tmp.Hasher()), br)
+	n, err := io.Copy(contextWriter{io.MultiWriter(fw, tmp.Hasher()), ctx}, br)
 	dclose(fw, &err)
 	if err != nil {
 		return err
 	}
 
+	// the size is of what was read, as the content may have been transformed
+	hdr.UncompressedSize64 = uint64(n)
 	hdr.CompressedSize64 = tmp.Written()
-	// if compressed file is larger, use the uncompressed version.
-	if hdr.CompressedSize64 > hdr.UncompressedSize64 {
-		f.Seek(0, io.SeekStart)
+	// if compressed file is larger, or with adaptive compression, not
+	// meaningfully smaller, use the uncompressed version.
+	expanded := hdr.CompressedSize64 > hdr.UncompressedSize64
+	if a.options.adaptiveCompression && !compressesEnough(hdr.CompressedSize64, hdr.UncompressedSize64) {
+		expanded = true
+	}
+	if s, ok := r.(io.Seeker); ok && expanded {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
 		hdr.Method = zip.Store
-		return a.compressFileSimple(ctx, f, fi, hdr)
+		return a.compressFileSimple(ctx, r, fi, hdr, seq)
 	}
 	hdr.CRC32 = tmp.Checksum()
 
-	a.m.Lock()
-	defer a.m.Unlock()
+	if err := a.lock(ctx, seq); err != nil {
+		return err
+	}
+	defer a.unlock(seq)
 
 	w, err := a.createHeaderRaw(fi, hdr)
 	if err != nil {
@@ -304,16 +727,76 @@ func (a *Archiver) compressFile(ctx context.Context, f *os.File, fi os.FileInfo,
 	return err
 }
 
+// adaptiveSampleSize is the amount of a file's content compressed to decide
+// whether it's worth compressing when adaptive compression is enabled.
+const adaptiveSampleSize = 64 * 1024
+
+// sampleCompression compresses the start of a file's content with method, to
+// decide whether the file is worth compressing, and returns a reader of the
+// whole of the content. Content that fits within the sample is compressed in
+// its entirety.
+func (a *Archiver) sampleCompression(r io.Reader, method uint16) (io.Reader, bool, error) {
+	comp, ok := a.compressors[method]
+	if !ok {
+		return r, true, nil
+	}
+
+	sample := make([]byte, adaptiveSampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	sample = sample[:n]
+
+	if s, ok := r.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+	} else {
+		r = io.MultiReader(bytes.NewReader(sample), r)
+	}
+
+	var compressed byteCounter
+	fw, err := comp(&compressed)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = fw.Write(sample)
+	dclose(fw, &err)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return r, compressesEnough(uint64(compressed), uint64(n)), nil
+}
+
+// compressesEnough returns whether compression saves at least 1/20th of the
+// uncompressed size, which for smaller savings isn't worth the overhead of
+// decompressing.
+func compressesEnough(compressed, uncompressed uint64) bool {
+	return compressed < uncompressed-uncompressed/20
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
 // compressFileSimple uses the conventional zip.createHeader. This differs from
 // compressFile as it locks the zip _whilst_ compressing (if the method is not
 // Store).
-func (a *Archiver) compressFileSimple(ctx context.Context, f *os.File, fi os.FileInfo, hdr *zip.FileHeader) error {
-	br := bufioReaderPool.Get().(*bufio.Reader)
-	defer bufioReaderPool.Put(br)
-	br.Reset(f)
+func (a *Archiver) compressFileSimple(ctx context.Context, r io.Reader, fi os.FileInfo, hdr *zip.FileHeader, seq *sequence) error {
+	br := a.bufPool.Get().(*bufio.Reader)
+	defer a.bufPool.Put(br)
+	br.Reset(r)
 
-	a.m.Lock()
-	defer a.m.Unlock()
+	if err := a.lock(ctx, seq); err != nil {
+		return err
+	}
+	defer a.unlock(seq)
 
 	w, err := a.createHeader(fi, hdr)
 	if err != nil {
@@ -2,21 +2,89 @@ package fastzip
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/flate"
 )
 
 var (
-	ErrMinConcurrency = errors.New("concurrency must be at least 1")
+	ErrMinConcurrency          = errors.New("concurrency must be at least 1")
+	ErrNegativeBufferSize      = errors.New("buffer size cannot be negative")
+	ErrInvalidCompressionLevel = errors.New("compression level must be between -2 and 9")
+	ErrUnsupportedType         = errors.New("unsupported file type")
+)
+
+// MethodDefault can be returned by the function provided to
+// WithArchiverMethodFunc to use the method the archiver would otherwise use.
+const MethodDefault uint16 = 0xffff
+
+// DefaultStoreExtensions are extensions of common file formats that are
+// already compressed, for use with WithArchiverStoreByExtension.
+var DefaultStoreExtensions = []string{
+	".7z", ".apk", ".avi", ".br", ".bz2", ".docx", ".flac", ".gif", ".gz",
+	".jar", ".jpeg", ".jpg", ".m4a", ".mkv", ".mov", ".mp3", ".mp4", ".ogg",
+	".png", ".pptx", ".rar", ".webm", ".webp", ".whl", ".xlsx", ".xz", ".zip",
+	".zst",
+}
+
+// UnsupportedTypePolicy determines how files that cannot be archived or
+// extracted, such as devices, named pipes and sockets, are handled.
+type UnsupportedTypePolicy int
+
+const (
+	// UnsupportedTypeSkip skips the file.
+	UnsupportedTypeSkip UnsupportedTypePolicy = iota
+
+	// UnsupportedTypeError causes archiving or extraction to fail with an
+	// error wrapping ErrUnsupportedType.
+	UnsupportedTypeError
+
+	// UnsupportedTypeLog skips the file, and when extracting, logs it with
+	// LogEntrySkip and counts it as skipped. The archiver has no logger, so
+	// skips the file as UnsupportedTypeSkip does.
+	UnsupportedTypeLog
 )
 
 // ArchiverOption is an option used when creating an archiver.
 type ArchiverOption func(*archiverOptions) error
 
 type archiverOptions struct {
-	method      uint16
-	concurrency int
-	bufferSize  int
-	stageDir    string
-	offset      int64
+	method                uint16
+	compressLevel         int
+	concurrency           int
+	bufferSize            int
+	readBufferSize        int
+	stageDir              string
+	offset                int64
+	storeXattrs           bool
+	storeFlags            bool
+	forceZip64            bool
+	storeEmptyDirs        bool
+	storeAccessTime       bool
+	utf8Names             bool
+	adaptiveCompression   bool
+	excludes              []string
+	modifiedAfter         time.Time
+	storeExts             map[string]struct{}
+	unsupportedTypePolicy UnsupportedTypePolicy
+
+	followSymlinks             bool
+	followSymlinksWithinChroot bool
+	methodFunc                 func(name string, fi os.FileInfo) uint16
+	nameFunc                   func(name string) (string, error)
+	baseDir                    string
+	comment                    string
+	commentFunc                func(name string) string
+	contentFunc                func(name string, r io.Reader) (io.Reader, error)
+
+	deterministic bool
+	modifiedEpoch time.Time
 }
 
 // WithArchiverMethod sets the zip method to be used for compressible files.
@@ -27,6 +95,20 @@ func WithArchiverMethod(method uint16) ArchiverOption {
 	}
 }
 
+// WithArchiverCompressLevel sets the compression level of the Deflate
+// compressor, from flate.HuffmanOnly (-2) to flate.BestCompression (9). Lower
+// levels are faster but produce larger archives, higher levels are slower but
+// produce smaller archives. The default is flate.DefaultCompression (-1).
+func WithArchiverCompressLevel(level int) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return ErrInvalidCompressionLevel
+		}
+		o.compressLevel = level
+		return nil
+	}
+}
+
 // WithArchiverConcurrency will set the maximum number of files to be
 // compressed concurrently. The default is set to GOMAXPROCS.
 func WithArchiverConcurrency(n int) ArchiverOption {
@@ -43,17 +125,34 @@ func WithArchiverConcurrency(n int) ArchiverOption {
 // concurrently. If a compressed file's data exceeds the buffer size, a
 // temporary file is written (to the stage directory) to hold the additional
 // data. The default is 2 mebibytes, so if concurrency is 16, 32 mebibytes of
-// memory will be allocated.
+// memory will be allocated. A size of 0 disables the buffer, so that every
+// concurrently compressed file is staged on disk. Larger buffers avoid staging
+// large files, whereas smaller buffers use less memory when archiving many
+// small files. A negative size returns ErrNegativeBufferSize.
 func WithArchiverBufferSize(n int) ArchiverOption {
 	return func(o *archiverOptions) error {
 		if n < 0 {
-			n = 0
+			return ErrNegativeBufferSize
 		}
 		o.bufferSize = n
 		return nil
 	}
 }
 
+// WithArchiverReadBufferSize sets the size of the buffer each file is read
+// through as it's compressed. Larger buffers reduce the number of reads for
+// large files, whereas smaller buffers use less memory when compressing many
+// files concurrently. The default is 32 kibibytes.
+func WithArchiverReadBufferSize(n int) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if n <= 0 {
+			return ErrMinBufferSize
+		}
+		o.readBufferSize = n
+		return nil
+	}
+}
+
 // WithStageDirectory sets the directory to be used to stage compressed files
 // before they're written to the archive. The default is the directory to be
 // archived.
@@ -72,3 +171,280 @@ func WithArchiverOffset(n int64) ArchiverOption {
 		return nil
 	}
 }
+
+// WithArchiverStoreXattrs enables storing each file's extended attributes in
+// the ExtraFieldXattrs extra field. Storing extended attributes is supported
+// on Linux, macOS, FreeBSD and NetBSD, and is a no-op on other platforms.
+func WithArchiverStoreXattrs(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeXattrs = store
+		return nil
+	}
+}
+
+// WithArchiverStoreFileFlags enables storing each file's flags, such as the
+// immutable and append-only flags set by chattr, in the ExtraFieldFileFlags
+// extra field. Storing file flags is supported on Linux, and is a no-op on
+// other platforms.
+func WithArchiverStoreFileFlags(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeFlags = store
+		return nil
+	}
+}
+
+// WithArchiverStoreAccessTime enables storing each file's access time, along
+// with its modification and creation times, in the NTFS extra field. Creation
+// times are only available on Windows, and the modification time is stored in
+// their place on other platforms. Access times are not stored when
+// deterministic output is enabled.
+func WithArchiverStoreAccessTime(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeAccessTime = store
+		return nil
+	}
+}
+
+// WithArchiverUTF8Names sets the UTF-8 flag of entries with names or comments
+// that contain non-ASCII characters, so that other tools decode them
+// correctly. Some legacy readers misbehave when the flag is set, and disabling
+// it stores these names without the flag. The default is true.
+func WithArchiverUTF8Names(utf8 bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.utf8Names = utf8
+		return nil
+	}
+}
+
+// WithArchiverAdaptiveCompression stores files that compression doesn't
+// meaningfully shrink: if compressing the start of a file, or the whole of a
+// small file, doesn't save at least 5%, it's stored instead. If the file is
+// compressed but the whole of it then fails to save 5%, it's stored instead
+// too. This trades the CPU time spent compressing a sample for not expanding
+// incompressible data. Files archived with a concurrency of 1, or whose
+// content is transformed by WithArchiverContentFunc, are only sampled, as
+// they're compressed as they're written.
+func WithArchiverAdaptiveCompression(adaptive bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.adaptiveCompression = adaptive
+		return nil
+	}
+}
+
+// WithArchiverForceZip64 always writes Zip64 records, rather than only when
+// an archive's size, or its number of entries, requires them. Every central
+// directory record stores its sizes and offset in a Zip64 extra field, and the
+// Zip64 end of central directory record is written. This can be used for
+// compatibility with readers that expect Zip64 archives, but archives are no
+// longer readable by readers that don't support Zip64.
+func WithArchiverForceZip64(force bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.forceZip64 = force
+		return nil
+	}
+}
+
+// WithArchiverStoreEmptyDirs enables storing an entry for every directory
+// archived, with a name ending in a slash, the Store method and no data, so
+// that empty directories, and each directory's mode and modification time, are
+// recreated on extraction. It is enabled by default. When disabled, directory
+// entries are omitted, as many tools do, and directories are only recreated as
+// the parents of other entries.
+func WithArchiverStoreEmptyDirs(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeEmptyDirs = store
+		return nil
+	}
+}
+
+// WithArchiverExcludes skips files that match any of the patterns provided.
+// Patterns use path.Match syntax and are matched against each file's path
+// relative to the chroot, using forward slashes. A pattern without a slash,
+// such as "*.tmp", is matched against the base name of the file instead.
+//
+// Files within an excluded directory are excluded too, even if they do not
+// match a pattern themselves.
+func WithArchiverExcludes(patterns ...string) ArchiverOption {
+	return func(o *archiverOptions) error {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("exclude pattern %q: %w", pattern, err)
+			}
+		}
+		o.excludes = append(o.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithArchiverModifiedAfter skips regular files that weren't modified after t,
+// so that an incremental archive of only the files changed since a previous
+// archive was created can be layered onto it. Directories and symlinks are
+// still archived. Excluded files are skipped regardless of when they were
+// modified. A zero time includes every file, which is the default.
+func WithArchiverModifiedAfter(t time.Time) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.modifiedAfter = t
+		return nil
+	}
+}
+
+// WithArchiverUnsupportedTypePolicy sets how files that cannot be archived,
+// such as devices, named pipes and sockets, are handled. This includes the
+// hard links of a tar stream archived by ArchiveTar. The default is
+// UnsupportedTypeSkip.
+func WithArchiverUnsupportedTypePolicy(policy UnsupportedTypePolicy) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.unsupportedTypePolicy = policy
+		return nil
+	}
+}
+
+// WithArchiverDeterministic enables reproducible output, so that archiving the
+// same files twice produces identical archives. Modification times are set to
+// the epoch set by WithArchiverModifiedEpoch and ownership is not stored.
+// WithArchiverAdaptiveCompression has no effect. Any compressors registered
+// must also produce deterministic output, and the concurrency should be the
+// same, as files that are larger once compressed are stored uncompressed when
+// they're staged, whereas with a concurrency of 1 they're compressed as
+// they're written, without being staged.
+func WithArchiverDeterministic(deterministic bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.deterministic = deterministic
+		return nil
+	}
+}
+
+// WithArchiverModifiedEpoch sets the modification time used for every entry
+// when deterministic output is enabled. The default is 1980-01-01 00:00:00
+// UTC, the earliest time an MS-DOS timestamp can represent.
+func WithArchiverModifiedEpoch(t time.Time) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.modifiedEpoch = t
+		return nil
+	}
+}
+
+// WithArchiverStoreByExtension uses the Store method, rather than the method
+// set by WithArchiverMethod, for files with any of the extensions provided.
+// This avoids spending time compressing files that are already compressed.
+// Extensions are matched case-insensitively, and DefaultStoreExtensions
+// provides a list of common compressed formats.
+func WithArchiverStoreByExtension(exts ...string) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if o.storeExts == nil {
+			o.storeExts = make(map[string]struct{})
+		}
+		for _, ext := range exts {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			o.storeExts[strings.ToLower(ext)] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// WithArchiverFollowSymlinks archives the target of each symlink in place of
+// the symlink itself, so that a symlink to a file is stored as a regular file
+// and a symlink to a directory is stored as a directory, along with everything
+// within it. Targets outside of the chroot are followed too, unless
+// WithArchiverFollowSymlinksWithinChroot is used. Archiving fails if a
+// symlink's target does not exist, or with ErrSymlinkCycle if a symlink links
+// to itself or to a directory that contains it.
+func WithArchiverFollowSymlinks(follow bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.followSymlinks = follow
+		return nil
+	}
+}
+
+// WithArchiverFollowSymlinksWithinChroot follows symlinks as
+// WithArchiverFollowSymlinks does, but fails with ErrSymlinkOutsideChroot if a
+// symlink's target, with every symlink in its path resolved, is outside of the
+// chroot.
+func WithArchiverFollowSymlinksWithinChroot(within bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.followSymlinks = within
+		o.followSymlinksWithinChroot = within
+		return nil
+	}
+}
+
+// WithArchiverMethodFunc sets a function that chooses the method used for each
+// file that isn't empty. The name provided is relative to the chroot and uses
+// forward slashes. Returning MethodDefault uses the method set by
+// WithArchiverMethod and WithArchiverStoreByExtension. Archiving fails if the
+// method returned has no registered compressor.
+func WithArchiverMethodFunc(fn func(name string, fi os.FileInfo) uint16) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.methodFunc = fn
+		return nil
+	}
+}
+
+// WithArchiverNameFunc sets a function that returns the name each file is
+// archived as by Archive. The name provided is the file's path relative to the
+// chroot, using forward slashes, and the name returned must be relative and
+// cannot reference parent directories. Returning an empty name skips the file,
+// and returning an error stops archiving.
+//
+// Parent directories implied by the names returned are archived too, with a
+// mode of 0755 and the current time, if they are not themselves one of the
+// files archived. Patterns set by WithArchiverExcludes are matched against the
+// names returned.
+func WithArchiverNameFunc(fn func(name string) (string, error)) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.nameFunc = fn
+		return nil
+	}
+}
+
+// WithArchiverComment sets the archive's comment, stored in the end of central
+// directory record. Comments are limited to 65535 bytes. When appending, the
+// existing archive's comment is replaced, and is otherwise preserved.
+func WithArchiverComment(comment string) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.comment = comment
+		return nil
+	}
+}
+
+// WithArchiverCommentFunc sets a function that returns the comment stored for
+// each file. The name provided is relative to the chroot and uses forward
+// slashes. Returning an empty comment stores no comment.
+func WithArchiverCommentFunc(fn func(name string) string) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.commentFunc = fn
+		return nil
+	}
+}
+
+// WithArchiverContentFunc sets a function that can wrap or replace the content
+// of each regular file before it is compressed, such as to inject a build
+// timestamp. The name provided is the name the file is archived as, and
+// returning r unchanged archives the file's content as is. The size and
+// checksum stored are of the content read from the reader returned, rather
+// than of the file. The function may be called from multiple goroutines
+// concurrently.
+func WithArchiverContentFunc(fn func(name string, r io.Reader) (io.Reader, error)) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.contentFunc = fn
+		return nil
+	}
+}
+
+// WithArchiverBaseDir sets the directory that names are relative to, rather
+// than the chroot, so that archiving /data/project/src with a base directory
+// of /data/project stores names beginning with src/. Archive fails if a file
+// is outside of the base directory. The function set by WithArchiverNameFunc
+// is called with names relative to the base directory.
+func WithArchiverBaseDir(dir string) ArchiverOption {
+	return func(o *archiverOptions) error {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		o.baseDir = dir
+		return nil
+	}
+}
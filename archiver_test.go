@@ -1,12 +1,20 @@
 package fastzip
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -16,6 +24,7 @@ import (
 
 	"github.com/klauspost/compress/zip"
 	"github.com/klauspost/compress/zstd"
+	"github.com/saracen/zipextra"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -112,7 +121,9 @@ func TestArchive(t *testing.T) {
 	tests := map[string][]ArchiverOption{
 		"default options":    nil,
 		"no buffer":          {WithArchiverBufferSize(0)},
+		"small read buffer":  {WithArchiverReadBufferSize(16)},
 		"with store":         {WithArchiverMethod(zip.Store)},
+		"with zstd":          {WithArchiverMethod(zstd.ZipMethodWinZip)},
 		"with concurrency 2": {WithArchiverConcurrency(2)},
 	}
 
@@ -136,6 +147,139 @@ func TestArchive(t *testing.T) {
 	}
 }
 
+func TestArchiveFiles(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go":     {mode: 0640, contents: "foo"},
+		"bar":        {mode: os.ModeDir | 0700},
+		"bar/bar.go": {mode: 0600, contents: "bar"},
+	}
+
+	_, dir := testCreateFiles(t, testFiles)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, a.ArchiveFiles(context.Background(), map[string]string{
+		"src/main.go":  filepath.Join(dir, "foo.go"),
+		"src/lib/":     filepath.Join(dir, "bar"),
+		"src/lib/b.go": filepath.Join(dir, "bar", "bar.go"),
+		"other/a.go":   filepath.Join(dir, "foo.go"),
+	}))
+	require.NoError(t, a.Close())
+
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+
+	modes := make(map[string]os.FileMode)
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+		modes[file.Name] = file.Mode()
+		assert.False(t, file.Modified.IsZero(), file.Name)
+	}
+
+	assert.Equal(t, []string{"other/", "other/a.go", "src/", "src/lib/", "src/lib/b.go", "src/main.go"}, names)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.ModeDir|0755, modes["src/"])
+		assert.Equal(t, os.ModeDir|0700, modes["src/lib/"])
+		assert.Equal(t, os.FileMode(0640), modes["src/main.go"])
+		assert.Equal(t, os.FileMode(0600), modes["src/lib/b.go"])
+	}
+
+	for _, files := range []map[string]string{
+		{"../foo.go": filepath.Join(dir, "foo.go")},
+		{"/foo.go": filepath.Join(dir, "foo.go")},
+		{"foo.go": filepath.Join(dir, "foo.go"), "foo.go/bar.go": filepath.Join(dir, "foo.go")},
+		{"missing.go": filepath.Join(dir, "missing.go")},
+	} {
+		a, err := NewArchiver(io.Discard, dir)
+		require.NoError(t, err)
+		assert.Error(t, a.ArchiveFiles(context.Background(), files))
+	}
+}
+
+func TestArchiveAppend(t *testing.T) {
+	for _, prefix := range []string{"", "#!/bin/sh\nexit 0\n"} {
+		t.Run(fmt.Sprintf("prefixed %v", prefix != ""), func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "archive.zip")
+
+			f, err := os.Create(archivePath)
+			require.NoError(t, err)
+			_, err = io.WriteString(f, prefix)
+			require.NoError(t, err)
+
+			zw := zip.NewWriter(f)
+			w, err := zw.Create("existing.go")
+			require.NoError(t, err)
+			_, err = io.WriteString(w, "existing")
+			require.NoError(t, err)
+			require.NoError(t, zw.SetComment("comment"))
+			require.NoError(t, zw.Close())
+			require.NoError(t, f.Close())
+
+			files, dir := testCreateFiles(t, map[string]testFile{
+				"foo.go": {mode: 0666, contents: strings.Repeat("foo", 1024)},
+				"bar.go": {mode: 0666, contents: "bar"},
+			})
+
+			a, err := NewArchiverAppend(archivePath, dir, WithArchiverConcurrency(2))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			zr, err := zip.OpenReader(archivePath)
+			require.NoError(t, err)
+			defer zr.Close()
+
+			assert.Equal(t, "comment", zr.Comment)
+
+			contents := make(map[string]string)
+			for _, file := range zr.File {
+				rc, err := file.Open()
+				require.NoError(t, err)
+				b, err := io.ReadAll(rc)
+				require.NoError(t, err)
+				require.NoError(t, rc.Close())
+				contents[file.Name] = string(b)
+			}
+
+			assert.Equal(t, map[string]string{
+				"./":          "",
+				"existing.go": "existing",
+				"foo.go":      strings.Repeat("foo", 1024),
+				"bar.go":      "bar",
+			}, contents)
+
+			b, err := os.ReadFile(archivePath)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(b), prefix))
+		})
+	}
+
+	t.Run("zip64 directory end", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		d := directoryEnd{zip64: true, diskRecords: 70000, records: 70000, comment: "comment"}
+		require.NoError(t, writeDirectoryEnd(buf, d, 0))
+
+		end, base, err := readDirectoryEnd(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		assert.Equal(t, d, end)
+		assert.Zero(t, base)
+	})
+
+	t.Run("not a zip", func(t *testing.T) {
+		archivePath := filepath.Join(t.TempDir(), "archive.zip")
+		require.NoError(t, os.WriteFile(archivePath, []byte("not a zip"), 0666))
+
+		_, err := NewArchiverAppend(archivePath, t.TempDir())
+		assert.ErrorIs(t, err, zip.ErrFormat)
+	})
+}
+
 func TestArchiveCancelContext(t *testing.T) {
 	twoMB := strings.Repeat("1", 2*1024*1024)
 	testFiles := map[string]testFile{}
@@ -183,6 +327,36 @@ func TestArchiveCancelContext(t *testing.T) {
 	}
 }
 
+func TestArchiveCancelContextConcurrent(t *testing.T) {
+	large := strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 256*1024)
+	testFiles := map[string]testFile{}
+	for i := 0; i < 20; i++ {
+		testFiles[fmt.Sprintf("file_%d", i)] = testFile{mode: 0666, contents: large}
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls int
+	a, err := NewArchiver(io.Discard, dir, WithArchiverConcurrency(4), WithArchiverBufferSize(0),
+		WithArchiverMethodFunc(func(name string, fi os.FileInfo) uint16 {
+			// cancel once a few files are being compressed
+			if calls++; calls == 3 {
+				cancel()
+			}
+			return MethodDefault
+		}),
+	)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, a.Archive(ctx, files), context.Canceled)
+
+	_, entries := a.Written()
+	assert.Less(t, entries, int64(len(files)))
+}
+
 func TestArchiveWithCompressor(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foo.go": {mode: 0666},
@@ -236,6 +410,49 @@ func TestArchiveWithMethod(t *testing.T) {
 	testExtract(t, f.Name(), testFiles)
 }
 
+func TestArchiveWithMethodFunc(t *testing.T) {
+	contents := strings.Repeat("compressible", 1024)
+	testFiles := map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/store":   {mode: 0666, contents: contents},
+		"foo/zstd":    {mode: 0666, contents: contents},
+		"foo/default": {mode: 0666, contents: contents},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	methodFunc := func(name string, fi os.FileInfo) uint16 {
+		switch name {
+		case "foo/store":
+			return zip.Store
+		case "foo/zstd":
+			return zstd.ZipMethodWinZip
+		}
+		return MethodDefault
+	}
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		methods := make(map[string]uint16)
+		for _, file := range zr.File {
+			methods[file.Name] = file.Method
+		}
+
+		assert.Equal(t, zip.Store, methods["foo/store"])
+		assert.Equal(t, uint16(zstd.ZipMethodWinZip), methods["foo/zstd"])
+		assert.Equal(t, zip.Deflate, methods["foo/default"])
+	}, WithArchiverMethodFunc(methodFunc))
+
+	a, err := NewArchiver(io.Discard, dir, WithArchiverMethodFunc(func(name string, fi os.FileInfo) uint16 {
+		return 1234
+	}))
+	require.NoError(t, err)
+	assert.ErrorIs(t, a.Archive(context.Background(), files), zip.ErrAlgorithm)
+}
+
 func TestArchiveWithStageDirectory(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foo.go": {mode: 0666},
@@ -312,6 +529,36 @@ func TestArchiveWithConcurrency(t *testing.T) {
 	}
 }
 
+func TestArchiveWithConcurrencyOrder(t *testing.T) {
+	testFiles := make(map[string]testFile)
+	for i := 0; i < 64; i++ {
+		// earlier files are larger, so that they take longer to compress
+		testFiles[fmt.Sprintf("%02d.go", i)] = testFile{mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdf", (64-i)*1024)}
+	}
+	testFiles["dir"] = testFile{mode: os.ModeDir | 0777}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		var names []string
+		for _, file := range zr.File {
+			names = append(names, file.Name)
+
+			rc, err := file.Open()
+			require.NoError(t, err)
+			_, err = io.Copy(io.Discard, rc)
+			require.NoError(t, err, file.Name)
+			require.NoError(t, rc.Close())
+		}
+
+		assert.True(t, sort.StringsAreSorted(names), "entries should be written in name order")
+	}, WithArchiverConcurrency(8))
+}
+
 func TestArchiveWithBufferSize(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foobar.go":      {mode: 0666},
@@ -321,38 +568,27 @@ func TestArchiveWithBufferSize(t *testing.T) {
 		"large_file":     {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 65536)},
 	}
 
-	tests := []struct {
-		buffersize int
-		zero       bool
-	}{
-		{-100, false},
-		{-2, false},
-		{-1, false},
-		{0, true},
-		{32 * 1024, true},
-		{64 * 1024, true},
-	}
-
 	files, dir := testCreateFiles(t, testFiles)
 	defer os.RemoveAll(dir)
 
-	for _, test := range tests {
+	for _, n := range []int{-100, -1} {
+		_, err := NewArchiver(io.Discard, dir, WithArchiverBufferSize(n))
+		assert.ErrorIs(t, err, ErrNegativeBufferSize, n)
+	}
+
+	for _, buffersize := range []int{0, 1, 32 * 1024, 64 * 1024} {
 		func() {
 			f, err := ioutil.TempFile("", "fastzip-test")
 			require.NoError(t, err)
 			defer os.Remove(f.Name())
 			defer f.Close()
 
-			a, err := NewArchiver(f, dir, WithArchiverBufferSize(test.buffersize))
+			a, err := NewArchiver(f, dir, WithArchiverBufferSize(buffersize))
 			require.NoError(t, err)
 			require.NoError(t, a.Archive(context.Background(), files))
 			require.NoError(t, a.Close())
 
-			if !test.zero {
-				require.Equal(t, 0, a.options.bufferSize)
-			} else {
-				require.Equal(t, test.buffersize, a.options.bufferSize)
-			}
+			require.Equal(t, buffersize, a.options.bufferSize)
 
 			_, entries := a.Written()
 			require.EqualValues(t, 6, entries)
@@ -362,6 +598,36 @@ func TestArchiveWithBufferSize(t *testing.T) {
 	}
 }
 
+func TestArchiveWithReadBufferSize(t *testing.T) {
+	testFiles := map[string]testFile{
+		"small":      {mode: 0666, contents: "small"},
+		"large_file": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 65536)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	for _, n := range []int{-1, 0} {
+		_, err := NewArchiver(io.Discard, dir, WithArchiverReadBufferSize(n))
+		assert.ErrorIs(t, err, ErrMinBufferSize, n)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		a, err := NewArchiver(f, dir, WithArchiverReadBufferSize(16), WithArchiverConcurrency(concurrency))
+		require.NoError(t, err)
+		assert.Equal(t, 16, a.bufPool.Get().(*bufio.Reader).Size())
+
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		testExtract(t, f.Name(), testFiles)
+	}
+}
+
 func TestArchiveChroot(t *testing.T) {
 	dir := t.TempDir()
 	f, err := os.Create(filepath.Join(dir, "archive.zip"))
@@ -436,103 +702,1344 @@ func TestArchiveWithOffset(t *testing.T) {
 
 var archiveDir = flag.String("archivedir", runtime.GOROOT(), "The directory to use for archive benchmarks")
 
-func benchmarkArchiveOptions(b *testing.B, stdDeflate bool, options ...ArchiverOption) {
-	files := make(map[string]os.FileInfo)
-	size := int64(0)
-	filepath.Walk(*archiveDir, func(filename string, fi os.FileInfo, err error) error {
-		files[filename] = fi
-		size += fi.Size()
-		return nil
-	})
-
-	dir := b.TempDir()
+func TestArchiveWithNameFunc(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go":     {mode: 0666, contents: "foo"},
+		"foo.tmp":    {mode: 0666},
+		"bar":        {mode: os.ModeDir | 0777},
+		"bar/bar.go": {mode: 0666, contents: "bar"},
+	}
 
-	options = append(options, WithStageDirectory(dir))
+	files, dir := testCreateFiles(t, testFiles)
 
-	b.ReportAllocs()
-	b.SetBytes(size)
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		f, err := os.Create(filepath.Join(dir, "fastzip-benchmark.zip"))
-		require.NoError(b, err)
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
 
-		a, err := NewArchiver(f, *archiveDir, options...)
-		if stdDeflate {
-			a.RegisterCompressor(zip.Deflate, StdFlateCompressor(-1))
-		} else {
-			a.RegisterCompressor(zip.Deflate, FlateCompressor(-1))
+	a, err := NewArchiver(f, dir, WithArchiverNameFunc(func(name string) (string, error) {
+		if strings.HasSuffix(name, ".tmp") {
+			return "", nil
 		}
-		require.NoError(b, err)
+		return path.Join("release-1.2.3", "src", name), nil
+	}))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
 
-		err = a.Archive(context.Background(), files)
-		require.NoError(b, err)
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
 
-		require.NoError(b, a.Close())
-		require.NoError(b, f.Close())
-		require.NoError(b, os.Remove(f.Name()))
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
 	}
-}
+	assert.Equal(t, []string{
+		"release-1.2.3/",
+		"release-1.2.3/src/",
+		"release-1.2.3/src/bar/",
+		"release-1.2.3/src/bar/bar.go",
+		"release-1.2.3/src/foo.go",
+	}, names)
+
+	t.Run("invalid name", func(t *testing.T) {
+		a, err := NewArchiver(io.Discard, dir, WithArchiverNameFunc(func(name string) (string, error) {
+			return "../" + name, nil
+		}))
+		require.NoError(t, err)
+		assert.Error(t, a.Archive(context.Background(), files))
+	})
 
-func BenchmarkArchiveStore_1(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(1), WithArchiverMethod(zip.Store))
+	t.Run("duplicate name", func(t *testing.T) {
+		a, err := NewArchiver(io.Discard, dir, WithArchiverNameFunc(func(name string) (string, error) {
+			return "same", nil
+		}))
+		require.NoError(t, err)
+		assert.Error(t, a.Archive(context.Background(), files))
+	})
 }
 
-func BenchmarkArchiveStandardFlate_1(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(1))
-}
+func TestArchiveGetters(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewArchiver(io.Discard, dir, WithArchiverConcurrency(3), WithArchiverMethod(zip.Store))
+	require.NoError(t, err)
 
-func BenchmarkArchiveStandardFlate_2(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(2))
+	assert.Equal(t, dir, a.Chroot())
+	assert.Equal(t, 3, a.Concurrency())
+	assert.Equal(t, fmt.Sprintf("Archiver{chroot: %q, concurrency: 3, method: 0}", dir), a.String())
 }
 
-func BenchmarkArchiveStandardFlate_4(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(4))
-}
+func TestArchiveWithCustomMethod(t *testing.T) {
+	const method = 99
 
-func BenchmarkArchiveStandardFlate_8(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(8))
-}
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: strings.Repeat("foo", 1000)},
+		"bar.go": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+	}
 
-func BenchmarkArchiveStandardFlate_16(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(16))
-}
+	files, dir := testCreateFiles(t, testFiles)
 
-func BenchmarkArchiveNonStandardFlate_1(b *testing.B) {
-	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(1))
-}
+	t.Run("unregistered", func(t *testing.T) {
+		a, err := NewArchiver(io.Discard, dir, WithArchiverMethod(method))
+		require.NoError(t, err)
+		assert.ErrorIs(t, a.Archive(context.Background(), files), zip.ErrAlgorithm)
+	})
 
-func BenchmarkArchiveNonStandardFlate_2(b *testing.B) {
-	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(2))
-}
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
 
-func BenchmarkArchiveNonStandardFlate_4(b *testing.B) {
-	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(4))
-}
+	a, err := NewArchiver(f, dir, WithArchiverMethod(method))
+	require.NoError(t, err)
+	a.RegisterCompressor(method, FlateCompressor(5))
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
 
-func BenchmarkArchiveNonStandardFlate_8(b *testing.B) {
-	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(8))
-}
+	chroot := t.TempDir()
+	e, err := NewExtractor(f.Name(), chroot)
+	require.NoError(t, err)
+	defer e.Close()
+	e.RegisterDecompressor(method, FlateDecompressor())
 
-func BenchmarkArchiveNonStandardFlate_16(b *testing.B) {
-	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(16), WithArchiverMethod(zstd.ZipMethodWinZip))
-}
+	for _, file := range e.Files() {
+		if !file.Mode().IsDir() {
+			assert.EqualValues(t, method, file.Method, file.Name)
+		}
+	}
 
-func BenchmarkArchiveZstd_1(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(1), WithArchiverMethod(zstd.ZipMethodWinZip))
+	require.NoError(t, e.Extract(context.Background()))
+	for name, tf := range testFiles {
+		data, err := os.ReadFile(filepath.Join(chroot, name))
+		require.NoError(t, err)
+		assert.Equal(t, tf.contents, string(data))
+	}
 }
 
-func BenchmarkArchiveZstd_2(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(2), WithArchiverMethod(zstd.ZipMethodWinZip))
+func TestArchiveInvalidConcurrency(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		_, err := NewArchiver(io.Discard, t.TempDir(), WithArchiverConcurrency(n))
+		assert.ErrorIs(t, err, ErrMinConcurrency, "concurrency %d", n)
+	}
 }
 
-func BenchmarkArchiveZstd_4(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(4), WithArchiverMethod(zstd.ZipMethodWinZip))
-}
+func TestArchiveWithBaseDir(t *testing.T) {
+	testFiles := map[string]testFile{
+		"project":              {mode: os.ModeDir | 0777},
+		"project/src":          {mode: os.ModeDir | 0777},
+		"project/src/main.go":  {mode: 0666, contents: "main"},
+		"project/src/lib":      {mode: os.ModeDir | 0777},
+		"project/src/lib/a.go": {mode: 0666, contents: "a"},
+		"project/README.md":    {mode: 0666, contents: "readme"},
+		"other":                {mode: os.ModeDir | 0777},
+		"other/ignored.go":     {mode: 0666, contents: "ignored"},
+	}
 
-func BenchmarkArchiveZstd_8(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(8), WithArchiverMethod(zstd.ZipMethodWinZip))
+	_, dir := testCreateFiles(t, testFiles)
+
+	files := make(map[string]os.FileInfo)
+	require.NoError(t, filepath.Walk(filepath.Join(dir, "project", "src"), func(path string, fi os.FileInfo, err error) error {
+		files[path] = fi
+		return err
+	}))
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverBaseDir(filepath.Join(dir, "project")))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	assert.Equal(t, []string{"src/", "src/lib/", "src/lib/a.go", "src/main.go"}, names)
+
+	t.Run("outside of base directory", func(t *testing.T) {
+		fi, err := os.Lstat(filepath.Join(dir, "other", "ignored.go"))
+		require.NoError(t, err)
+
+		a, err := NewArchiver(io.Discard, dir, WithArchiverBaseDir(filepath.Join(dir, "project")))
+		require.NoError(t, err)
+		assert.Error(t, a.Archive(context.Background(), map[string]os.FileInfo{filepath.Join(dir, "other", "ignored.go"): fi}))
+	})
 }
 
-func BenchmarkArchiveZstd_16(b *testing.B) {
-	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(16), WithArchiverMethod(zstd.ZipMethodWinZip))
+func TestArchiveSplit(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) string {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return string(b)
+	}
+
+	testFiles := map[string]testFile{
+		"foo":       {mode: os.ModeDir | 0777},
+		"foo/a.bin": {mode: 0666, contents: random(100 * 1024)},
+		"foo/b.bin": {mode: 0666, contents: random(50 * 1024)},
+		"c.bin":     {mode: 0666, contents: random(30 * 1024)},
+		"d.txt":     {mode: 0666, contents: "d"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	t.Run("multiple volumes", func(t *testing.T) {
+		out := t.TempDir()
+		archivePath := filepath.Join(out, "archive.zip")
+
+		a, err := NewArchiverSplit(archivePath, dir, minSplitSize)
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		volumes, err := filepath.Glob(filepath.Join(out, "archive.z*"))
+		require.NoError(t, err)
+		assert.Greater(t, len(volumes), 2)
+		for _, volume := range volumes {
+			fi, err := os.Stat(volume)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, fi.Size(), int64(minSplitSize))
+		}
+
+		chroot := t.TempDir()
+		e, err := NewExtractorSplit(archivePath, chroot)
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		for name, tf := range testFiles {
+			if tf.mode.IsDir() {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(chroot, name))
+			require.NoError(t, err)
+			assert.Equal(t, tf.contents, string(b), name)
+		}
+	})
+
+	t.Run("single volume", func(t *testing.T) {
+		archivePath := filepath.Join(t.TempDir(), "archive.zip")
+
+		a, err := NewArchiverSplit(archivePath, dir, 1<<20)
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		b, err := os.ReadFile(archivePath)
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(b, []byte("PK00")))
+
+		e, err := NewExtractorSplit(archivePath, t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+		assert.Equal(t, int64(6), e.FileCount())
+	})
+
+	t.Run("invalid size", func(t *testing.T) {
+		_, err := NewArchiverSplit(filepath.Join(t.TempDir(), "archive.zip"), dir, 1024)
+		assert.ErrorIs(t, err, ErrSplitSize)
+	})
+}
+
+func TestArchiveWithForceZip64(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+		"bar.go": {mode: 0666, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	for _, force := range []bool{false, true} {
+		t.Run(fmt.Sprintf("force %v", force), func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "archive.zip")
+			f, err := os.Create(archivePath)
+			require.NoError(t, err)
+			defer f.Close()
+
+			a, err := NewArchiver(f, dir, WithArchiverForceZip64(force))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			chroot := t.TempDir()
+			e, err := NewExtractor(archivePath, chroot)
+			require.NoError(t, err)
+			defer e.Close()
+
+			assert.Equal(t, force, e.IsZip64())
+			require.NoError(t, e.Extract(context.Background()))
+
+			for name, tf := range testFiles {
+				b, err := os.ReadFile(filepath.Join(chroot, name))
+				require.NoError(t, err)
+				assert.Equal(t, tf.contents, string(b))
+			}
+		})
+	}
+}
+
+func TestArchiveWithComments(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+		"bar.go": {mode: 0666, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	archivePath := filepath.Join(t.TempDir(), "archive.zip")
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir,
+		WithArchiverComment("archive comment"),
+		WithArchiverCommentFunc(func(name string) string {
+			if name == "foo.go" {
+				return "foo comment"
+			}
+			return ""
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	e, err := NewExtractor(archivePath, t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+	assert.Equal(t, "archive comment", e.Comment())
+
+	comments := make(map[string]string)
+	require.NoError(t, e.ExtractFilter(context.Background(), func(file *zip.File) bool {
+		comments[file.Name] = file.Comment
+		return false
+	}))
+	assert.Equal(t, map[string]string{"./": "", "foo.go": "foo comment", "bar.go": ""}, comments)
+
+	t.Run("append", func(t *testing.T) {
+		a, err := NewArchiverAppend(archivePath, dir)
+		require.NoError(t, err)
+		require.NoError(t, a.Close())
+
+		e, err := NewExtractor(archivePath, t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+		assert.Equal(t, "archive comment", e.Comment())
+	})
+}
+
+func TestArchiveWithStoreEmptyDirs(t *testing.T) {
+	testFiles := map[string]testFile{
+		"empty_dir":         {mode: os.ModeDir | 0750},
+		"full_dir":          {mode: os.ModeDir | 0755},
+		"full_dir/file.txt": {mode: 0666, contents: "contents"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	for _, store := range []bool{false, true} {
+		t.Run(fmt.Sprintf("store %v", store), func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "archive.zip")
+			f, err := os.Create(archivePath)
+			require.NoError(t, err)
+			defer f.Close()
+
+			a, err := NewArchiver(f, dir, WithArchiverStoreEmptyDirs(store))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			chroot := t.TempDir()
+			e, err := NewExtractor(archivePath, chroot)
+			require.NoError(t, err)
+			defer e.Close()
+
+			for _, file := range e.Files() {
+				if !strings.HasSuffix(file.Name, "/") {
+					continue
+				}
+				assert.True(t, store, file.Name)
+				assert.Equal(t, zip.Store, file.Method)
+				assert.Equal(t, uint64(0), file.UncompressedSize64)
+				assert.Equal(t, uint64(0), file.CompressedSize64)
+			}
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			fi, err := os.Stat(filepath.Join(chroot, "empty_dir"))
+			if !store {
+				assert.True(t, os.IsNotExist(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, fi.IsDir())
+			if runtime.GOOS != "windows" {
+				assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+			}
+			assert.Equal(t, fixedModTime.Unix(), fi.ModTime().Unix())
+
+			b, err := os.ReadFile(filepath.Join(chroot, "full_dir", "file.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "contents", string(b))
+		})
+	}
+}
+
+func TestArchiveTar(t *testing.T) {
+	modTime := time.Date(2020, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	members := []struct {
+		hdr      tar.Header
+		contents string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./dir/", Mode: 0750}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./dir/file.txt", Mode: 0640, Uid: 1234, Gid: 5678}, contents: "file contents"},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "./link", Linkname: "dir/file.txt", Mode: 0777}},
+		{hdr: tar.Header{Typeflag: tar.TypeFifo, Name: "./fifo", Mode: 0644}},
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, m := range members {
+		hdr := m.hdr
+		hdr.ModTime = modTime
+		hdr.Size = int64(len(m.contents))
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := io.WriteString(tw, m.contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	t.Run("skip", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		a, err := NewArchiver(f, t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, a.ArchiveTar(context.Background(), bytes.NewReader(buf.Bytes())))
+		require.NoError(t, a.Close())
+
+		_, entries := a.Written()
+		assert.Equal(t, int64(3), entries)
+
+		e, err := NewExtractor(f.Name(), t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+
+		expected := map[string]struct {
+			mode     os.FileMode
+			contents string
+		}{
+			"dir/":         {mode: os.ModeDir | 0750},
+			"dir/file.txt": {mode: 0640, contents: "file contents"},
+			"link":         {mode: os.ModeSymlink | 0777, contents: "dir/file.txt"},
+		}
+
+		require.Len(t, e.Files(), len(expected))
+		for _, file := range e.Files() {
+			exp, ok := expected[file.Name]
+			require.True(t, ok, file.Name)
+			assert.Equal(t, exp.mode, file.Mode(), file.Name)
+			assert.True(t, modTime.Equal(file.Modified), file.Name)
+
+			rc, err := file.Open()
+			require.NoError(t, err)
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			require.NoError(t, err)
+			assert.Equal(t, exp.contents, string(b), file.Name)
+
+			if file.Name == "dir/file.txt" {
+				fields, err := zipextra.Parse(file.Extra)
+				require.NoError(t, err)
+				unix, err := fields[zipextra.ExtraFieldUnixN].InfoZIPNewUnix()
+				require.NoError(t, err)
+				assert.Equal(t, int64(1234), unix.Uid.Int64())
+				assert.Equal(t, int64(5678), unix.Gid.Int64())
+			}
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		a, err := NewArchiver(f, t.TempDir(), WithArchiverUnsupportedTypePolicy(UnsupportedTypeError))
+		require.NoError(t, err)
+		assert.ErrorIs(t, a.ArchiveTar(context.Background(), bytes.NewReader(buf.Bytes())), ErrUnsupportedType)
+	})
+}
+
+func TestArchiveWithContentFunc(t *testing.T) {
+	testFiles := map[string]testFile{
+		"version.txt": {mode: 0666, contents: "version: dev"},
+		"other.txt":   {mode: 0666, contents: strings.Repeat("other", 1000)},
+		"empty.txt":   {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "archive.zip")
+			f, err := os.Create(archivePath)
+			require.NoError(t, err)
+			defer f.Close()
+
+			a, err := NewArchiver(f, dir, WithArchiverConcurrency(concurrency), WithArchiverContentFunc(func(name string, r io.Reader) (io.Reader, error) {
+				switch name {
+				case "version.txt":
+					return strings.NewReader(strings.Repeat("version: 1.2.3\n", 100)), nil
+				case "empty.txt":
+					return strings.NewReader("not empty"), nil
+				}
+				return r, nil
+			}))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			chroot := t.TempDir()
+			e, err := NewExtractor(archivePath, chroot)
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			for name, contents := range map[string]string{
+				"version.txt": strings.Repeat("version: 1.2.3\n", 100),
+				"other.txt":   testFiles["other.txt"].contents,
+				"empty.txt":   "not empty",
+			} {
+				b, err := os.ReadFile(filepath.Join(chroot, name))
+				require.NoError(t, err)
+				assert.Equal(t, contents, string(b), name)
+			}
+		})
+	}
+}
+
+func TestArchiveCopyEntry(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range []struct {
+		name     string
+		mode     os.FileMode
+		method   uint16
+		contents string
+	}{
+		{"foo/", os.ModeDir | 0777, zip.Store, ""},
+		{"foo/bar", 0640, zip.Deflate, strings.Repeat("bar", 1024)},
+		{"foo/baz", os.ModeSymlink | 0777, zip.Store, "bar"},
+	} {
+		hdr := &zip.FileHeader{Name: entry.name, Method: entry.method, Modified: fixedModTime, Comment: "comment"}
+		hdr.Extra = zipextra.NewInfoZIPNewUnix(big.NewInt(1000), big.NewInt(1001)).Encode()
+		hdr.SetMode(entry.mode)
+
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, entry.contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	src, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, t.TempDir())
+	require.NoError(t, err)
+	for _, file := range src.File {
+		require.NoError(t, a.CopyEntry(file))
+	}
+	require.NoError(t, a.Close())
+
+	_, entries := a.Written()
+	assert.EqualValues(t, 3, entries)
+
+	dst, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer dst.Close()
+
+	require.Len(t, dst.File, len(src.File))
+	for i, file := range dst.File {
+		want := src.File[i]
+		assert.Equal(t, want.Name, file.Name)
+		assert.Equal(t, want.Method, file.Method)
+		assert.Equal(t, want.CRC32, file.CRC32)
+		assert.Equal(t, want.CompressedSize64, file.CompressedSize64)
+		assert.Equal(t, want.UncompressedSize64, file.UncompressedSize64)
+		assert.Equal(t, want.Mode(), file.Mode())
+		assert.Equal(t, want.Extra, file.Extra)
+		assert.Equal(t, want.Comment, file.Comment)
+		assert.Equal(t, want.Modified, file.Modified)
+
+		wr, err := want.OpenRaw()
+		require.NoError(t, err)
+		wantRaw, err := io.ReadAll(wr)
+		require.NoError(t, err)
+
+		r, err := file.OpenRaw()
+		require.NoError(t, err)
+		raw, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, wantRaw, raw)
+	}
+}
+
+func TestArchiveSplitCopyEntry(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < 200; i++ {
+		hdr := &zip.FileHeader{Name: fmt.Sprintf("%03d-%s", i, strings.Repeat("n", 200)), Method: zip.Store, Modified: fixedModTime}
+		hdr.SetMode(0666)
+
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, strings.Repeat("x", 997))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	src, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	out := t.TempDir()
+	archivePath := filepath.Join(out, "archive.zip")
+
+	a, err := NewArchiverSplit(archivePath, t.TempDir(), minSplitSize)
+	require.NoError(t, err)
+	for _, file := range src.File {
+		require.NoError(t, a.CopyEntry(file))
+	}
+	require.NoError(t, a.Close())
+
+	volumes, err := filepath.Glob(filepath.Join(out, "archive.z*"))
+	require.NoError(t, err)
+	require.Greater(t, len(volumes), 2)
+
+	// every local file header must be entirely within one volume
+	headers := 0
+	for _, volume := range volumes {
+		b, err := os.ReadFile(volume)
+		require.NoError(t, err)
+
+		for i := 0; i+4 <= len(b); i++ {
+			if string(b[i:i+4]) != "PK\x03\x04" {
+				continue
+			}
+			headers++
+			require.LessOrEqual(t, i+30, len(b), volume)
+			end := i + 30 + int(binary.LittleEndian.Uint16(b[i+26:])) + int(binary.LittleEndian.Uint16(b[i+28:]))
+			assert.LessOrEqual(t, end, len(b), "local file header at %d straddles %s", i, volume)
+		}
+	}
+	assert.Equal(t, len(src.File), headers)
+
+	e, err := NewExtractorSplit(archivePath, t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Extract(context.Background()))
+	assert.Equal(t, int64(len(src.File)), e.FileCount())
+}
+
+func TestArchiveWithUTF8Names(t *testing.T) {
+	testFiles := map[string]testFile{
+		"café.txt":  {mode: 0666, contents: strings.Repeat("café", 1024)},
+		"empty.txt": {mode: 0666},
+		"ascii.txt": {mode: 0666, contents: "ascii"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	for _, utf8 := range []bool{true, false} {
+		t.Run(fmt.Sprintf("utf8 %v", utf8), func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+			require.NoError(t, err)
+			defer f.Close()
+
+			a, err := NewArchiver(f, dir, WithArchiverUTF8Names(utf8), WithArchiverCommentFunc(func(name string) string {
+				if name == "empty.txt" {
+					return "commentaire éphémère"
+				}
+				return ""
+			}))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			zr, err := zip.OpenReader(f.Name())
+			require.NoError(t, err)
+			defer zr.Close()
+
+			flags := make(map[string]bool)
+			for _, file := range zr.File {
+				flags[file.Name] = file.Flags&0x800 != 0
+			}
+			assert.Equal(t, map[string]bool{
+				"./":        false,
+				"café.txt":  utf8,
+				"empty.txt": utf8,
+				"ascii.txt": false,
+			}, flags)
+		})
+	}
+}
+
+func TestArchiveDir(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go":     {mode: 0666, contents: "foo"},
+		"bar":        {mode: os.ModeDir | 0777},
+		"bar/bar.go": {mode: 0666, contents: "bar"},
+	}
+
+	_, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	// the archive is created within the directory being archived, and
+	// shouldn't archive itself
+	dest := filepath.Join(dir, "archive.zip")
+	require.NoError(t, ArchiveDir(dest, dir))
+
+	testExtract(t, dest, testFiles)
+
+	t.Run("close error", func(t *testing.T) {
+		errClose := errors.New("close failed")
+		w := struct {
+			io.Writer
+			io.Closer
+		}{io.Discard, closerFunc(func() error { return errClose })}
+
+		assert.ErrorIs(t, archiveDirTo(w, filepath.Join(t.TempDir(), "archive.zip"), dir, nil), errClose)
+	})
+}
+
+func TestArchiveWithAdaptiveCompression(t *testing.T) {
+	random := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"random.bin":       {mode: 0666, contents: string(random)},
+		"small-random.bin": {mode: 0666, contents: string(random[:1024])},
+		"text.txt":         {mode: 0666, contents: strings.Repeat("compressible ", 16*1024)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	for _, concurrency := range []int{1, 4} {
+		for _, adaptive := range []bool{false, true} {
+			t.Run(fmt.Sprintf("concurrency %d adaptive %v", concurrency, adaptive), func(t *testing.T) {
+				f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+				require.NoError(t, err)
+				defer f.Close()
+
+				a, err := NewArchiver(f, dir, WithArchiverConcurrency(concurrency), WithArchiverAdaptiveCompression(adaptive), WithStageDirectory(t.TempDir()))
+				require.NoError(t, err)
+				require.NoError(t, a.Archive(context.Background(), files))
+				require.NoError(t, a.Close())
+
+				zr, err := zip.OpenReader(f.Name())
+				require.NoError(t, err)
+				defer zr.Close()
+
+				methods := make(map[string]uint16)
+				for _, file := range zr.File {
+					methods[file.Name] = file.Method
+					if adaptive && file.Method == zip.Store {
+						assert.Equal(t, file.UncompressedSize64, file.CompressedSize64)
+					}
+				}
+
+				assert.Equal(t, zip.Deflate, methods["text.txt"])
+				if adaptive {
+					assert.Equal(t, zip.Store, methods["random.bin"])
+					assert.Equal(t, zip.Store, methods["small-random.bin"])
+				} else if concurrency == 1 {
+					assert.Equal(t, zip.Deflate, methods["random.bin"])
+				}
+			})
+		}
+	}
+
+	testExtract(t, func() string {
+		f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		a, err := NewArchiver(f, dir, WithArchiverAdaptiveCompression(true))
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+		return f.Name()
+	}(), testFiles)
+}
+
+func TestArchiveWithModifiedAfter(t *testing.T) {
+	testFiles := map[string]testFile{
+		"old.go":      {mode: 0666},
+		"new.go":      {mode: 0666},
+		"new.tmp":     {mode: 0666},
+		"bar":         {mode: os.ModeDir | 0777},
+		"bar/old.go":  {mode: 0666},
+		"bar/new.go":  {mode: 0666},
+		"bar/link.go": {mode: os.ModeSymlink | 0777, contents: "old.go"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	threshold := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for path := range files {
+		mtime := threshold
+		if strings.HasPrefix(filepath.Base(path), "new") {
+			mtime = threshold.Add(time.Second)
+		}
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+
+		fi, err := os.Lstat(path)
+		require.NoError(t, err)
+		files[path] = fi
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverModifiedAfter(threshold), WithArchiverExcludes("*.tmp"))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	assert.ElementsMatch(t, []string{"./", "bar/", "bar/link.go", "bar/new.go", "new.go"}, names)
+}
+
+func TestArchiveWithExcludes(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go":                 {mode: 0666},
+		"foo.tmp":                {mode: 0666},
+		"bar":                    {mode: os.ModeDir | 0777},
+		"bar/bar.tmp":            {mode: 0666},
+		"bar/bar.go":             {mode: 0666},
+		"node_modules":           {mode: os.ModeDir | 0777},
+		"node_modules/module":    {mode: os.ModeDir | 0777},
+		"node_modules/module.go": {mode: 0666},
+		"vendor":                 {mode: os.ModeDir | 0777},
+		"vendor/vendor.go":       {mode: 0666},
+		"baz":                    {mode: os.ModeDir | 0777},
+		"baz/vendor":             {mode: os.ModeDir | 0777},
+		"baz/vendor/vendor.go":   {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverExcludes("*.tmp", "node_modules", "baz/vendor"))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	assert.ElementsMatch(t, []string{"./", "bar/", "bar/bar.go", "baz/", "foo.go", "vendor/", "vendor/vendor.go"}, names)
+
+	_, entries := a.Written()
+	assert.EqualValues(t, len(names), entries)
+
+	_, err = NewArchiver(io.Discard, dir, WithArchiverExcludes("["))
+	assert.Error(t, err)
+}
+
+func TestArchiveWithDeterministic(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/foo.go":  {mode: 0666, contents: "foo"},
+		"bar":         {mode: os.ModeDir | 0777},
+		"bar/bar.go":  {mode: 0666, contents: strings.Repeat("bar", 1024)},
+		"bar/baz.go":  {mode: 0666, contents: "A3#bez&OqCusPr)d&D]Vot9Eo0z^5O*VZm3:sO3HptL.H-4cOv"},
+		"bar/qux.go":  {mode: 0666, contents: strings.Repeat("qux", 65536)},
+		"bar/quux.go": {mode: 0666, contents: ""},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	epoch := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	archive := func(opts ...ArchiverOption) []byte {
+		buf := new(bytes.Buffer)
+		opts = append([]ArchiverOption{WithArchiverDeterministic(true), WithArchiverModifiedEpoch(epoch), WithArchiverConcurrency(4)}, opts...)
+		a, err := NewArchiver(buf, dir, opts...)
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		return buf.Bytes()
+	}
+
+	first := archive()
+
+	// change modification times and refresh the file infos
+	for path := range files {
+		require.NoError(t, os.Chtimes(path, time.Now(), time.Now()))
+		fi, err := os.Lstat(path)
+		require.NoError(t, err)
+		files[path] = fi
+	}
+
+	assert.Equal(t, first, archive())
+
+	// adaptive compression is ignored
+	assert.Equal(t, first, archive(WithArchiverAdaptiveCompression(true)))
+
+	// the compression level is kept
+	huffman := archive(WithArchiverCompressLevel(-2))
+	assert.NotEqual(t, first, huffman)
+	assert.Equal(t, huffman, archive(WithArchiverCompressLevel(-2)))
+
+	zr, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+	require.NoError(t, err)
+	for _, file := range zr.File {
+		assert.True(t, epoch.Equal(file.Modified), file.Name)
+	}
+}
+
+func TestArchiveWithCompressLevel(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 65536)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	sizes := make(map[int]uint64)
+	for _, level := range []int{-2, 1, 9} {
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			zr, err := zip.OpenReader(filename)
+			require.NoError(t, err)
+			defer zr.Close()
+
+			for _, file := range zr.File {
+				if file.Name == "foo.go" {
+					sizes[level] = file.CompressedSize64
+				}
+			}
+		}, WithArchiverCompressLevel(level))
+	}
+
+	assert.Greater(t, sizes[-2], sizes[1])
+	assert.Greater(t, sizes[1], sizes[9])
+
+	for _, level := range []int{-3, 10} {
+		_, err := NewArchiver(io.Discard, dir, WithArchiverCompressLevel(level))
+		assert.ErrorIs(t, err, ErrInvalidCompressionLevel)
+	}
+}
+
+func TestArchiveWithStoreByExtension(t *testing.T) {
+	contents := strings.Repeat("compressible", 1024)
+	testFiles := map[string]testFile{
+		"foo.go":  {mode: 0666, contents: contents},
+		"foo.JPG": {mode: 0666, contents: contents},
+		"foo.zip": {mode: 0666, contents: contents},
+		"foo.mp4": {mode: 0666, contents: contents},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		methods := make(map[string]uint16)
+		for _, file := range zr.File {
+			methods[file.Name] = file.Method
+		}
+
+		assert.Equal(t, zip.Deflate, methods["foo.go"])
+		assert.Equal(t, zip.Store, methods["foo.JPG"])
+		assert.Equal(t, zip.Store, methods["foo.zip"])
+		assert.Equal(t, zip.Deflate, methods["foo.mp4"])
+	}, WithArchiverStoreByExtension(".jpg", "zip"))
+}
+
+func TestArchiveToPipe(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":        {mode: os.ModeDir | 0777},
+		"foo/foo.go": {mode: 0666, contents: strings.Repeat("foo", 1024)},
+		"foo/bar.go": {mode: 0666, contents: "bar"},
+		"foo/baz.go": {mode: 0666, contents: ""},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+
+	for _, concurrency := range []int{1, 2} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			pr, pw := io.Pipe()
+
+			result := make(chan []byte)
+			go func() {
+				defer close(result)
+				buf, _ := io.ReadAll(pr)
+				result <- buf
+			}()
+
+			a, err := NewArchiver(pw, dir, WithArchiverConcurrency(concurrency))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+			require.NoError(t, pw.Close())
+
+			buf := <-result
+			zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+			require.NoError(t, err)
+			require.Len(t, zr.File, len(files))
+
+			for _, file := range zr.File {
+				tf, ok := testFiles[strings.TrimSuffix(file.Name, "/")]
+				if !ok || file.Mode().IsDir() {
+					continue
+				}
+
+				rc, err := file.Open()
+				require.NoError(t, err)
+				contents, err := io.ReadAll(rc)
+				require.NoError(t, err)
+				require.NoError(t, rc.Close())
+				assert.Equal(t, tf.contents, string(contents))
+			}
+		})
+	}
+}
+
+func TestArchiveWithFollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows (symlinks require elevated privileges)")
+	}
+
+	testFiles := map[string]testFile{
+		"foo":          {mode: os.ModeDir | 0777},
+		"foo/foo.go":   {mode: 0640, contents: "foo"},
+		"foo/link.go":  {mode: os.ModeSymlink | 0777, contents: "foo.go"},
+		"bar.go":       {mode: os.ModeSymlink | 0777, contents: "foo/foo.go"},
+		"baz":          {mode: os.ModeSymlink | 0777, contents: "foo"},
+		"cycle/a":      {mode: os.ModeSymlink | 0777, contents: "b"},
+		"cycle/b":      {mode: os.ModeSymlink | 0777, contents: "a"},
+		"cycle":        {mode: os.ModeDir | 0777},
+		"loop":         {mode: os.ModeDir | 0777},
+		"loop/sub":     {mode: os.ModeDir | 0777},
+		"loop/sub/up":  {mode: os.ModeSymlink | 0777, contents: ".."},
+		"dangling.go":  {mode: os.ModeSymlink | 0777, contents: "missing.go"},
+		"outside":      {mode: os.ModeDir | 0777},
+		"outside/file": {mode: 0666, contents: "outside"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	for path := range files {
+		rel, err := filepath.Rel(dir, path)
+		require.NoError(t, err)
+		if strings.HasPrefix(rel, "cycle") || strings.HasPrefix(rel, "loop") || strings.HasPrefix(rel, "outside") || rel == "dangling.go" {
+			delete(files, path)
+		}
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverFollowSymlinks(true))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+
+	modes := make(map[string]os.FileMode)
+	for _, file := range zr.File {
+		modes[file.Name] = file.Mode()
+
+		if file.Mode().IsRegular() {
+			rc, err := file.Open()
+			require.NoError(t, err)
+			contents, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			assert.Equal(t, "foo", string(contents), file.Name)
+		}
+	}
+
+	delete(modes, "./")
+	assert.Equal(t, map[string]os.FileMode{
+		"bar.go":      0640,
+		"baz/":        os.ModeDir | 0777,
+		"baz/foo.go":  0640,
+		"baz/link.go": 0640,
+		"foo/":        os.ModeDir | 0777,
+		"foo/foo.go":  0640,
+		"foo/link.go": 0640,
+	}, modes)
+
+	tests := map[string]error{
+		"dangling.go":                      os.ErrNotExist,
+		filepath.Join("cycle", "a"):        ErrSymlinkCycle,
+		filepath.Join("loop", "sub", "up"): ErrSymlinkCycle,
+	}
+	for name, expected := range tests {
+		path := filepath.Join(dir, name)
+		fi, err := os.Lstat(path)
+		require.NoError(t, err)
+
+		a, err := NewArchiver(io.Discard, dir, WithArchiverFollowSymlinks(true))
+		require.NoError(t, err)
+		assert.ErrorIs(t, a.Archive(context.Background(), map[string]os.FileInfo{path: fi}), expected, name)
+	}
+
+	t.Run("within chroot", func(t *testing.T) {
+		chroot := filepath.Join(dir, "foo")
+		require.NoError(t, os.Symlink(filepath.Join(dir, "outside"), filepath.Join(chroot, "outside")))
+		defer os.Remove(filepath.Join(chroot, "outside"))
+
+		for _, name := range []string{"link.go", "outside"} {
+			path := filepath.Join(chroot, name)
+			fi, err := os.Lstat(path)
+			require.NoError(t, err)
+
+			a, err := NewArchiver(io.Discard, chroot, WithArchiverFollowSymlinks(true))
+			require.NoError(t, err)
+			assert.NoError(t, a.Archive(context.Background(), map[string]os.FileInfo{path: fi}), name)
+
+			a, err = NewArchiver(io.Discard, chroot, WithArchiverFollowSymlinksWithinChroot(true))
+			require.NoError(t, err)
+			err = a.Archive(context.Background(), map[string]os.FileInfo{path: fi})
+			if name == "outside" {
+				assert.ErrorIs(t, err, ErrSymlinkOutsideChroot)
+			} else {
+				assert.NoError(t, err)
+			}
+		}
+	})
+}
+
+func benchmarkArchiveOptions(b *testing.B, stdDeflate bool, options ...ArchiverOption) {
+	files := make(map[string]os.FileInfo)
+	size := int64(0)
+	filepath.Walk(*archiveDir, func(filename string, fi os.FileInfo, err error) error {
+		files[filename] = fi
+		size += fi.Size()
+		return nil
+	})
+
+	dir := b.TempDir()
+
+	options = append(options, WithStageDirectory(dir))
+
+	b.ReportAllocs()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f, err := os.Create(filepath.Join(dir, "fastzip-benchmark.zip"))
+		require.NoError(b, err)
+
+		a, err := NewArchiver(f, *archiveDir, options...)
+		require.NoError(b, err)
+		if stdDeflate {
+			a.RegisterCompressor(zip.Deflate, StdFlateCompressor(-1))
+		}
+
+		err = a.Archive(context.Background(), files)
+		require.NoError(b, err)
+
+		require.NoError(b, a.Close())
+		require.NoError(b, f.Close())
+		require.NoError(b, os.Remove(f.Name()))
+	}
+}
+
+func BenchmarkArchiveStore_1(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(1), WithArchiverMethod(zip.Store))
+}
+
+func BenchmarkArchiveCompressLevel_1(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverCompressLevel(1))
+}
+
+func BenchmarkArchiveCompressLevel_9(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverCompressLevel(9))
+}
+
+func BenchmarkArchiveStandardFlate_1(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(1))
+}
+
+func BenchmarkArchiveStandardFlate_2(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(2))
+}
+
+func BenchmarkArchiveStandardFlate_4(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(4))
+}
+
+func BenchmarkArchiveStandardFlate_8(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(8))
+}
+
+func BenchmarkArchiveStandardFlate_16(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(16))
+}
+
+func BenchmarkArchiveNonStandardFlate_1(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(1))
+}
+
+func BenchmarkArchiveNonStandardFlate_2(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(2))
+}
+
+func BenchmarkArchiveNonStandardFlate_4(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(4))
+}
+
+func BenchmarkArchiveNonStandardFlate_8(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(8))
+}
+
+func BenchmarkArchiveNonStandardFlate_16(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverConcurrency(16), WithArchiverMethod(zstd.ZipMethodWinZip))
+}
+
+func BenchmarkArchiveZstd_1(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(1), WithArchiverMethod(zstd.ZipMethodWinZip))
+}
+
+func BenchmarkArchiveZstd_2(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(2), WithArchiverMethod(zstd.ZipMethodWinZip))
+}
+
+func BenchmarkArchiveZstd_4(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(4), WithArchiverMethod(zstd.ZipMethodWinZip))
+}
+
+func BenchmarkArchiveZstd_8(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(8), WithArchiverMethod(zstd.ZipMethodWinZip))
+}
+
+func BenchmarkArchiveZstd_16(b *testing.B) {
+	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(16), WithArchiverMethod(zstd.ZipMethodWinZip))
+}
+
+func BenchmarkArchiveBufferSize_0(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverBufferSize(0))
+}
+
+func BenchmarkArchiveBufferSize_256K(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverBufferSize(256*1024))
+}
+
+func BenchmarkArchiveBufferSize_2M(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverBufferSize(2*1024*1024))
+}
+
+func BenchmarkArchiveBufferSize_16M(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverBufferSize(16*1024*1024))
+}
+
+func BenchmarkArchiveReadBufferSize_4K(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverReadBufferSize(4*1024))
+}
+
+func BenchmarkArchiveReadBufferSize_32K(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverReadBufferSize(32*1024))
+}
+
+func BenchmarkArchiveReadBufferSize_1M(b *testing.B) {
+	benchmarkArchiveOptions(b, false, WithArchiverReadBufferSize(1024*1024))
+}
+
+func benchmarkCopyEntries(b *testing.B, fn func(a *Archiver, file *zip.File) error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 64; i++ {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("file_%d", i), Method: zip.Deflate})
+		require.NoError(b, err)
+
+		// half random and half repeated data, so that it's compressible
+		data := make([]byte, 128*1024)
+		rnd.Read(data[:len(data)/2])
+		_, err = w.Write(data)
+		require.NoError(b, err)
+	}
+	require.NoError(b, zw.Close())
+
+	src, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(b, err)
+
+	var size int64
+	for _, file := range src.File {
+		size += int64(file.UncompressedSize64)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		a, err := NewArchiver(io.Discard, b.TempDir())
+		require.NoError(b, err)
+		for _, file := range src.File {
+			require.NoError(b, fn(a, file))
+		}
+		require.NoError(b, a.Close())
+	}
+}
+
+func BenchmarkCopyEntryRaw(b *testing.B) {
+	benchmarkCopyEntries(b, func(a *Archiver, file *zip.File) error {
+		return a.CopyEntry(file)
+	})
+}
+
+func BenchmarkCopyEntryRecompress(b *testing.B) {
+	benchmarkCopyEntries(b, func(a *Archiver, file *zip.File) error {
+		r, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		hdr := file.FileHeader
+		w, err := a.zw.CreateHeader(&hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	})
 }
@@ -8,25 +8,46 @@ import (
 	"math/big"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/klauspost/compress/zip"
 	"github.com/saracen/zipextra"
+	"golang.org/x/sys/unix"
 )
 
 func (a *Archiver) createHeader(fi os.FileInfo, hdr *zip.FileHeader) (io.Writer, error) {
 	stat, ok := fi.Sys().(*syscall.Stat_t)
-	if ok {
+	if ok && !a.options.deterministic {
 		hdr.Extra = append(hdr.Extra, zipextra.NewInfoZIPNewUnix(big.NewInt(int64(stat.Uid)), big.NewInt(int64(stat.Gid))).Encode()...)
 	}
 
+	if err := a.reserveHeader(hdr); err != nil {
+		return nil, err
+	}
+
 	return a.zw.CreateHeader(hdr)
 }
 
 func (a *Archiver) createRaw(fi os.FileInfo, hdr *zip.FileHeader) (io.Writer, error) {
 	stat, ok := fi.Sys().(*syscall.Stat_t)
-	if ok {
+	if ok && !a.options.deterministic {
 		hdr.Extra = append(hdr.Extra, zipextra.NewInfoZIPNewUnix(big.NewInt(int64(stat.Uid)), big.NewInt(int64(stat.Gid))).Encode()...)
 	}
 
+	if err := a.reserveHeader(hdr); err != nil {
+		return nil, err
+	}
+
 	return a.zw.CreateRaw(hdr)
 }
+
+// fileTimes returns a file's access and creation times. Creation times aren't
+// available on every unix platform, so the modification time is used instead.
+func fileTimes(path string, fi os.FileInfo) (atime, ctime time.Time, err error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return atime, ctime, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+
+	return time.Unix(st.Atim.Unix()), fi.ModTime(), nil
+}
@@ -6,14 +6,50 @@ package fastzip
 import (
 	"io"
 	"os"
+	"syscall"
+	"time"
 
 	"github.com/klauspost/compress/zip"
 )
 
 func (a *Archiver) createHeader(fi os.FileInfo, hdr *zip.FileHeader) (io.Writer, error) {
+	hdr.ExternalAttrs |= dosAttributes(fi)
+
+	if err := a.reserveHeader(hdr); err != nil {
+		return nil, err
+	}
+
 	return a.zw.CreateHeader(hdr)
 }
 
 func (a *Archiver) createRaw(fi os.FileInfo, hdr *zip.FileHeader) (io.Writer, error) {
+	hdr.ExternalAttrs |= dosAttributes(fi)
+
+	if err := a.reserveHeader(hdr); err != nil {
+		return nil, err
+	}
+
 	return a.zw.CreateRaw(hdr)
 }
+
+// dosAttributes returns the file's hidden, system and archive attributes, which
+// are stored in the low byte of the external attributes. The read-only and
+// directory attributes are already set from the file's mode.
+func dosAttributes(fi os.FileInfo) uint32 {
+	data, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return 0
+	}
+
+	return data.FileAttributes & (syscall.FILE_ATTRIBUTE_HIDDEN | syscall.FILE_ATTRIBUTE_SYSTEM | syscall.FILE_ATTRIBUTE_ARCHIVE)
+}
+
+// fileTimes returns a file's access and creation times.
+func fileTimes(path string, fi os.FileInfo) (atime, ctime time.Time, err error) {
+	data, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return fi.ModTime(), fi.ModTime(), nil
+	}
+
+	return time.Unix(0, data.LastAccessTime.Nanoseconds()), time.Unix(0, data.CreationTime.Nanoseconds()), nil
+}
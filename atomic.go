@@ -0,0 +1,246 @@
+package fastzip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// extractAtomic extracts to a temporary sibling of the chroot, and then
+// renames it into place.
+func (e *Extractor) extractAtomic(ctx context.Context, filter func(*zip.File) bool) (err error) {
+	chroot := e.chroot
+	if err := os.MkdirAll(filepath.Dir(chroot), e.options.dirMode); err != nil {
+		return err
+	}
+
+	tmpDir := filepath.Dir(chroot)
+	if e.options.tempDir != "" {
+		tmpDir = e.options.tempDir
+	}
+
+	tmp, err := os.MkdirTemp(tmpDir, filepath.Base(chroot)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	// the temporary directory is created with 0700, so give it the
+	// permissions of the directory it replaces
+	mode := e.options.dirMode
+	if fi, err := os.Lstat(chroot); err == nil && fi.IsDir() {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+
+	// entries are checked against the chroot and reported by their path
+	// within it, but are written to the temporary directory
+	e.root = tmp
+	err = e.extract(ctx, filter)
+	e.root = chroot
+	if err != nil {
+		return err
+	}
+
+	return replaceDir(tmp, chroot)
+}
+
+// checkWritableDir returns an error if a directory cannot be created in dir.
+func checkWritableDir(dir string) error {
+	tmp, err := os.MkdirTemp(dir, ".fastzip-")
+	if err != nil {
+		return err
+	}
+	return os.Remove(tmp)
+}
+
+// replaceDir renames src to dst, removing whatever was at dst. If dst exists,
+// it's first moved aside so that it can be restored if the rename fails. If
+// dst cannot be moved, such as when it's a mount point, its contents are
+// replaced by copying, which isn't atomic.
+func replaceDir(src, dst string) error {
+	backup := filepath.Join(filepath.Dir(dst), filepath.Base(src)+".old")
+	if err := os.Rename(dst, backup); err != nil {
+		switch {
+		case os.IsNotExist(err):
+			return moveDir(src, dst)
+
+		case errors.Is(err, syscall.EBUSY), errors.Is(err, syscall.EXDEV):
+			return replaceContents(src, dst)
+		}
+		return err
+	}
+
+	if err := moveDir(src, dst); err != nil {
+		os.Rename(backup, dst)
+		return err
+	}
+
+	return os.RemoveAll(backup)
+}
+
+// moveDir renames src to dst, copying it and then removing it if they're on
+// different filesystems.
+func moveDir(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	if err := copyDir(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+// replaceContents removes the contents of dst, copies the contents of src
+// into it and then removes src.
+func replaceContents(src, dst string) error {
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	if err := copyDir(src, dst); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+// copyDir copies the contents of src into dst, which must already exist,
+// preserving modes, modification times and, where permitted, ownership. Hard
+// links are copied as separate files.
+func copyDir(src, dst string) error {
+	type dir struct {
+		path string
+		fi   os.FileInfo
+	}
+
+	// the metadata of directories is copied once they've been populated, so
+	// that their modification times and permissions are what was extracted
+	var dirs []dir
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			if rel != "." {
+				if err := os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, dir{path, fi})
+			return nil
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+
+		case fi.Mode().IsRegular():
+			if err := copyFile(path, target); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("%s: %w", path, ErrNotRegularFile)
+		}
+
+		return copyMetadata(path, target, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(src, dirs[i].path)
+		if err != nil {
+			return err
+		}
+		if err := copyMetadata(dirs[i].path, filepath.Join(dst, rel), dirs[i].fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies the contents of the regular file src to dst.
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// copyMetadata copies the ownership, mode and times of src, described by fi,
+// to dst. Ownership is copied on a best effort basis, as it is during
+// extraction.
+func copyMetadata(src, dst string, fi os.FileInfo) error {
+	copyOwnership(dst, fi)
+
+	if err := lchmod(dst, fi.Mode()); err != nil {
+		return err
+	}
+
+	atime, _, err := fileTimes(src, fi)
+	if err != nil {
+		return err
+	}
+
+	return lchtimes(dst, fi.Mode(), atime, fi.ModTime())
+}
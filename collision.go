@@ -0,0 +1,198 @@
+package fastzip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+
+	"github.com/klauspost/compress/zip"
+)
+
+var (
+	ErrCaseCollision  = errors.New("case-insensitive name collision")
+	ErrDuplicateEntry = errors.New("duplicate entry")
+	ErrTypeConflict   = errors.New("path is both a directory and a non-directory")
+)
+
+// checkCaseCollisions returns an error if two entries that would be extracted
+// to different paths on a case-sensitive filesystem would be extracted to the
+// same path on a case-insensitive filesystem. Directories are allowed to
+// collide, as their contents are merged rather than overwritten.
+func (e *Extractor) checkCaseCollisions(files []*zip.File) error {
+	switch e.options.caseCollisionPolicy {
+	case CaseCollisionIgnore:
+		return nil
+
+	case CaseCollisionAuto:
+		if !e.caseInsensitive() {
+			return nil
+		}
+	}
+
+	seen := make(map[string]*zip.File, len(files))
+	for _, file := range files {
+		if file.Mode()&irregularModes != 0 {
+			continue
+		}
+
+		name := e.collisionName(file)
+		folded := strings.ToLower(name)
+
+		other, ok := seen[folded]
+		if !ok {
+			seen[folded] = file
+			continue
+		}
+
+		if e.collisionName(other) == name || (other.Mode().IsDir() && file.Mode().IsDir()) {
+			continue
+		}
+
+		return fmt.Errorf("%s collides with %s: %w", file.Name, other.Name, ErrCaseCollision)
+	}
+
+	return nil
+}
+
+// collisionName returns the name compared for collisions, which is the base
+// name of the entry when the archive is being flattened.
+func (e *Extractor) collisionName(file *zip.File) string {
+	if e.options.flatten {
+		return flattenName(file.Name)
+	}
+	return path.Clean(file.Name)
+}
+
+// removeDuplicates applies the duplicate policy to entries that would be
+// extracted to the same path, returning the entries to be extracted in their
+// original order. Directories are allowed to be duplicated, as their contents
+// are merged rather than overwritten, but only one is kept.
+func (e *Extractor) removeDuplicates(files []*zip.File) ([]*zip.File, error) {
+	kept := make(map[string]int, len(files))
+	unique := make([]*zip.File, 0, len(files))
+	for _, file := range files {
+		if file.Mode()&irregularModes != 0 {
+			unique = append(unique, file)
+			continue
+		}
+
+		path, err := e.destination(file)
+		if err != nil {
+			return nil, err
+		}
+
+		i, ok := kept[path]
+		if !ok {
+			kept[path] = len(unique)
+			unique = append(unique, file)
+			continue
+		}
+
+		other := unique[i]
+		switch {
+		case e.options.duplicatePolicy == DuplicateError && !(other.Mode().IsDir() && file.Mode().IsDir()):
+			return nil, fmt.Errorf("%s is a duplicate of %s: %w", file.Name, other.Name, ErrDuplicateEntry)
+
+		case e.options.duplicatePolicy == DuplicateLastWins:
+			unique[i] = file
+		}
+	}
+
+	return unique, nil
+}
+
+// removeTypeConflicts applies the type conflict policy to files and symlinks
+// that would be extracted to a path that must be a directory, because it's
+// the path of a directory entry or of the parent of another entry.
+func (e *Extractor) removeTypeConflicts(files []*zip.File) ([]*zip.File, error) {
+	if e.options.typeConflictPolicy == TypeConflictIgnore {
+		return files, nil
+	}
+
+	dirs := make(map[string]*zip.File)
+	for _, file := range files {
+		if file.Mode()&irregularModes != 0 {
+			continue
+		}
+
+		path, err := e.destination(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if file.Mode().IsDir() {
+			if _, ok := dirs[path]; !ok {
+				dirs[path] = file
+			}
+		}
+		for dir := filepath.Dir(path); dir != e.root && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if _, ok := dirs[dir]; ok {
+				break
+			}
+			dirs[dir] = file
+		}
+	}
+
+	kept := make([]*zip.File, 0, len(files))
+	for _, file := range files {
+		if file.Mode()&irregularModes != 0 || file.Mode().IsDir() {
+			kept = append(kept, file)
+			continue
+		}
+
+		path, err := e.destination(file)
+		if err != nil {
+			return nil, err
+		}
+
+		other, ok := dirs[path]
+		switch {
+		case !ok:
+			kept = append(kept, file)
+
+		case e.options.typeConflictPolicy == TypeConflictError:
+			return nil, fmt.Errorf("%s conflicts with directory required by %s: %w", file.Name, other.Name, ErrTypeConflict)
+		}
+	}
+
+	return kept, nil
+}
+
+// caseInsensitive returns whether the filesystem of the chroot is case
+// insensitive. This is detected by checking whether the nearest existing
+// ancestor of the chroot can also be found with the case of its name
+// swapped. If no ancestor has a name with letters, the platform's default is
+// assumed.
+func (e *Extractor) caseInsensitive() bool {
+	for dir := e.chroot; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		fi, err := e.options.fs.Lstat(dir)
+		if err != nil {
+			continue
+		}
+
+		base := filepath.Base(dir)
+		swapped := swapCase(base)
+		if swapped == base {
+			continue
+		}
+
+		sfi, err := e.options.fs.Lstat(filepath.Join(filepath.Dir(dir), swapped))
+		return err == nil && os.SameFile(fi, sfi)
+	}
+
+	return runtime.GOOS == "windows" || runtime.GOOS == "darwin" || runtime.GOOS == "ios"
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
@@ -0,0 +1,44 @@
+package fastzip
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// CopyEntry copies an entry from another archive without decompressing and
+// recompressing it, which is much faster than archiving its contents again
+// when converting one archive to another. The entry's compressed data, CRC32,
+// method, sizes, extra fields, comment and other metadata are preserved.
+//
+// The entry's name is unchanged, and the archiver's options, such as the
+// functions set by WithArchiverNameFunc and WithArchiverMethodFunc, and the
+// patterns set by WithArchiverExcludes, are not applied.
+func (a *Archiver) CopyEntry(src *zip.File) error {
+	r, err := src.OpenRaw()
+	if err != nil {
+		return err
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	// CreateRaw modifies the header, so a copy is used
+	hdr := src.FileHeader
+	if err := a.reserveHeader(&hdr); err != nil {
+		return err
+	}
+
+	w, err := a.zw.CreateRaw(&hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	if err == nil {
+		atomic.AddInt64(&a.written, int64(src.UncompressedSize64))
+	}
+	incOnSuccess(&a.entries, err)
+	return err
+}
@@ -0,0 +1,32 @@
+package fastzip
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/text/encoding"
+)
+
+// flagUTF8 is the general purpose bit flag set when an entry's name and
+// comment are UTF-8 encoded.
+const flagUTF8 = 0x800
+
+// decodeNames decodes the names of entries without the UTF-8 flag from enc, so
+// that they're extracted with UTF-8 names. Entries with the flag are left
+// untouched.
+func decodeNames(files []*zip.File, enc encoding.Encoding) error {
+	dec := enc.NewDecoder()
+	for _, file := range files {
+		if file.Flags&flagUTF8 != 0 {
+			continue
+		}
+
+		name, err := dec.String(file.Name)
+		if err != nil {
+			return fmt.Errorf("decoding name %q: %w", file.Name, err)
+		}
+		file.Name = name
+		file.NonUTF8 = false
+	}
+	return nil
+}
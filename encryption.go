@@ -0,0 +1,411 @@
+package fastzip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/saracen/zipextra"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	ErrPasswordRequired     = errors.New("password required")
+	ErrIncorrectPassword    = errors.New("incorrect password")
+	ErrAuthenticationFailed = errors.New("authentication failed")
+)
+
+const (
+	flagEncrypted        = 0x1
+	flagStrongEncryption = 0x40
+
+	// methodWinZipAES is the method of entries encrypted with WinZip's AES
+	// encryption. The entry's actual method is stored in the AES extra field.
+	methodWinZipAES     = 99
+	extraFieldWinZipAES = 0x9901
+
+	aesKeyIterations  = 1000
+	aesPasswordVerLen = 2
+	aesAuthCodeLen    = 10
+
+	// flagDataDescriptor is set when an entry's checksum and sizes follow its
+	// data, in which case the ZipCrypto header is checked against the entry's
+	// modification time rather than its checksum.
+	flagDataDescriptor = 0x8
+	zipCryptoHeaderLen = 12
+)
+
+// openFile opens a file within the archive, decrypting it if it is encrypted.
+func (e *Extractor) openFile(file *zip.File) (io.ReadCloser, error) {
+	if file.Flags&flagEncrypted == 0 {
+		return file.Open()
+	}
+
+	if e.options.password == nil {
+		return nil, fmt.Errorf("%s is encrypted: %w", file.Name, ErrPasswordRequired)
+	}
+
+	if file.Method == methodWinZipAES {
+		return e.openAES(file)
+	}
+
+	if file.Flags&flagStrongEncryption == 0 {
+		return e.openZipCrypto(file)
+	}
+
+	return nil, fmt.Errorf("%s uses an unsupported encryption method: %w", file.Name, zip.ErrAlgorithm)
+}
+
+// decompressor returns the decompressor registered for method.
+func (e *Extractor) decompressor(method uint16) zip.Decompressor {
+	if dcomp, ok := e.decompressors[method]; ok {
+		return dcomp
+	}
+	if method == zip.Store {
+		return io.NopCloser
+	}
+	return nil
+}
+
+// winZipAES is the WinZip AES extra field.
+type winZipAES struct {
+	version  uint16
+	strength uint8
+	method   uint16
+}
+
+func parseWinZipAES(file *zip.File) (field winZipAES, ok bool) {
+	fields, err := zipextra.Parse(file.Extra)
+	if err != nil {
+		return field, false
+	}
+
+	ef, ok := fields[extraFieldWinZipAES]
+	if !ok || len(ef) < 7 || string(ef[2:4]) != "AE" {
+		return field, false
+	}
+
+	field.version = binary.LittleEndian.Uint16(ef[0:2])
+	field.strength = ef[4]
+	field.method = binary.LittleEndian.Uint16(ef[5:7])
+
+	return field, true
+}
+
+// storesChecksum returns whether the CRC32 stored for a file is meaningful.
+// Entries encrypted with AE-2 purposely omit the checksum, relying instead on
+// the authentication code.
+func storesChecksum(file *zip.File) bool {
+	if file.Method != methodWinZipAES {
+		return true
+	}
+
+	field, ok := parseWinZipAES(file)
+	return !ok || field.version != 2
+}
+
+// openAES opens a file encrypted with WinZip's AES encryption. The data
+// consists of a salt, a password verification value, the encrypted data and an
+// authentication code.
+func (e *Extractor) openAES(file *zip.File) (io.ReadCloser, error) {
+	field, ok := parseWinZipAES(file)
+	if !ok {
+		return nil, fmt.Errorf("%s has an invalid AES extra field: %w", file.Name, zip.ErrFormat)
+	}
+
+	var keyLen int
+	switch field.strength {
+	case 1:
+		keyLen = 16
+	case 2:
+		keyLen = 24
+	case 3:
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("%s has an invalid AES strength: %w", file.Name, zip.ErrFormat)
+	}
+	saltLen := keyLen / 2
+
+	dcomp := e.decompressor(field.method)
+	if dcomp == nil {
+		return nil, zip.ErrAlgorithm
+	}
+
+	size := int64(file.CompressedSize64) - int64(saltLen+aesPasswordVerLen+aesAuthCodeLen)
+	if size < 0 {
+		return nil, zip.ErrFormat
+	}
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, saltLen+aesPasswordVerLen)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2.Key(e.options.password, header[:saltLen], aesKeyIterations, 2*keyLen+aesPasswordVerLen, sha1.New)
+	if subtle.ConstantTimeCompare(key[2*keyLen:], header[saltLen:]) != 1 {
+		return nil, fmt.Errorf("%s: %w", file.Name, ErrIncorrectPassword)
+	}
+
+	block, err := aes.NewCipher(key[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	data := &aesReader{
+		r:      raw,
+		n:      size,
+		stream: newWinZipCTR(block),
+		mac:    hmac.New(sha1.New, key[keyLen:2*keyLen]),
+	}
+
+	dr := &decryptedReader{
+		rc:   dcomp(data),
+		data: data,
+		file: file,
+	}
+	if field.version != 2 {
+		dr.hash = crc32.NewIEEE()
+	}
+
+	return dr, nil
+}
+
+// aesReader decrypts n bytes of data from r, verifying the authentication
+// code that follows it.
+type aesReader struct {
+	r      io.Reader
+	n      int64
+	stream cipher.Stream
+	mac    hash.Hash
+	err    error
+}
+
+func (r *aesReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if r.n <= 0 {
+		r.err = r.authenticate()
+		return 0, r.err
+	}
+
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+
+	n, err = r.r.Read(p)
+	r.mac.Write(p[:n])
+	r.stream.XORKeyStream(p[:n], p[:n])
+	r.n -= int64(n)
+
+	switch {
+	case err == io.EOF && r.n > 0:
+		err = io.ErrUnexpectedEOF
+	case err == nil && r.n == 0:
+		err = r.authenticate()
+	}
+	if err != nil {
+		r.err = err
+	}
+
+	return n, err
+}
+
+func (r *aesReader) authenticate() error {
+	code := make([]byte, aesAuthCodeLen)
+	if _, err := io.ReadFull(r.r, code); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if !hmac.Equal(code, r.mac.Sum(nil)[:aesAuthCodeLen]) {
+		return ErrAuthenticationFailed
+	}
+
+	return io.EOF
+}
+
+// winZipCTR is AES in CTR mode as used by WinZip. Unlike cipher.NewCTR, the
+// counter is little-endian and starts at 1.
+type winZipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	pos     int
+}
+
+func newWinZipCTR(block cipher.Block) *winZipCTR {
+	return &winZipCTR{block: block, pos: aes.BlockSize}
+}
+
+func (c *winZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.pos == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.pos = 0
+		}
+
+		dst[i] = src[i] ^ c.stream[c.pos]
+		c.pos++
+	}
+}
+
+// openZipCrypto opens a file encrypted with PKWARE's traditional encryption,
+// known as ZipCrypto. The data consists of a 12 byte encryption header and the
+// encrypted data. ZipCrypto is weak, and only the last byte of the header can
+// be used to check the password, so an incorrect password is only detected
+// with certainty by the checksum once the file has been read.
+func (e *Extractor) openZipCrypto(file *zip.File) (io.ReadCloser, error) {
+	dcomp := e.decompressor(file.Method)
+	if dcomp == nil {
+		return nil, zip.ErrAlgorithm
+	}
+
+	size := int64(file.CompressedSize64) - zipCryptoHeaderLen
+	if size < 0 {
+		return nil, zip.ErrFormat
+	}
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := newZipCryptoKeys(e.options.password)
+
+	header := make([]byte, zipCryptoHeaderLen)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+	keys.decrypt(header)
+
+	check := byte(file.CRC32 >> 24)
+	if file.Flags&flagDataDescriptor != 0 {
+		check = byte(file.ModifiedTime >> 8)
+	}
+	if header[zipCryptoHeaderLen-1] != check {
+		return nil, fmt.Errorf("%s: %w", file.Name, ErrIncorrectPassword)
+	}
+
+	data := &zipCryptoReader{r: io.LimitReader(raw, size), keys: keys}
+
+	return &decryptedReader{
+		rc:   dcomp(data),
+		data: data,
+		file: file,
+		hash: crc32.NewIEEE(),
+	}, nil
+}
+
+// zipCryptoKeys is the state of the ZipCrypto stream cipher.
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password []byte) *zipCryptoKeys {
+	keys := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for _, b := range password {
+		keys.update(b)
+	}
+	return keys
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ (k[0] >> 8)
+	k[1] = (k[1]+k[0]&0xff)*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ (k[2] >> 8)
+}
+
+// decrypt decrypts p in place.
+func (k *zipCryptoKeys) decrypt(p []byte) {
+	for i, c := range p {
+		t := uint16(k[2] | 2)
+		p[i] = c ^ byte((t*(t^1))>>8)
+		k.update(p[i])
+	}
+}
+
+// zipCryptoReader decrypts the data read from r.
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func (r *zipCryptoReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.keys.decrypt(p[:n])
+	return n, err
+}
+
+// decryptedReader verifies the size and checksum of a decrypted and
+// decompressed file, and ensures all of the encrypted data is consumed, so
+// that it is authenticated, once the decompressor reaches EOF.
+type decryptedReader struct {
+	rc    io.ReadCloser
+	data  io.Reader
+	file  *zip.File
+	hash  hash.Hash32
+	nread uint64
+	err   error
+}
+
+func (r *decryptedReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err = r.rc.Read(p)
+	r.nread += uint64(n)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+
+	if r.nread > r.file.UncompressedSize64 {
+		r.err = zip.ErrFormat
+		return 0, r.err
+	}
+
+	if err == io.EOF {
+		switch {
+		case r.nread != r.file.UncompressedSize64:
+			err = io.ErrUnexpectedEOF
+
+		default:
+			if _, derr := io.Copy(io.Discard, r.data); derr != nil {
+				err = derr
+			} else if r.hash != nil && r.hash.Sum32() != r.file.CRC32 {
+				err = zip.ErrChecksum
+			}
+		}
+	}
+	if err != nil {
+		r.err = err
+	}
+
+	return n, err
+}
+
+func (r *decryptedReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,122 @@
+package fastzip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// EntryError is an error encountered extracting an entry.
+type EntryError struct {
+	// Name is the entry's name within the archive.
+	Name string
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// ExtractErrors is returned by Extract when WithExtractorContinueOnError is
+// enabled and one or more entries failed to extract. The errors are sorted by
+// entry name.
+type ExtractErrors []*EntryError
+
+func (errs ExtractErrors) Error() string {
+	switch len(errs) {
+	case 0:
+		return "no errors"
+	case 1:
+		return errs[0].Error()
+	}
+
+	return fmt.Sprintf("%v (and %d other errors)", errs[0], len(errs)-1)
+}
+
+// ChrootEscapeError is returned when an entry, or the target of a symlink or
+// hard link, resolves outside of the chroot, which is a sign of a malicious
+// archive. It always stops extraction.
+type ChrootEscapeError struct {
+	// Name is the entry's name within the archive.
+	Name string
+
+	// Chroot is the directory entries are extracted to.
+	Chroot string
+
+	// Resolved is the path outside of the chroot that the entry, or its
+	// link target, resolves to.
+	Resolved string
+
+	// Target is the link target that escapes the chroot, as stored in the
+	// archive. It is empty if the entry's name escapes the chroot.
+	Target string
+}
+
+func (e *ChrootEscapeError) Error() string {
+	if e.Target != "" {
+		return fmt.Sprintf("%s link target %s is outside of chroot (%s)", e.Name, e.Target, e.Chroot)
+	}
+	return fmt.Sprintf("%s cannot be extracted outside of chroot (%s)", e.Resolved, e.Chroot)
+}
+
+// entryErrors collects the errors of entries that failed to extract, when
+// extraction continues on error, and calls the error handler.
+type entryErrors struct {
+	m       sync.Mutex
+	enabled bool
+	errs    ExtractErrors
+
+	handler   func(file *zip.File, err error) error
+	handlerMu *sync.Mutex
+}
+
+// record handles err for the file provided, returning nil if extraction
+// should continue. Cancellation and chroot errors are always returned.
+func (r *entryErrors) record(file *zip.File, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var cerr *ChrootEscapeError
+	if errors.As(err, &cerr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	if r.handler != nil {
+		r.handlerMu.Lock()
+		defer r.handlerMu.Unlock()
+
+		return r.handler(file, err)
+	}
+
+	if !r.enabled {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.errs = append(r.errs, &EntryError{Name: file.Name, Err: err})
+
+	return nil
+}
+
+// err returns the errors recorded, or nil if there are none.
+func (r *entryErrors) err() error {
+	if len(r.errs) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(r.errs, func(i, j int) bool {
+		return r.errs[i].Name < r.errs[j].Name
+	})
+
+	return r.errs
+}
@@ -3,14 +3,21 @@ package fastzip
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/klauspost/compress/zip"
@@ -19,17 +26,43 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-var bufioWriterPool = sync.Pool{
-	New: func() interface{} {
-		return bufio.NewWriterSize(nil, 32*1024)
-	},
+const defaultExtractorBufferSize = 32 * 1024
+
+var bufioWriterPool = newBufioWriterPool(defaultExtractorBufferSize)
+
+func newBufioWriterPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return bufio.NewWriterSize(nil, size)
+		},
+	}
 }
 
 var (
-	defaultDecompressor     = FlateDecompressor()
-	defaultZstdDecompressor = ZstdDecompressor()
+	ErrExtractionLimitExceeded = errors.New("extraction limit exceeded")
+	ErrNotRegularFile          = errors.New("not a regular file")
+	ErrAtomicFilesystem        = errors.New("atomic extraction requires the operating system's filesystem")
+	ErrPathTooLong             = errors.New("path too long")
+	ErrChrootNotEmpty          = errors.New("chroot is not empty")
+	ErrAbsolutePath            = errors.New("entry has an absolute path")
+	ErrEmptyChrootFilesystem   = errors.New("requiring an empty chroot requires the operating system's filesystem")
+	ErrSymlinkNotAllowed       = errors.New("symlinks are not allowed")
+	ErrSymlinkTargetNotFile    = errors.New("symlink target is not a file in the archive")
+	ErrSymlinkParent           = errors.New("parent directory is a symlink")
+	ErrExtractionInProgress    = errors.New("extraction already in progress")
+	ErrNotStored               = errors.New("entry is not stored uncompressed")
+)
+
+var (
+	defaultDecompressor      = FlateDecompressor()
+	defaultZstdDecompressor  = ZstdDecompressor()
+	defaultBzip2Decompressor = Bzip2Decompressor()
 )
 
+// maxSymlinkCopyDepth is the number of symlinks followed when copying a
+// symlink's target, matching Linux's limit.
+const maxSymlinkCopyDepth = 40
+
 // Extractor is an opinionated Zip file extractor.
 //
 // Files are extracted in parallel. Only regular files, symlinks and directories
@@ -37,42 +70,116 @@ var (
 //
 // Access permissions, ownership (unix) and modification times are preserved.
 type Extractor struct {
-	// This 2 fields are accessed via atomic operations
+	// These fields are accessed via atomic operations
 	// They are at the start of the struct so they are properly 8 byte aligned
-	written, entries int64
+	written, entries, skipped    int64
+	files, directories, symlinks int64
+	verified                     int64
+
+	// running is set whilst an extraction or verification is in progress
+	running int32
 
 	zr      *zip.Reader
 	closer  io.Closer
 	m       sync.Mutex
 	options extractorOptions
 	chroot  string
+
+	// root is the directory entries are extracted to, which is the chroot
+	// unless an atomic extraction is extracting to a temporary directory
+	root string
+
+	// zip64End is whether the archive has a Zip64 end of central directory
+	// record
+	zip64End bool
+
+	decompressors map[uint16]zip.Decompressor
+	rateLimiter   *rateLimiter
+	bufPool       *sync.Pool
+	openFiles     chan struct{}
+
+	// symlinkSources are the entries of the archive by destination, used to
+	// find the files copied in place of symlinks
+	symlinkSources map[string]*zip.File
+
+	// total is the uncompressed size of the files being extracted
+	total int64
+
+	profileMu sync.Mutex
+	profiles  map[string]EntryProfile
+
+	// created are the paths created, relative to the chroot, when
+	// WithExtractorRecordCreatedPaths is enabled
+	createdMu sync.Mutex
+	created   []string
+
+	// ordered buffers events when WithExtractorOrderedEvents is enabled
+	ordered *orderedEvents
 }
 
 // NewExtractor opens a zip file and returns a new extractor.
 //
+// Self-extracting archives, and other files with data prepended to the zip
+// data, are supported, whether or not the archive's offsets were adjusted to
+// account for the prepended data.
+//
 // Close() should be called to close the extractor's underlying zip.Reader
 // when done.
 func NewExtractor(filename, chroot string, opts ...ExtractorOption) (*Extractor, error) {
-	zr, err := zip.OpenReader(filename)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := newExtractorFile(f, chroot, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func newExtractorFile(f *os.File, chroot string, opts []ExtractorOption) (*Extractor, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(f, fi.Size())
 	if err != nil {
 		return nil, err
 	}
 
-	return newExtractor(&zr.Reader, zr, chroot, opts)
+	e, err := newExtractor(zr, f, chroot, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.zip64End = hasZip64End(f, fi.Size())
+
+	return e, nil
 }
 
-// NewExtractor returns a new extractor, reading from the reader provided.
+// NewExtractorFromReader returns a new extractor, reading from the reader
+// provided, such as an in-memory archive or one received over the network.
 //
 // The size of the archive should be provided.
 //
-// Unlike with NewExtractor(), calling Close() on the extractor is unnecessary.
+// Unlike with NewExtractor(), calling Close() on the extractor is unnecessary,
+// and r is never closed, even if it implements io.Closer.
 func NewExtractorFromReader(r io.ReaderAt, size int64, chroot string, opts ...ExtractorOption) (*Extractor, error) {
 	zr, err := zip.NewReader(r, size)
 	if err != nil {
 		return nil, err
 	}
 
-	return newExtractor(zr, nil, chroot, opts)
+	e, err := newExtractor(zr, nil, chroot, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.zip64End = hasZip64End(r, size)
+
+	return e, nil
 }
 
 func newExtractor(r *zip.Reader, c io.Closer, chroot string, opts []ExtractorOption) (*Extractor, error) {
@@ -82,12 +189,21 @@ func newExtractor(r *zip.Reader, c io.Closer, chroot string, opts []ExtractorOpt
 	}
 
 	e := &Extractor{
-		chroot: chroot,
-		zr:     r,
-		closer: c,
+		chroot:        chroot,
+		root:          chroot,
+		zr:            r,
+		closer:        c,
+		decompressors: make(map[uint16]zip.Decompressor),
 	}
 
 	e.options.concurrency = runtime.GOMAXPROCS(0)
+	e.options.fs = osFilesystem{}
+	e.options.dirMode = 0755
+	e.options.modeMask = permMask
+	e.options.preserveOwnership = true
+	e.options.preserveModTime = true
+	e.options.bufferSize = defaultExtractorBufferSize
+	e.options.maxOpenFiles = defaultMaxOpenFiles()
 	for _, o := range opts {
 		err := o(&e.options)
 		if err != nil {
@@ -95,16 +211,50 @@ func newExtractor(r *zip.Reader, c io.Closer, chroot string, opts []ExtractorOpt
 		}
 	}
 
+	if _, ok := e.options.fs.(osFilesystem); e.options.atomic && !ok {
+		return nil, ErrAtomicFilesystem
+	}
+	if _, ok := e.options.fs.(osFilesystem); e.options.requireEmptyChroot && !ok {
+		return nil, ErrEmptyChrootFilesystem
+	}
+	if e.options.atomic && e.options.tempDir != "" {
+		if err := checkWritableDir(e.options.tempDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.options.filenameEncoding != nil {
+		if err := decodeNames(e.zr.File, e.options.filenameEncoding); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.options.maxOpenFiles > 0 {
+		e.openFiles = make(chan struct{}, e.options.maxOpenFiles)
+	}
+
+	if e.options.rateLimit > 0 {
+		e.rateLimiter = newRateLimiter(e.options.rateLimit)
+	}
+
+	e.bufPool = bufioWriterPool
+	if e.options.bufferSize != defaultExtractorBufferSize {
+		e.bufPool = newBufioWriterPool(e.options.bufferSize)
+	}
+
 	e.RegisterDecompressor(zip.Deflate, defaultDecompressor)
 	e.RegisterDecompressor(zstd.ZipMethodWinZip, defaultZstdDecompressor)
+	e.RegisterDecompressor(MethodBzip2, defaultBzip2Decompressor)
 
 	return e, nil
 }
 
 // RegisterDecompressor allows custom decompressors for a specified method ID.
-// The common methods Store and Deflate are built in.
+// The common methods Store and Deflate are built in, as are Zstandard and
+// bzip2.
 func (e *Extractor) RegisterDecompressor(method uint16, dcomp zip.Decompressor) {
 	e.zr.RegisterDecompressor(method, dcomp)
+	e.decompressors[method] = dcomp
 }
 
 // Files returns the file within the archive.
@@ -112,216 +262,1676 @@ func (e *Extractor) Files() []*zip.File {
 	return e.zr.File
 }
 
-// Close closes the underlying ZipReader.
-func (e *Extractor) Close() error {
-	if e.closer == nil {
-		return nil
-	}
-	return e.closer.Close()
+// FS returns a read-only view of the archive as an fs.FS, so that it can be
+// used with fs.WalkDir, fs.ReadFile and http.FS without extracting it.
+// Directories that the archive doesn't contain entries for are synthesized
+// from the names of the entries within them, and registered decompressors are
+// used to read files. Encrypted entries cannot be read, and the view is empty
+// once WithExtractorReleaseEntries has released the entries.
+func (e *Extractor) FS() fs.FS {
+	return e.zr
 }
 
-// Written returns how many bytes and entries have been written to disk.
-// Written can be called whilst extraction is in progress.
-func (e *Extractor) Written() (bytes, entries int64) {
-	return atomic.LoadInt64(&e.written), atomic.LoadInt64(&e.entries)
+// EntryCounts are the number of each type of entry within the archive.
+type EntryCounts struct {
+	Files       int64
+	Directories int64
+	Symlinks    int64
 }
 
-// Extract extracts files, creates symlinks and directories from the
-// archive.
-func (e *Extractor) Extract(ctx context.Context) (err error) {
-	limiter := make(chan struct{}, e.options.concurrency)
-
-	wg, ctx := errgroup.WithContext(ctx)
-	defer func() {
-		if werr := wg.Wait(); werr != nil {
-			err = werr
+// Counts returns the number of regular files, directories and symlinks
+// within the archive. Only the central directory is read.
+func (e *Extractor) Counts() EntryCounts {
+	var counts EntryCounts
+	for _, file := range e.zr.File {
+		switch mode := file.Mode(); {
+		case mode&irregularModes != 0:
+		case mode&os.ModeSymlink != 0:
+			counts.Symlinks++
+		case mode.IsDir():
+			counts.Directories++
+		default:
+			counts.Files++
 		}
-	}()
+	}
+	return counts
+}
 
-	for i, file := range e.zr.File {
-		if file.Mode()&irregularModes != 0 {
-			continue
-		}
+// EntryInfo describes an entry within the archive, as recorded in the central
+// directory.
+type EntryInfo struct {
+	Name             string
+	Method           uint16
+	CompressedSize   uint64
+	UncompressedSize uint64
+	Modified         time.Time
+	Mode             os.FileMode
 
-		var path string
-		path, err = filepath.Abs(filepath.Join(e.chroot, file.Name))
-		if err != nil {
-			return err
-		}
+	// Ratio is the compressed size divided by the uncompressed size, or 1 for
+	// entries with no data.
+	Ratio float64
 
-		if !strings.HasPrefix(path, e.chroot+string(filepath.Separator)) && path != e.chroot {
-			return fmt.Errorf("%s cannot be extracted outside of chroot (%s)", path, e.chroot)
-		}
+	// IsRegular, IsDir and IsSymlink classify the entry as Extract does.
+	// Entries that are none of these, such as devices and named pipes, are
+	// not extracted.
+	IsRegular bool
+	IsDir     bool
+	IsSymlink bool
+}
 
-		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
-			return err
+// Entries returns information about every entry within the archive, in the
+// order of the central directory. Only the central directory is read.
+func (e *Extractor) Entries() []EntryInfo {
+	entries := make([]EntryInfo, 0, len(e.zr.File))
+	for _, file := range e.zr.File {
+		mode := file.Mode()
+		info := EntryInfo{
+			Name:             file.Name,
+			Method:           file.Method,
+			CompressedSize:   file.CompressedSize64,
+			UncompressedSize: file.UncompressedSize64,
+			Modified:         file.Modified,
+			Mode:             mode,
+			Ratio:            1,
 		}
-
-		if ctx.Err() != nil {
-			return ctx.Err()
+		if file.UncompressedSize64 > 0 {
+			info.Ratio = float64(file.CompressedSize64) / float64(file.UncompressedSize64)
 		}
 
 		switch {
-		case file.Mode()&os.ModeSymlink != 0:
-			// defer the creation of symlinks
-			// this is to prevent a traversal vulnerability where a symlink is
-			// first created and then files are additional extracted into it
-			continue
+		case mode&irregularModes != 0:
+		case mode&os.ModeSymlink != 0:
+			info.IsSymlink = true
+		case mode.IsDir():
+			info.IsDir = true
+		default:
+			info.IsRegular = true
+		}
 
-		case file.Mode().IsDir():
-			err = e.createDirectory(path, file)
+		entries = append(entries, info)
+	}
+	return entries
+}
 
-		default:
-			limiter <- struct{}{}
+// FileCount returns the number of entries Extract would extract: regular
+// files, directories and symlinks. Only the central directory is read.
+func (e *Extractor) FileCount() int64 {
+	counts := e.Counts()
+	return counts.Files + counts.Directories + counts.Symlinks
+}
 
-			gf := e.zr.File[i]
-			wg.Go(func() error {
-				defer func() { <-limiter }()
-				err := e.createFile(ctx, path, gf)
-				if err == nil {
-					err = e.updateFileMetadata(path, gf)
-				}
-				return err
-			})
+// TotalUncompressedSize returns the total uncompressed size of the regular
+// files within the archive, as recorded in the central directory. No file
+// data is read, so this can be used to check there's enough disk space before
+// extracting.
+func (e *Extractor) TotalUncompressedSize() int64 {
+	var total int64
+	for _, file := range e.zr.File {
+		if file.Mode()&(irregularModes|os.ModeSymlink|os.ModeDir) == 0 {
+			total += int64(file.UncompressedSize64)
 		}
-		if err != nil {
-			return err
+	}
+	return total
+}
+
+// Comment returns the archive's comment. Each entry's comment is available
+// from its zip.File's Comment field.
+func (e *Extractor) Comment() string {
+	return e.zr.Comment
+}
+
+// IsZip64 reports whether the archive uses Zip64: if it has a Zip64 end of
+// central directory record, because it has more entries or a larger or
+// further central directory than the end of central directory record can
+// hold, or because one was written regardless, or if any entry has a Zip64
+// extra field, because of its size or offset. Archives that use Zip64 cannot
+// be read by legacy readers.
+func (e *Extractor) IsZip64() bool {
+	if e.zip64End {
+		return true
+	}
+
+	for _, file := range e.zr.File {
+		if _, ok, _ := zip64Extra(file.Extra); ok {
+			return true
 		}
 	}
 
-	if err := wg.Wait(); err != nil {
-		return err
+	return false
+}
+
+// UnsupportedMethods returns the compression methods used by the archive's
+// entries that have no registered decompressor, in ascending order, so that an
+// archive that cannot be fully extracted can be rejected up front. Store,
+// Deflate, Zstandard and bzip2 are always supported. For entries encrypted with
+// WinZip's AES encryption, the method of the encrypted data is checked.
+func (e *Extractor) UnsupportedMethods() []uint16 {
+	seen := make(map[uint16]struct{})
+	var methods []uint16
+	for _, file := range e.zr.File {
+		method := file.Method
+		if method == methodWinZipAES {
+			if field, ok := parseWinZipAES(file); ok {
+				method = field.method
+			}
+		}
+
+		if _, ok := seen[method]; ok || e.decompressor(method) != nil {
+			continue
+		}
+		seen[method] = struct{}{}
+		methods = append(methods, method)
 	}
 
-	// handle deferred symlink creation and update directory metadata
-	// (otherwise modification dates are incorrect)
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
+
+	return methods
+}
+
+// Open opens the named file within the archive for reading. The file is
+// decompressed, and decrypted if a password has been provided, using the
+// registered decompressors. Only regular files can be opened.
+func (e *Extractor) Open(name string) (io.ReadCloser, error) {
 	for _, file := range e.zr.File {
-		if file.Mode()&os.ModeSymlink == 0 && !file.Mode().IsDir() {
+		if file.Name != name {
 			continue
 		}
 
-		path, err := filepath.Abs(filepath.Join(e.chroot, file.Name))
-		if err != nil {
-			return err
+		if !file.Mode().IsRegular() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotRegularFile}
 		}
 
-		if file.Mode()&os.ModeSymlink != 0 {
-			if err := e.createSymlink(path, file); err != nil {
-				return err
-			}
+		return e.openFile(file)
+	}
+
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+// ReaderAt returns a reader of the named file's data within the archive, so
+// that it can be read at arbitrary offsets without decompressing it from the
+// beginning. Only regular files stored with the Store method, and without
+// encryption, can be read, as the data of other files can't be read randomly.
+// The data is not verified against the entry's CRC-32.
+func (e *Extractor) ReaderAt(name string) (*io.SectionReader, error) {
+	for _, file := range e.zr.File {
+		if file.Name != name {
 			continue
 		}
 
-		err = e.updateFileMetadata(path, file)
+		switch {
+		case !file.Mode().IsRegular():
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotRegularFile}
+		case file.Method != zip.Store || file.Flags&flagEncrypted != 0:
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotStored}
+		}
+
+		r, err := file.OpenRaw()
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return r.(*io.SectionReader), nil
 	}
 
-	return nil
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
 }
 
-func (e *Extractor) createDirectory(path string, file *zip.File) error {
-	err := os.Mkdir(path, 0777)
-	if os.IsExist(err) {
-		err = nil
+// ExtractEntry copies the contents of the named file within the archive to w.
+// Nothing is written to the chroot.
+func (e *Extractor) ExtractEntry(name string, w io.Writer) error {
+	rc, err := e.Open(name)
+	if err != nil {
+		return err
 	}
-	incOnSuccess(&e.entries, err)
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
 	return err
 }
 
-func (e *Extractor) createSymlink(path string, file *zip.File) error {
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		return err
+// Close closes the underlying ZipReader.
+func (e *Extractor) Close() error {
+	if e.closer == nil {
+		return nil
 	}
+	return e.closer.Close()
+}
 
-	r, err := file.Open()
-	if err != nil {
-		return err
-	}
-	defer r.Close()
+// Chroot returns the absolute path of the directory files are extracted to.
+func (e *Extractor) Chroot() string {
+	return e.chroot
+}
 
-	name, err := io.ReadAll(r)
-	if err != nil {
-		return err
+// Concurrency returns the maximum number of files extracted concurrently.
+func (e *Extractor) Concurrency() int {
+	if e.options.limiter != nil {
+		return cap(e.options.limiter)
 	}
+	return e.options.concurrency
+}
 
-	if err := os.Symlink(string(name), path); err != nil {
-		return err
+// String returns a summary of the extractor's configuration.
+func (e *Extractor) String() string {
+	return fmt.Sprintf("Extractor{chroot: %q, concurrency: %d, files: %d}", e.chroot, e.Concurrency(), len(e.zr.File))
+}
+
+// Written returns how many bytes and entries have been written to disk.
+// Written can be called whilst extraction is in progress.
+func (e *Extractor) Written() (bytes, entries int64) {
+	return atomic.LoadInt64(&e.written), atomic.LoadInt64(&e.entries)
+}
+
+// ExtractorStats are statistics about the entries extracted.
+type ExtractorStats struct {
+	Files        int64
+	Directories  int64
+	Symlinks     int64
+	BytesWritten int64
+	Skipped      int64
+
+	// BytesVerified is the uncompressed size of the entries read by Verify.
+	BytesVerified int64
+}
+
+// Stats returns statistics about the entries extracted. The counters are
+// updated concurrently, so Stats is only guaranteed to be consistent once
+// Extract() has returned.
+func (e *Extractor) Stats() ExtractorStats {
+	return ExtractorStats{
+		Files:        atomic.LoadInt64(&e.files),
+		Directories:  atomic.LoadInt64(&e.directories),
+		Symlinks:     atomic.LoadInt64(&e.symlinks),
+		BytesWritten: atomic.LoadInt64(&e.written),
+		Skipped:      atomic.LoadInt64(&e.skipped),
+
+		BytesVerified: atomic.LoadInt64(&e.verified),
 	}
+}
 
-	err = e.updateFileMetadata(path, file)
-	incOnSuccess(&e.entries, err)
+// CreatedPaths returns the paths of the files, directories and symlinks created
+// by the last extraction, in lexical order, when WithExtractorRecordCreatedPaths
+// is enabled. Files that replaced existing files are included, but directories
+// that already existed, and parent directories created for entries without
+// directory entries of their own, are not.
+func (e *Extractor) CreatedPaths() []string {
+	e.createdMu.Lock()
+	defer e.createdMu.Unlock()
 
-	return err
+	paths := make([]string, 0, len(e.created))
+	for _, rel := range e.created {
+		paths = append(paths, filepath.Join(e.chroot, rel))
+	}
+	sort.Strings(paths)
+	return paths
 }
 
-func (e *Extractor) createFile(ctx context.Context, path string, file *zip.File) (err error) {
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		return err
+// recordCreated records that path was created, relative to the root, so that
+// the temporary directory of atomic extraction isn't recorded.
+func (e *Extractor) recordCreated(path string) {
+	if !e.options.recordCreatedPaths {
+		return
 	}
 
-	r, err := file.Open()
+	rel, err := filepath.Rel(e.root, path)
 	if err != nil {
-		return err
+		return
 	}
-	defer dclose(r, &err)
 
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return err
+	e.createdMu.Lock()
+	defer e.createdMu.Unlock()
+
+	e.created = append(e.created, rel)
+}
+
+// Skipped returns how many entries have been skipped, either because of the
+// overwrite, symlink or path length policy. Skipped can be called whilst extraction is in
+// progress.
+func (e *Extractor) Skipped() int64 {
+	return atomic.LoadInt64(&e.skipped)
+}
+
+// Extract extracts files, creates symlinks and directories from the
+// archive.
+func (e *Extractor) Extract(ctx context.Context) error {
+	return e.ExtractFilter(ctx, nil)
+}
+
+// ExtractFilter extracts only the files, symlinks and directories from the
+// archive for which filter returns true. Directories that are parents of
+// selected entries are always created, and have their metadata updated, even
+// if they were not selected themselves.
+//
+// A nil filter selects every entry.
+//
+// An extractor can be used for any number of extractions, one after the other,
+// and the statistics returned by Stats, Written and Profile are reset at the
+// start of each. Extracting an archive again has the same result as extracting
+// it once, unless WithExtractorReleaseEntries has released its entries. Calls
+// made whilst another extraction or Verify is in progress return
+// ErrExtractionInProgress.
+func (e *Extractor) ExtractFilter(ctx context.Context, filter func(*zip.File) bool) error {
+	if !e.begin() {
+		return ErrExtractionInProgress
 	}
-	defer dclose(f, &err)
+	defer e.end()
 
-	bw := bufioWriterPool.Get().(*bufio.Writer)
-	defer bufioWriterPool.Put(bw)
+	atomic.StoreInt64(&e.written, 0)
+	atomic.StoreInt64(&e.entries, 0)
+	atomic.StoreInt64(&e.skipped, 0)
+	atomic.StoreInt64(&e.files, 0)
+	atomic.StoreInt64(&e.directories, 0)
+	atomic.StoreInt64(&e.symlinks, 0)
+	e.profileMu.Lock()
+	e.profiles = nil
+	e.profileMu.Unlock()
+	e.createdMu.Lock()
+	e.created = nil
+	e.createdMu.Unlock()
 
-	bw.Reset(countWriter{f, &e.written, ctx})
-	if _, err = bw.ReadFrom(r); err != nil {
-		return err
+	if e.options.requireEmptyChroot {
+		if err := checkEmptyDir(e.chroot); err != nil {
+			return err
+		}
 	}
 
-	err = bw.Flush()
-	incOnSuccess(&e.entries, err)
+	if e.options.atomic {
+		return e.extractAtomic(ctx, filter)
+	}
+	return e.extract(ctx, filter)
+}
 
-	return err
+// begin marks the start of an extraction or verification, returning false if
+// one is already in progress.
+func (e *Extractor) begin() bool {
+	return atomic.CompareAndSwapInt32(&e.running, 0, 1)
 }
 
-func (e *Extractor) updateFileMetadata(path string, file *zip.File) error {
-	fields, err := zipextra.Parse(file.Extra)
+// end marks the end of an extraction or verification.
+func (e *Extractor) end() {
+	atomic.StoreInt32(&e.running, 0)
+}
+
+// checkEmptyDir returns ErrChrootNotEmpty if dir exists and isn't empty.
+func checkEmptyDir(dir string) error {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	if err := lchtimes(path, file.Mode(), time.Now(), file.Modified); err != nil {
+	_, err = f.Readdirnames(1)
+	switch {
+	case err == io.EOF:
+		return nil
+	case err != nil:
 		return err
 	}
 
-	if err := lchmod(path, file.Mode()); err != nil {
+	return fmt.Errorf("%s: %w", dir, ErrChrootNotEmpty)
+}
+
+func (e *Extractor) extract(ctx context.Context, filter func(*zip.File) bool) (err error) {
+	files, err := e.prepare(filter)
+	if err != nil {
 		return err
 	}
 
-	unixfield, ok := fields[zipextra.ExtraFieldUnixN]
-	if !ok {
-		return nil
+	if e.options.orderedEvents {
+		e.ordered = newOrderedEvents(files)
+		defer e.flushEvents()
 	}
 
-	unix, err := unixfield.InfoZIPNewUnix()
-	if err != nil {
-		return err
+	// remove the reader's references to the entries, so that each file's entry
+	// can be reclaimed once it has been extracted
+	var released map[string]struct{}
+	if e.options.releaseEntries {
+		if e.options.noSymlinksPolicy == NoSymlinksCopy {
+			e.loadSymlinkSources()
+		}
+		if e.options.fsync {
+			released = make(map[string]struct{})
+		}
+		e.zr.File = nil
 	}
 
-	err = lchown(path, int(unix.Uid.Int64()), int(unix.Gid.Int64()))
-	if err == nil {
-		return nil
+	limiter := e.options.limiter
+	if limiter == nil {
+		limiter = make(chan struct{}, e.options.concurrency)
 	}
 
-	if e.options.chownErrorHandler == nil {
-		return nil
+	errs := &entryErrors{enabled: e.options.continueOnError, handler: e.options.errorHandler, handlerMu: &e.m}
+
+	wg, gctx := errgroup.WithContext(ctx)
+	defer func() {
+		if werr := wg.Wait(); werr != nil {
+			err = werr
+		}
+	}()
+
+	// create directories before anything is extracted within them, with
+	// their final permissions, so that they're never more permissive than
+	// the archive specifies whilst they're being populated
+	made := make(map[string]struct{})
+	if err := e.createDirectories(gctx, files, errs, made); err != nil {
+		return err
 	}
 
-	e.m.Lock()
-	defer e.m.Unlock()
+	var hardlinks []hardlink
+	for i, file := range files {
+		if file.Mode()&irregularModes != 0 && e.options.unsupportedTypePolicy == UnsupportedTypeLog {
+			path, _ := e.destination(file)
+			e.skip(file, path, skipUnsupportedType)
+		}
+		if file.Mode()&irregularModes != 0 || file.Mode().IsDir() {
+			continue
+		}
 
-	return e.options.chownErrorHandler(file.Name, err)
+		var path string
+		path, err = e.destination(file)
+		if err != nil {
+			return err
+		}
+
+		if e.pathTooLong(path) {
+			e.skip(file, path, skipPathLength)
+			e.complete(file)
+			continue
+		}
+
+		if err := e.mkdirAll(filepath.Dir(path), made); err != nil {
+			if err := errs.record(file, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if gctx.Err() != nil {
+			return gctx.Err()
+		}
+
+		switch {
+		case file.Mode()&os.ModeSymlink != 0:
+			// defer the creation of symlinks
+			// this is to prevent a traversal vulnerability where a symlink is
+			// first created and then files are additional extracted into it
+			continue
+
+		default:
+			if e.options.preserveHardlinks {
+				target, err := e.hardlinkPath(file)
+				if err != nil {
+					return err
+				}
+
+				// defer the creation of hard links until the files they link
+				// to have been extracted
+				if target != "" && target != path {
+					hardlinks = append(hardlinks, hardlink{path, target, file})
+					continue
+				}
+			}
+
+			select {
+			case limiter <- struct{}{}:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+
+			gf := files[i]
+			if e.options.releaseEntries {
+				files[i] = nil
+				if released != nil {
+					released[filepath.Dir(path)] = struct{}{}
+				}
+			}
+
+			wg.Go(func() error {
+				defer func() { <-limiter }()
+				return errs.record(gf, e.logEntry(gf, path, func() error {
+					if skip, err := e.checkOverwrite(path, gf); skip || err != nil {
+						return err
+					}
+
+					err := e.createFile(gctx, path, gf)
+					if err == nil {
+						// don't apply metadata if extraction has been cancelled
+						err = gctx.Err()
+					}
+					if err == nil {
+						err = e.updateFileMetadata(path, gf)
+					}
+					return err
+				}))
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := wg.Wait(); err != nil {
+		return err
+	}
+
+	for _, link := range hardlinks {
+		link := link
+		err := e.logEntry(link.file, link.path, func() error {
+			return e.createHardlink(link.path, link.target, link.file)
+		})
+		if err := errs.record(link.file, err); err != nil {
+			return err
+		}
+	}
+
+	// handle deferred symlink creation
+	for _, file := range files {
+		if file == nil || file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		path, err := e.destination(file)
+		if err != nil {
+			return err
+		}
+		if e.pathTooLong(path) {
+			continue
+		}
+
+		err = e.logEntry(file, path, func() error {
+			return e.createSymlink(ctx, path, file)
+		})
+		if err := errs.record(file, err); err != nil {
+			return err
+		}
+	}
+
+	// update directory metadata once everything within them has been created
+	// (otherwise modification dates are incorrect), including directories
+	// with no entries within them
+	if err := e.updateDirectoryMetadata(ctx, files, errs, limiter); err != nil {
+		return err
+	}
+
+	if e.options.fsync {
+		if err := e.syncDirs(files, released); err != nil {
+			return err
+		}
+	}
+
+	return errs.err()
+}
+
+// prepare returns the files to be extracted, with duplicates removed, checking
+// that they're within the extraction limits, don't collide and, unless they're to be skipped, don't
+// exceed the maximum path length.
+func (e *Extractor) prepare(filter func(*zip.File) bool) ([]*zip.File, error) {
+	files := e.filterFiles(filter)
+	if e.options.flatten {
+		files = withoutDirectories(files)
+	}
+
+	files, err := e.removeTypeConflicts(files)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err = e.removeDuplicates(files)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	e.total = 0
+	for _, file := range files {
+		if file.Mode()&irregularModes != 0 {
+			if e.options.unsupportedTypePolicy == UnsupportedTypeError {
+				return nil, fmt.Errorf("%s has mode %v, which cannot be extracted: %w", file.Name, file.Mode(), ErrUnsupportedType)
+			}
+			continue
+		}
+		count++
+
+		if file.Mode()&(os.ModeSymlink|os.ModeDir) == 0 {
+			e.total += int64(file.UncompressedSize64)
+		}
+	}
+
+	if e.options.maxFiles > 0 && count > e.options.maxFiles {
+		return nil, fmt.Errorf("archive has %d entries, limit is %d: %w", count, e.options.maxFiles, ErrExtractionLimitExceeded)
+	}
+	if e.options.maxTotalBytes > 0 && e.total > e.options.maxTotalBytes {
+		return nil, fmt.Errorf("archive has %d uncompressed bytes, limit is %d: %w", e.total, e.options.maxTotalBytes, ErrExtractionLimitExceeded)
+	}
+
+	if err := e.checkCaseCollisions(files); err != nil {
+		return nil, err
+	}
+
+	if e.options.maxPathLength > 0 && e.options.pathLengthPolicy == PathLengthError {
+		for _, file := range files {
+			if file.Mode()&irregularModes != 0 {
+				continue
+			}
+
+			path, err := e.destination(file)
+			if err != nil {
+				return nil, err
+			}
+			if e.pathTooLong(path) {
+				return nil, fmt.Errorf("%s is %d bytes, limit is %d: %w", path, len(path), e.options.maxPathLength, ErrPathTooLong)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// pathTooLong returns whether path exceeds the maximum path length.
+func (e *Extractor) pathTooLong(path string) bool {
+	return e.options.maxPathLength > 0 && len(path) > e.options.maxPathLength
+}
+
+// destination returns the path a file is extracted to, checking that it's
+// within the chroot.
+func (e *Extractor) destination(file *zip.File) (string, error) {
+	name := file.Name
+	if isAbsoluteName(name) {
+		if e.options.absolutePathPolicy != AbsolutePathStrip {
+			return "", fmt.Errorf("%s: %w", name, ErrAbsolutePath)
+		}
+		name = stripAbsoluteName(name)
+	}
+	if e.options.flatten {
+		name = flattenName(name)
+	}
+
+	path, err := filepath.Abs(filepath.Join(e.root, name))
+	if err != nil {
+		return "", err
+	}
+
+	// backslashes are separators on Windows, so names that would escape the
+	// chroot when they're treated as such are rejected on all platforms
+	if !e.withinChroot(path) || !e.withinChroot(filepath.Join(e.root, strings.ReplaceAll(name, `\`, "/"))) {
+		return "", &ChrootEscapeError{Name: file.Name, Chroot: e.chroot, Resolved: e.chrootPath(path)}
+	}
+
+	return path, nil
+}
+
+// flattenName returns the base name of an entry, treating both forward and
+// backslashes as separators.
+func flattenName(name string) string {
+	return path.Base(path.Clean(strings.ReplaceAll(name, `\`, "/")))
+}
+
+// withoutDirectories returns files without its directory entries.
+func withoutDirectories(files []*zip.File) []*zip.File {
+	filtered := make([]*zip.File, 0, len(files))
+	for _, file := range files {
+		if !file.Mode().IsDir() {
+			filtered = append(filtered, file)
+		}
+	}
+	return filtered
+}
+
+// isAbsoluteName returns whether an entry's name is absolute on any platform,
+// beginning with a separator or a Windows drive letter.
+func isAbsoluteName(name string) bool {
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return true
+	}
+	return len(name) >= 2 && name[1] == ':' && ('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z')
+}
+
+// stripAbsoluteName removes the drive letter and leading separators of an
+// absolute name.
+func stripAbsoluteName(name string) string {
+	if len(name) >= 2 && name[1] == ':' {
+		name = name[2:]
+	}
+	return strings.TrimLeft(name, `/\`)
+}
+
+// filterFiles returns the files selected by filter, along with any directory
+// entries that are parents of selected files.
+func (e *Extractor) filterFiles(filter func(*zip.File) bool) []*zip.File {
+	if filter == nil {
+		return e.zr.File
+	}
+
+	selected := make([]bool, len(e.zr.File))
+	parents := make(map[string]struct{})
+	for i, file := range e.zr.File {
+		if !filter(file) {
+			continue
+		}
+		selected[i] = true
+
+		for dir := path.Dir(path.Clean(file.Name)); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			parents[dir] = struct{}{}
+		}
+	}
+
+	var files []*zip.File
+	for i, file := range e.zr.File {
+		if !selected[i] && file.Mode().IsDir() {
+			_, selected[i] = parents[path.Clean(file.Name)]
+		}
+		if selected[i] {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// mkdirAll creates dir and any of its parents that don't exist, unless dir has
+// already been created, so that entries sharing a parent don't each require
+// it to be checked. Directories that have been created are recorded in made,
+// along with their parents within the chroot.
+func (e *Extractor) mkdirAll(dir string, made map[string]struct{}) error {
+	if _, ok := made[dir]; ok {
+		return nil
+	}
+
+	if err := e.options.fs.MkdirAll(dir, e.options.dirMode); err != nil {
+		return err
+	}
+
+	for {
+		if _, ok := made[dir]; ok {
+			break
+		}
+		made[dir] = struct{}{}
+		if dir == e.root || dir == filepath.Dir(dir) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	return nil
+}
+
+// createDirectories creates the directory entries, parents first. The
+// directories' modification times and exact modes are applied once
+// everything within them has been extracted.
+func (e *Extractor) createDirectories(ctx context.Context, files []*zip.File, errs *entryErrors, made map[string]struct{}) error {
+	var dirs []*zip.File
+	for _, file := range files {
+		if file.Mode()&irregularModes == 0 && file.Mode().IsDir() {
+			dirs = append(dirs, file)
+		}
+	}
+
+	// parents are created before their children even if an archive lists
+	// them afterwards, so that they're not created implicitly
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return strings.Count(path.Clean(dirs[i].Name), "/") < strings.Count(path.Clean(dirs[j].Name), "/")
+	})
+
+	for _, file := range dirs {
+		path, err := e.destination(file)
+		if err != nil {
+			return err
+		}
+
+		if e.pathTooLong(path) {
+			e.skip(file, path, skipPathLength)
+			e.complete(file)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err = e.logEntry(file, path, func() error {
+			if err := e.mkdirAll(filepath.Dir(path), made); err != nil {
+				return err
+			}
+			return e.createDirectory(path, file)
+		})
+		if err := errs.record(file, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateDirectoryMetadata updates the metadata of the directory entries. The
+// directories at each depth are updated concurrently, deepest first, so that
+// children are updated before their parents' permissions are restored.
+func (e *Extractor) updateDirectoryMetadata(ctx context.Context, files []*zip.File, errs *entryErrors, limiter chan struct{}) error {
+	type dir struct {
+		path string
+		file *zip.File
+	}
+
+	var depths []int
+	levels := make(map[int][]dir)
+	for i := len(files) - 1; i >= 0; i-- {
+		file := files[i]
+		if file == nil || !file.Mode().IsDir() {
+			continue
+		}
+
+		path, err := e.destination(file)
+		if err != nil {
+			return err
+		}
+		if e.pathTooLong(path) {
+			continue
+		}
+
+		depth := strings.Count(path, string(filepath.Separator))
+		if _, ok := levels[depth]; !ok {
+			depths = append(depths, depth)
+		}
+		levels[depth] = append(levels[depth], dir{path, file})
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(depths)))
+
+	for _, depth := range depths {
+		wg, gctx := errgroup.WithContext(ctx)
+		for _, d := range levels[depth] {
+			d := d
+
+			select {
+			case limiter <- struct{}{}:
+			case <-gctx.Done():
+				if err := wg.Wait(); err != nil {
+					return err
+				}
+				return gctx.Err()
+			}
+
+			wg.Go(func() error {
+				defer func() { <-limiter }()
+				if gctx.Err() != nil {
+					return gctx.Err()
+				}
+				return errs.record(d.file, e.updateFileMetadata(d.path, d.file))
+			})
+		}
+		if err := wg.Wait(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createDirectory creates a directory with the entry's permissions. The
+// owner can always write to and search the directory, so that its children
+// can be extracted, and the exact mode is set later.
+func (e *Extractor) createDirectory(path string, file *zip.File) error {
+	// the directory is created with its final permissions, whilst remaining
+	// writable by its owner until its contents have been extracted
+	err := e.options.fs.Mkdir(path, e.mode(file).Perm()|0700)
+	if err == nil {
+		e.recordCreated(path)
+	}
+	if os.IsExist(err) {
+		err = nil
+	}
+	incOnSuccess(&e.entries, err)
+	incOnSuccess(&e.directories, err)
+	return err
+}
+
+// mode returns the mode an entry is given, with the mode mask applied and
+// special bits removed unless they're preserved.
+func (e *Extractor) mode(file *zip.File) os.FileMode {
+	mode := file.Mode() &^ (permMask &^ e.options.modeMask)
+	if !e.options.preserveSpecial {
+		mode &^= specialModes
+	}
+	return mode
+}
+
+func (e *Extractor) createSymlink(ctx context.Context, path string, file *zip.File) error {
+	switch e.options.noSymlinksPolicy {
+	case NoSymlinksSkip:
+		e.skip(file, path, skipSymlink)
+		return nil
+
+	case NoSymlinksError:
+		return fmt.Errorf("%s: %w", file.Name, ErrSymlinkNotAllowed)
+	}
+
+	target, skip, err := e.symlinkTarget(path, file)
+	if err != nil {
+		return err
+	}
+	if skip {
+		e.skip(file, path, skipSymlink)
+		return nil
+	}
+
+	if e.options.noSymlinksPolicy == NoSymlinksCopy {
+		return e.copySymlink(ctx, path, target, file)
+	}
+
+	if skip, err := e.checkOverwrite(path, file); skip || err != nil {
+		return err
+	}
+
+	if !e.options.assumeCleanTarget {
+		if err := e.options.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := e.options.fs.Symlink(target, path); err != nil {
+		return err
+	}
+	e.recordCreated(path)
+
+	err = e.updateFileMetadata(path, file)
+	incOnSuccess(&e.entries, err)
+	incOnSuccess(&e.symlinks, err)
+
+	return err
+}
+
+// copySymlink extracts the file that a symlink's target refers to in place of
+// the symlink, following the targets of any other symlinks along the way. The
+// file is extracted with its own metadata.
+func (e *Extractor) copySymlink(ctx context.Context, path, target string, file *zip.File) error {
+	e.loadSymlinkSources()
+
+	link := e.chrootPath(path)
+	for i := 0; i < maxSymlinkCopyDepth; i++ {
+		resolved := resolveSymlink(link, target)
+
+		src, ok := e.symlinkSources[resolved]
+		switch {
+		case !ok || src.Mode().IsDir() || src.Mode()&irregularModes != 0:
+			return fmt.Errorf("%s symlink target %s: %w", file.Name, target, ErrSymlinkTargetNotFile)
+
+		case src.Mode()&os.ModeSymlink != 0:
+			var err error
+			if target, err = e.readSymlink(src); err != nil {
+				return err
+			}
+			if resolved := resolveSymlink(resolved, target); !withinDir(e.chroot, resolved) {
+				return &ChrootEscapeError{Name: file.Name, Chroot: e.chroot, Resolved: resolved, Target: target}
+			}
+			link = resolved
+			continue
+		}
+
+		if skip, err := e.checkOverwrite(path, file); skip || err != nil {
+			return err
+		}
+
+		if err := e.createFile(ctx, path, src); err != nil {
+			return err
+		}
+		return e.updateFileMetadata(path, src)
+	}
+
+	return fmt.Errorf("%s symlink target %s: too many levels of symlinks: %w", file.Name, target, ErrSymlinkTargetNotFile)
+}
+
+// loadSymlinkSources indexes the archive's entries by their destination within
+// the chroot, for copySymlink, if they haven't already been.
+func (e *Extractor) loadSymlinkSources() {
+	if e.symlinkSources != nil {
+		return
+	}
+
+	e.symlinkSources = make(map[string]*zip.File)
+	for _, f := range e.zr.File {
+		if dest, err := e.destination(f); err == nil {
+			e.symlinkSources[e.chrootPath(dest)] = f
+		}
+	}
+}
+
+// symlinkTarget reads a symlink's target, applying the symlink policy if it
+// resolves outside of the chroot. It returns whether the symlink should be
+// skipped.
+func (e *Extractor) symlinkTarget(path string, file *zip.File) (string, bool, error) {
+	target, err := e.readSymlink(file)
+	if err != nil {
+		return "", false, err
+	}
+
+	// the target is resolved relative to the symlink's parent directory, which
+	// can't be checked if it's reached through another symlink, such as one
+	// that links to the chroot itself
+	parent, err := e.symlinkParent(path)
+	if err != nil {
+		return "", false, err
+	}
+	if parent != "" {
+		if e.options.symlinkPolicy == SymlinkSkip {
+			return target, true, nil
+		}
+		return "", false, fmt.Errorf("%s is within %s: %w", file.Name, e.chrootPath(parent), ErrSymlinkParent)
+	}
+
+	// absolute targets refer to the chroot, rather than to the temporary
+	// directory of an atomic extraction, so the target is resolved from the
+	// symlink's path within the chroot
+	if resolved := resolveSymlink(e.chrootPath(path), target); !withinDir(e.chroot, resolved) {
+		switch e.options.symlinkPolicy {
+		case SymlinkSkip:
+			return target, true, nil
+
+		case SymlinkClamp:
+			if target, err = e.clampSymlink(path, target); err != nil {
+				return "", false, err
+			}
+
+		default:
+			return "", false, &ChrootEscapeError{Name: file.Name, Chroot: e.chroot, Resolved: resolved, Target: target}
+		}
+	}
+
+	return target, false, nil
+}
+
+// symlinkParent returns the first directory between the root and path that is
+// a symlink, or an empty string if there isn't one.
+func (e *Extractor) symlinkParent(path string) (string, error) {
+	var dirs []string
+	for dir := filepath.Dir(path); dir != e.root && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := e.options.fs.Lstat(dirs[i])
+		switch {
+		case os.IsNotExist(err):
+			return "", nil
+		case err != nil:
+			return "", err
+		case fi.Mode()&os.ModeSymlink != 0:
+			return dirs[i], nil
+		}
+	}
+
+	return "", nil
+}
+
+// readSymlink reads a symlink entry's target.
+func (e *Extractor) readSymlink(file *zip.File) (string, error) {
+	r, err := e.openFile(file)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	target, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+// checkOverwrite applies the overwrite policy to path, returning whether the
+// entry should be skipped.
+func (e *Extractor) checkOverwrite(path string, file *zip.File) (bool, error) {
+	if e.options.overwritePolicy == OverwriteReplace {
+		return false, nil
+	}
+
+	action, err := e.overwriteAction(path)
+	if action == PlanSkip {
+		e.skip(file, path, skipOverwrite)
+	}
+
+	return action == PlanSkip, err
+}
+
+// skip counts an entry as skipped.
+func (e *Extractor) skip(file *zip.File, path, reason string) {
+	atomic.AddInt64(&e.skipped, 1)
+	e.log(LogEntrySkip, file, "path", path, "reason", reason)
+}
+
+// overwriteAction returns the action the overwrite policy results in for
+// path.
+func (e *Extractor) overwriteAction(path string) (PlanAction, error) {
+	_, err := e.options.fs.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		return PlanCreate, nil
+
+	case err != nil:
+		return PlanCreate, err
+
+	case e.options.overwritePolicy == OverwriteSkip:
+		return PlanSkip, nil
+
+	case e.options.overwritePolicy == OverwriteError:
+		return PlanCreate, &os.PathError{Op: "extract", Path: path, Err: os.ErrExist}
+	}
+
+	return PlanReplace, nil
+}
+
+// withinChroot returns whether path is the root or a descendant of it.
+func (e *Extractor) withinChroot(path string) bool {
+	return withinDir(e.root, path)
+}
+
+// chrootPath returns the path within the chroot that corresponds to a path
+// within the root.
+func (e *Extractor) chrootPath(path string) string {
+	if e.root == e.chroot {
+		return path
+	}
+
+	rel, err := filepath.Rel(e.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(e.chroot, rel)
+}
+
+// clampSymlink rewrites a symlink's target so that it resolves within the
+// chroot. The chroot is treated as the root directory, so absolute targets are
+// relative to it and parent directory references cannot traverse above it.
+func (e *Extractor) clampSymlink(path, target string) (string, error) {
+	dir, err := filepath.Rel(e.root, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+
+	sep := string(filepath.Separator)
+	if isAbsTarget(target) {
+		target = sep + target[len(filepath.VolumeName(target)):]
+	} else {
+		target = filepath.Join(sep, dir, target)
+	}
+
+	return filepath.Rel(filepath.Dir(path), filepath.Join(e.root, filepath.Clean(target)))
+}
+
+// resolveSymlink returns the path a symlink located at path resolves to.
+func resolveSymlink(path, target string) string {
+	if isAbsTarget(target) {
+		return filepath.Clean(target)
+	}
+	return filepath.Join(filepath.Dir(path), target)
+}
+
+// isAbsTarget returns whether a symlink target is absolute. This includes
+// targets that are rooted or have a volume name but are not considered
+// absolute by filepath.IsAbs on Windows.
+func isAbsTarget(target string) bool {
+	return filepath.IsAbs(target) ||
+		filepath.VolumeName(target) != "" ||
+		(target != "" && os.IsPathSeparator(target[0]))
+}
+
+type hardlink struct {
+	path   string
+	target string
+	file   *zip.File
+}
+
+// hardlinkPath returns the path of the file a hard link entry links to, or an
+// empty string if the entry isn't a hard link.
+func (e *Extractor) hardlinkPath(file *zip.File) (string, error) {
+	name, err := hardlinkTarget(file.Extra)
+	if err != nil || name == "" {
+		return "", err
+	}
+
+	target, err := filepath.Abs(filepath.Join(e.root, name))
+	if err != nil {
+		return "", err
+	}
+
+	if !e.withinChroot(target) {
+		return "", &ChrootEscapeError{Name: file.Name, Chroot: e.chroot, Resolved: e.chrootPath(target), Target: name}
+	}
+
+	return target, nil
+}
+
+func (e *Extractor) createHardlink(path, target string, file *zip.File) error {
+	fi, err := e.options.fs.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s hard link target %s is not a regular file", file.Name, target)
+	}
+
+	if skip, err := e.checkOverwrite(path, file); skip || err != nil {
+		return err
+	}
+
+	if !e.options.assumeCleanTarget {
+		if err := e.options.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err = e.options.fs.Link(target, path)
+	incOnSuccess(&e.entries, err)
+	incOnSuccess(&e.files, err)
+	if err == nil {
+		e.recordCreated(path)
+	}
+
+	return err
+}
+
+// openDestination creates the file an entry is extracted to. When the target is
+// assumed to be clean, the file is created exclusively, and only if it already
+// exists is it checked to be a regular file before replacing its contents, so
+// that nothing is written through a symlink.
+func (e *Extractor) openDestination(path string) (File, error) {
+	perm := 0666 & e.options.modeMask
+	if !e.options.assumeCleanTarget {
+		return e.options.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	}
+
+	f, err := e.options.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if !os.IsExist(err) {
+		return f, err
+	}
+
+	fi, err := e.options.fs.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s already exists: %w", path, ErrNotRegularFile)
+	}
+
+	return e.options.fs.OpenFile(path, os.O_WRONLY|os.O_TRUNC, perm)
+}
+
+func (e *Extractor) createFile(ctx context.Context, path string, file *zip.File) (err error) {
+	if e.openFiles != nil {
+		select {
+		case e.openFiles <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-e.openFiles }()
+	}
+
+	if !e.options.assumeCleanTarget {
+		if err := e.options.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	var profile EntryProfile
+	if e.options.profiling {
+		defer func() {
+			if err == nil {
+				e.addProfile(file.Name, profile)
+			}
+		}()
+	}
+
+	start := time.Now()
+	r, err := e.openFile(file)
+	if err != nil {
+		return err
+	}
+	defer dclose(r, &err)
+	profile.Decompress = time.Since(start)
+
+	f, err := e.openDestination(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// remove partially written files
+		if err != nil {
+			e.options.fs.Remove(path)
+		}
+	}()
+	defer dclose(f, &err)
+
+	bw := e.bufPool.Get().(*bufio.Writer)
+	defer e.bufPool.Put(bw)
+
+	var fw io.Writer = f
+	sparse, ok := f.(sparseFile)
+	if ok && e.options.sparse {
+		fw = &sparseWriter{f: sparse}
+	}
+
+	var w io.Writer = countWriter{fw, &e.written, ctx}
+	if e.options.profiling {
+		w = countWriter{timedWriter{fw, &profile.Write}, &e.written, ctx}
+	}
+	if e.rateLimiter != nil {
+		w = rateWriter{w, e.rateLimiter, ctx}
+	}
+	if e.options.progress != nil {
+		w = progressWriter{w, func() {
+			written := atomic.LoadInt64(&e.written)
+			e.emit(file, false, func() {
+				e.options.progress(file.Name, written, e.total)
+			})
+		}}
+	}
+
+	var rd io.Reader = r
+	if e.options.profiling {
+		rd = timedReader{r, &profile.Decompress}
+	}
+	var crc hash.Hash32
+	if e.options.verifyChecksum && storesChecksum(file) {
+		crc = crc32.NewIEEE()
+		rd = io.TeeReader(rd, crc)
+	}
+
+	bw.Reset(w)
+	_, err = bw.ReadFrom(rd)
+	if crc != nil && (err == nil || errors.Is(err, zip.ErrChecksum)) {
+		if sum := crc.Sum32(); sum != file.CRC32 {
+			return fmt.Errorf("%s checksum mismatch, expected %08x, got %08x: %w", file.Name, file.CRC32, sum, zip.ErrChecksum)
+		}
+	}
+	if err != nil {
+		// the zip reader returns ErrFormat if an entry's data exceeds its
+		// declared uncompressed size
+		if errors.Is(err, zip.ErrFormat) && e.options.maxTotalBytes > 0 {
+			return fmt.Errorf("%s exceeds its declared size: %w", file.Name, ErrExtractionLimitExceeded)
+		}
+		return err
+	}
+
+	err = bw.Flush()
+	if sw, ok := fw.(*sparseWriter); ok && err == nil {
+		err = sw.finish()
+	}
+	if s, ok := f.(syncer); ok && e.options.fsync && err == nil {
+		start := time.Now()
+		err = s.Sync()
+		profile.Write += time.Since(start)
+	}
+	incOnSuccess(&e.entries, err)
+	incOnSuccess(&e.files, err)
+	if err == nil {
+		e.recordCreated(path)
+	}
+
+	return err
+}
+
+// syncer is implemented by files that can be flushed to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// syncDirs flushes each directory that entries were extracted to, and their
+// parent directories up to the chroot, to stable storage. The directories of
+// entries that have been released are provided separately.
+func (e *Extractor) syncDirs(files []*zip.File, released map[string]struct{}) error {
+	fs, ok := e.options.fs.(dirSyncer)
+	if !ok {
+		return nil
+	}
+
+	dirs := make(map[string]struct{})
+	add := func(dir string) {
+		for ; e.withinChroot(dir); dir = filepath.Dir(dir) {
+			if _, ok := dirs[dir]; ok {
+				break
+			}
+			dirs[dir] = struct{}{}
+		}
+	}
+
+	for dir := range released {
+		add(dir)
+	}
+
+	for _, file := range files {
+		if file == nil || file.Mode()&irregularModes != 0 {
+			continue
+		}
+
+		path, err := e.destination(file)
+		if err != nil {
+			return err
+		}
+		add(filepath.Dir(path))
+	}
+
+	// sync the deepest directories first
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	for _, dir := range sorted {
+		if err := fs.syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// progressWriter calls report after each write to the underlying writer.
+type progressWriter struct {
+	w      io.Writer
+	report func()
+}
+
+func (w progressWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	if n > 0 {
+		w.report()
+	}
+	return n, err
+}
+
+func (e *Extractor) updateFileMetadata(path string, file *zip.File) error {
+	if e.options.profiling {
+		defer func(start time.Time) {
+			e.addProfile(file.Name, EntryProfile{Metadata: time.Since(start)})
+		}(time.Now())
+	}
+
+	fields, err := zipextra.Parse(file.Extra)
+	if err != nil {
+		return err
+	}
+
+	atime, mtime := time.Now(), file.Modified
+	var ctime time.Time
+	if e.options.restorePreciseTimes {
+		if times, ok := ntfsTimes(fields); ok {
+			atime, mtime, ctime = times.ATime, times.MTime, times.CTime
+		}
+	}
+	if e.options.restoreAccessTime {
+		if times, ok := ntfsTimes(fields); ok && !times.ATime.IsZero() {
+			atime = times.ATime
+		}
+	}
+
+	if e.options.preserveModTime {
+		if err := e.options.fs.Lchtimes(path, file.Mode(), atime, mtime); err != nil {
+			return err
+		}
+
+		if fs, ok := e.options.fs.(creationTimer); ok && !ctime.IsZero() {
+			if err := fs.lchctime(path, file.Mode(), ctime); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := e.updateOwnership(path, file, fields); err != nil {
+		return err
+	}
+
+	// the mode is restored after ownership, as changing ownership clears the
+	// setuid and setgid bits
+	if err := e.options.fs.Lchmod(path, e.mode(file)); err != nil && !(file.Mode()&os.ModeSymlink != 0 && notSupported(err)) {
+		return err
+	}
+
+	// extended attributes are restored after ownership, as changing
+	// ownership can clear some (such as security.capability)
+	if e.options.restoreXattrs {
+		if err := e.updateXattrs(path, file, fields); err != nil {
+			return err
+		}
+	}
+
+	// DOS attributes are restored after the mode, which would otherwise
+	// overwrite the read-only attribute
+	if fs, ok := e.options.fs.(dosAttributer); ok && e.options.restoreDOSAttributes {
+		if err := fs.setDOSAttributes(path, file.Mode(), file.ExternalAttrs&dosAttributeMask); err != nil {
+			return err
+		}
+	}
+
+	// file flags are restored last, as flags such as immutable prevent any
+	// further changes to the file
+	if e.options.restoreFileFlags {
+		if err := e.updateFileFlags(path, file, fields); err != nil {
+			return err
+		}
+	}
+
+	e.log(LogMetadataApplied, file, "path", path)
+
+	return nil
+}
+
+func (e *Extractor) updateFileFlags(path string, file *zip.File, fields map[uint16]zipextra.ExtraField) error {
+	field, ok := fields[ExtraFieldFileFlags]
+	if !ok {
+		return nil
+	}
+
+	flags, err := decodeFileFlags(field)
+	if err != nil {
+		return err
+	}
+
+	if fs, ok := e.options.fs.(fileFlagger); ok {
+		return fs.setFileFlags(path, file.Mode(), flags)
+	}
+
+	return nil
+}
+
+// notSupported returns whether err is because an operation isn't supported,
+// such as changing the mode of a symlink on some platforms and filesystems.
+// The permissions of symlinks are ignored on most platforms, so failing to set
+// them is tolerated.
+func notSupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// dosAttributeMask are the DOS attributes restored: read-only, hidden, system
+// and archive.
+const dosAttributeMask = 0x01 | 0x02 | 0x04 | 0x20
+
+// ntfsTimes returns the times stored in the NTFS extra field.
+func ntfsTimes(fields map[uint16]zipextra.ExtraField) (zipextra.NTFSTimeAttribute, bool) {
+	ef, ok := fields[zipextra.ExtraFieldNTFS]
+	if !ok {
+		return zipextra.NTFSTimeAttribute{}, false
+	}
+
+	ntfs, err := ef.NTFS()
+	if err != nil {
+		return zipextra.NTFSTimeAttribute{}, false
+	}
+
+	for _, attr := range ntfs.Attributes {
+		if times, ok := attr.(zipextra.NTFSTimeAttribute); ok {
+			return times, true
+		}
+	}
+
+	return zipextra.NTFSTimeAttribute{}, false
+}
+
+func (e *Extractor) updateOwnership(path string, file *zip.File, fields map[uint16]zipextra.ExtraField) error {
+	var uid, gid int
+	switch {
+	case e.options.forceOwner:
+		uid, gid = e.options.forceUID, e.options.forceGID
+
+	case !e.options.preserveOwnership:
+		return nil
+
+	default:
+		var ok bool
+		var err error
+		uid, gid, ok, err = ownership(fields)
+		if err != nil || !ok {
+			return err
+		}
+
+		if e.options.uidGIDMap != nil {
+			uid, gid = e.options.uidGIDMap(uid, gid)
+		}
+	}
+
+	err := e.options.fs.Lchown(path, uid, gid)
+	if err == nil {
+		return nil
+	}
+
+	if e.options.chownErrorHandler == nil {
+		return nil
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	return e.options.chownErrorHandler(file.Name, err)
+}
+
+func (e *Extractor) updateXattrs(path string, file *zip.File, fields map[uint16]zipextra.ExtraField) error {
+	field, ok := fields[ExtraFieldXattrs]
+	if !ok {
+		return nil
+	}
+
+	attrs, err := decodeXattrs(field)
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range attrs {
+		err := e.options.fs.Lsetxattr(path, attr.name, attr.value)
+		if err == nil || e.options.xattrErrorHandler == nil {
+			continue
+		}
+
+		e.m.Lock()
+		err = e.options.xattrErrorHandler(file.Name, err)
+		e.m.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -1,13 +1,219 @@
 package fastzip
 
+import (
+	"errors"
+	"os"
+
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/text/encoding"
+)
+
+var (
+	ErrMinBufferSize = errors.New("buffer size must be at least 1")
+	ErrMinOpenFiles  = errors.New("max open files must be at least 1")
+)
+
+const (
+	// specialModes are the setuid, setgid and sticky bits.
+	specialModes = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+	// permMask is the permission and special bits of a mode.
+	permMask = os.ModePerm | specialModes
+)
+
 // ExtractorOption is an option used when creating an extractor.
 type ExtractorOption func(*extractorOptions) error
 
 type extractorOptions struct {
 	concurrency       int
 	chownErrorHandler func(name string, err error) error
+	uidGIDMap         func(uid, gid int) (int, int)
+	forceOwner        bool
+	forceUID          int
+	forceGID          int
+	preserveOwnership bool
+	preserveModTime   bool
+	preserveSpecial   bool
+	symlinkPolicy     SymlinkPolicy
+	noSymlinksPolicy  NoSymlinksPolicy
+	progress          func(name string, bytesWritten, totalBytes int64)
+	maxFiles          int
+	maxTotalBytes     int64
+	overwritePolicy   OverwritePolicy
+	verifyChecksum    bool
+	password          []byte
+	restoreXattrs     bool
+	xattrErrorHandler func(name string, err error) error
+	restoreFileFlags  bool
+	preserveHardlinks bool
+	fs                Filesystem
+	dirMode           os.FileMode
+	modeMask          os.FileMode
+
+	restorePreciseTimes   bool
+	restoreAccessTime     bool
+	caseCollisionPolicy   CaseCollisionPolicy
+	duplicatePolicy       DuplicatePolicy
+	typeConflictPolicy    TypeConflictPolicy
+	limiter               chan struct{}
+	continueOnError       bool
+	atomic                bool
+	tempDir               string
+	sparse                bool
+	rateLimit             int64
+	bufferSize            int
+	maxOpenFiles          int
+	fsync                 bool
+	releaseEntries        bool
+	profiling             bool
+	flatten               bool
+	orderedEvents         bool
+	assumeCleanTarget     bool
+	filenameEncoding      encoding.Encoding
+	unsupportedTypePolicy UnsupportedTypePolicy
+	recordCreatedPaths    bool
+	errorHandler          func(file *zip.File, err error) error
+
+	restoreDOSAttributes bool
+	maxPathLength        int
+	pathLengthPolicy     PathLengthPolicy
+	requireEmptyChroot   bool
+	absolutePathPolicy   AbsolutePathPolicy
+	logger               func(event LogEvent, name string, fields map[string]interface{})
 }
 
+// SymlinkPolicy determines how a symlink with a target that resolves outside
+// of the chroot is handled.
+type SymlinkPolicy int
+
+const (
+	// SymlinkError causes extraction to fail.
+	SymlinkError SymlinkPolicy = iota
+
+	// SymlinkSkip skips creation of the symlink.
+	SymlinkSkip
+
+	// SymlinkClamp rewrites the symlink's target as if the chroot were the
+	// root directory, so that it always resolves within the chroot.
+	SymlinkClamp
+)
+
+// NoSymlinksPolicy determines whether symlinks are created, for environments
+// where they are disallowed.
+type NoSymlinksPolicy int
+
+const (
+	// NoSymlinksOff creates symlinks.
+	NoSymlinksOff NoSymlinksPolicy = iota
+
+	// NoSymlinksSkip skips every symlink, and counts it as skipped.
+	NoSymlinksSkip
+
+	// NoSymlinksError causes extraction to fail with ErrSymlinkNotAllowed if
+	// the archive contains a symlink.
+	NoSymlinksError
+
+	// NoSymlinksCopy extracts a copy of the file that a symlink refers to in
+	// its place.
+	NoSymlinksCopy
+)
+
+// OverwritePolicy determines how files and symlinks that already exist at the
+// destination are handled.
+type OverwritePolicy int
+
+const (
+	// OverwriteReplace removes the existing file before it is extracted.
+	OverwriteReplace OverwritePolicy = iota
+
+	// OverwriteSkip leaves the existing file untouched, and counts the entry
+	// as skipped.
+	OverwriteSkip
+
+	// OverwriteError causes extraction to fail.
+	OverwriteError
+)
+
+// CaseCollisionPolicy determines whether extraction fails when two entries
+// have names that differ only by case, which would be extracted to the same
+// path on a case-insensitive filesystem, with one overwriting the other.
+type CaseCollisionPolicy int
+
+const (
+	// CaseCollisionIgnore does not check for collisions.
+	CaseCollisionIgnore CaseCollisionPolicy = iota
+
+	// CaseCollisionAuto checks for collisions if the chroot's filesystem is
+	// detected to be case-insensitive.
+	CaseCollisionAuto
+
+	// CaseCollisionAlways checks for collisions regardless of the chroot's
+	// filesystem.
+	CaseCollisionAlways
+)
+
+// DuplicatePolicy determines how entries that would be extracted to the same
+// path are handled.
+type DuplicatePolicy int
+
+const (
+	// DuplicateLastWins extracts only the last of the entries.
+	DuplicateLastWins DuplicatePolicy = iota
+
+	// DuplicateFirstWins extracts only the first of the entries.
+	DuplicateFirstWins
+
+	// DuplicateError causes extraction to fail with ErrDuplicateEntry, before
+	// anything is extracted. Duplicate directories are allowed.
+	DuplicateError
+)
+
+// TypeConflictPolicy determines how a path that entries use as both a
+// directory and a non-directory is handled, such as a file named "foo" and a
+// directory named "foo/", or a file named "foo" and a file named "foo/bar".
+type TypeConflictPolicy int
+
+const (
+	// TypeConflictError causes extraction to fail with ErrTypeConflict, before
+	// anything is extracted.
+	TypeConflictError TypeConflictPolicy = iota
+
+	// TypeConflictDirectoryWins extracts the directory, and not the files and
+	// symlinks that conflict with it.
+	TypeConflictDirectoryWins
+
+	// TypeConflictIgnore extracts the entries regardless, which fails with an
+	// error from the filesystem or replaces one entry with another, depending
+	// on the order of the entries and the overwrite behaviour.
+	TypeConflictIgnore
+)
+
+// PathLengthPolicy determines how entries with a path longer than the limit
+// set by WithExtractorMaxPathLength are handled.
+type PathLengthPolicy int
+
+const (
+	// PathLengthError causes extraction to fail with ErrPathTooLong, before
+	// anything is extracted.
+	PathLengthError PathLengthPolicy = iota
+
+	// PathLengthSkip skips the entry, and counts it as skipped.
+	PathLengthSkip
+)
+
+// AbsolutePathPolicy determines how entries with absolute names, such as
+// /etc/passwd or C:\Windows, are handled.
+type AbsolutePathPolicy int
+
+const (
+	// AbsolutePathError causes extraction to fail with ErrAbsolutePath.
+	AbsolutePathError AbsolutePathPolicy = iota
+
+	// AbsolutePathStrip removes the drive letter and leading separators, so
+	// that the entry is extracted relative to the chroot.
+	AbsolutePathStrip
+)
+
 // WithExtractorConcurrency will set the maximum number of files being
 // extracted concurrently. The default is set to GOMAXPROCS.
 func WithExtractorConcurrency(n int) ExtractorOption {
@@ -20,6 +226,37 @@ func WithExtractorConcurrency(n int) ExtractorOption {
 	}
 }
 
+// WithExtractorLimiter sets a semaphore that limits the number of files
+// being extracted concurrently, so that it can be shared between extractors.
+// A slot is acquired by sending to the channel for each file extracted, and
+// released by receiving from it. The channel's capacity is the number of files
+// that can be extracted concurrently, overriding WithExtractorConcurrency, and
+// is owned by the caller.
+func WithExtractorLimiter(sem chan struct{}) ExtractorOption {
+	return func(o *extractorOptions) error {
+		if cap(sem) == 0 {
+			return ErrMinConcurrency
+		}
+		o.limiter = sem
+		return nil
+	}
+}
+
+// WithExtractorMaxOpenFiles sets the maximum number of files being written
+// at once, independently of the concurrency set by WithExtractorConcurrency,
+// to avoid exceeding the process's open file limit. On Unix, the default is
+// half of the soft limit on open files, and on other platforms there is no
+// limit.
+func WithExtractorMaxOpenFiles(n int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		if n <= 0 {
+			return ErrMinOpenFiles
+		}
+		o.maxOpenFiles = n
+		return nil
+	}
+}
+
 // WithExtractorChownErrorHandler sets an error handler to be called if errors are
 // encountered when trying to preserve ownership of extracted files. Returning
 // nil will continue extraction, returning any error will cause Extract() to
@@ -30,3 +267,580 @@ func WithExtractorChownErrorHandler(fn func(name string, err error) error) Extra
 		return nil
 	}
 }
+
+// WithExtractorForceOwner sets the uid and gid that every extracted entry is
+// owned by, such as to extract as root but have files owned by an application
+// user. The ownership stored in the archive is ignored, and the function set
+// by WithExtractorUIDGIDMap is not called. Ownership is changed even if
+// WithExtractorPreserveOwnership is disabled, and errors are passed to the
+// handler set by WithExtractorChownErrorHandler.
+func WithExtractorForceOwner(uid, gid int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.forceOwner = true
+		o.forceUID, o.forceGID = uid, gid
+		return nil
+	}
+}
+
+// WithExtractorUIDGIDMap sets a function that maps the uid and gid stored in
+// each entry to those the entry is owned by once extracted, such as to restore
+// a backup onto a machine with different user IDs. Returning the values
+// provided leaves them unchanged. The function is only called for entries
+// that store ownership, and errors from changing ownership to the values
+// returned are passed to the handler set by WithExtractorChownErrorHandler.
+// The function may be called from multiple goroutines concurrently.
+func WithExtractorUIDGIDMap(fn func(uid, gid int) (int, int)) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.uidGIDMap = fn
+		return nil
+	}
+}
+
+// WithExtractorPreserveOwnership sets whether the ownership stored in each
+// entry's Info-ZIP Unix extra field is restored. When disabled, no attempt is
+// made to change ownership and the chown error handler is never called, which
+// avoids permission errors when extracting as a user that cannot change
+// ownership. Access permissions and modification times are still restored. The
+// default is true.
+func WithExtractorPreserveOwnership(preserve bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.preserveOwnership = preserve
+		return nil
+	}
+}
+
+// WithExtractorPreserveModTime sets whether each entry's modification time is
+// restored. When disabled, extracted files, directories and symlinks are left
+// with the time they were created, and WithExtractorRestorePreciseTimes has no
+// effect. The default is true.
+func WithExtractorPreserveModTime(preserve bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.preserveModTime = preserve
+		return nil
+	}
+}
+
+// WithExtractorPreserveSpecialBits sets whether the setuid, setgid and sticky
+// bits of each entry's mode are restored. They are applied once ownership has
+// been restored, as changing ownership clears the setuid and setgid bits. The
+// default is false, and the bits are removed, as restoring them from an
+// untrusted archive can create setuid executables, which if extracted as root
+// allow anyone able to run them to gain the privileges of their owner.
+func WithExtractorPreserveSpecialBits(preserve bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.preserveSpecial = preserve
+		return nil
+	}
+}
+
+// WithExtractorSymlinkPolicy sets how symlinks with targets outside of the
+// chroot are handled. The default is SymlinkError. A symlink within a
+// directory that is itself a symlink, such as one created by an earlier entry,
+// can't be checked, and fails with ErrSymlinkParent unless the policy is
+// SymlinkSkip, in which case it's skipped.
+func WithExtractorSymlinkPolicy(policy SymlinkPolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.symlinkPolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorNoSymlinks sets whether symlinks are created, which avoids
+// symlink-based escapes entirely. With NoSymlinksCopy, the file that each
+// symlink's target refers to is extracted in its place, with the metadata of
+// that file, following the targets of other symlinks within the archive. The
+// target must be a regular file within the archive, or extraction fails with
+// ErrSymlinkTargetNotFile: nothing is copied from the disk, even from within
+// the chroot, and directories are not copied. Targets outside of the chroot
+// are first handled by the policy set by WithExtractorSymlinkPolicy, and so
+// are clamped to within the chroot, skipped or cause extraction to fail. The
+// default is NoSymlinksOff.
+func WithExtractorNoSymlinks(policy NoSymlinksPolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.noSymlinksPolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorProgress sets a function to be called as file data is written
+// to disk. It is called with the name of the file being written, the total
+// bytes written so far and the total uncompressed size of all files being
+// extracted. Calls to fn are serialized, so it does not need to be
+// concurrency-safe, but it should return quickly as it blocks extraction.
+func WithExtractorProgress(fn func(name string, bytesWritten, totalBytes int64)) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.progress = fn
+		return nil
+	}
+}
+
+// WithExtractorMaxFiles sets the maximum number of entries (files, directories
+// and symlinks) that can be extracted. If an archive has more entries, Extract()
+// returns an error wrapping ErrExtractionLimitExceeded before extracting
+// anything. The default of 0 is unlimited.
+func WithExtractorMaxFiles(n int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.maxFiles = n
+		return nil
+	}
+}
+
+// WithExtractorMaxTotalBytes sets the maximum total uncompressed size of files
+// that can be extracted. If the sizes declared by an archive exceed this,
+// Extract() returns an error wrapping ErrExtractionLimitExceeded before
+// extracting anything. Files with data exceeding their declared size also
+// return this error, and are removed. The default of 0 is unlimited.
+func WithExtractorMaxTotalBytes(n int64) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.maxTotalBytes = n
+		return nil
+	}
+}
+
+// WithExtractorOverwrite sets how files and symlinks that already exist at the
+// destination are handled. Directories are never replaced: existing
+// directories are extracted into. The default is OverwriteReplace.
+func WithExtractorOverwrite(policy OverwritePolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.overwritePolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorVerifyChecksum enables an explicit check of each file's CRC32
+// against the checksum stored in the archive, after the file has been fully
+// written. On a mismatch, the file is removed and Extract() returns an error
+// wrapping zip.ErrChecksum. Unlike the zip reader's own check, a stored
+// checksum of zero is also verified.
+func WithExtractorVerifyChecksum(verify bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.verifyChecksum = verify
+		return nil
+	}
+}
+
+// WithExtractorPassword sets the password used to decrypt encrypted entries.
+// WinZip AES (AE-1 and AE-2) encryption is supported, with 128, 192 and 256
+// bit keys, as is PKWARE's traditional ZipCrypto encryption, which is insecure
+// but common in older archives. Without a password, extracting an encrypted
+// entry returns an error wrapping ErrPasswordRequired.
+func WithExtractorPassword(password string) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.password = []byte(password)
+		return nil
+	}
+}
+
+// WithExtractorRestoreXattrs enables restoring extended attributes stored in
+// the ExtraFieldXattrs extra field. Restoring extended attributes is supported
+// on Linux, macOS, FreeBSD and NetBSD, and is a no-op on other platforms.
+func WithExtractorRestoreXattrs(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.restoreXattrs = restore
+		return nil
+	}
+}
+
+// WithExtractorXattrErrorHandler sets an error handler to be called if errors
+// are encountered when trying to restore extended attributes. Returning nil
+// will continue extraction, returning any error will cause Extract() to error.
+func WithExtractorXattrErrorHandler(fn func(name string, err error) error) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.xattrErrorHandler = fn
+		return nil
+	}
+}
+
+// WithExtractorRestoreFileFlags enables restoring file flags stored in the
+// ExtraFieldFileFlags extra field. Flags are restored after each file's
+// content and other metadata, as flags such as immutable prevent further
+// changes. Restoring file flags is supported on Linux, and is a no-op on other
+// platforms and filesystems that do not support them. Setting the immutable
+// and append-only flags requires the CAP_LINUX_IMMUTABLE capability.
+func WithExtractorRestoreFileFlags(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.restoreFileFlags = restore
+		return nil
+	}
+}
+
+// WithExtractorPreserveHardlinks enables the creation of hard links for
+// entries with a PKWARE Unix extra field naming the file they link to. Hard
+// links are created once all other files have been extracted, and share the
+// metadata of the file they link to. When disabled, such entries are
+// extracted as regular files.
+func WithExtractorPreserveHardlinks(preserve bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.preserveHardlinks = preserve
+		return nil
+	}
+}
+
+// WithExtractorFilesystem sets the filesystem files are extracted to. The
+// default is the operating system's filesystem.
+func WithExtractorFilesystem(fs Filesystem) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.fs = fs
+		return nil
+	}
+}
+
+// WithExtractorModeMask sets a mask that the permissions of every extracted
+// file and directory are AND-ed with, regardless of the modes stored in the
+// archive, so that a mask of 0755 ensures nothing extracted is group or world
+// writable. It is enforced, unlike the umask, which only applies as files are
+// created. The setuid, setgid and sticky bits are cleared unless the mask
+// includes them. The default mask allows every permission.
+func WithExtractorModeMask(mask os.FileMode) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.modeMask = mask & permMask
+		return nil
+	}
+}
+
+// WithExtractorDirMode sets the permissions of parent directories that are
+// created implicitly because they have no entry in the archive. Directories
+// with an entry use the mode stored in the archive. The default is 0755.
+func WithExtractorDirMode(mode os.FileMode) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.dirMode = mode.Perm()
+		return nil
+	}
+}
+
+// WithExtractorRestorePreciseTimes uses the times stored in the NTFS extra
+// field, when present, in preference to those of other fields. The NTFS extra
+// field has a resolution of 100 nanoseconds and also stores access and
+// creation times. Creation times are only restored on Windows.
+func WithExtractorRestorePreciseTimes(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.restorePreciseTimes = restore
+		return nil
+	}
+}
+
+// WithExtractorRestoreAccessTime restores access times stored in the NTFS
+// extra field, such as by WithArchiverStoreAccessTime, rather than setting them
+// to the time of extraction. Access times are only restored when modification
+// times are, and reading an extracted file may update its access time again,
+// depending on how the filesystem is mounted.
+func WithExtractorRestoreAccessTime(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.restoreAccessTime = restore
+		return nil
+	}
+}
+
+// WithExtractorAbsolutePathPolicy sets how entries with absolute names are
+// handled. Names beginning with a forward slash, a backslash or a drive letter
+// are absolute, regardless of the platform. The default is AbsolutePathError.
+func WithExtractorAbsolutePathPolicy(policy AbsolutePathPolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.absolutePathPolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorDuplicatePolicy sets how entries that would be extracted to
+// the same path, such as two entries with identical names, are handled. An
+// archive with duplicate entries can be a sign of tampering, as different
+// readers may extract different entries. The default is DuplicateLastWins.
+func WithExtractorDuplicatePolicy(policy DuplicatePolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.duplicatePolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorTypeConflictPolicy sets how a path that entries use as both a
+// directory and a non-directory, either explicitly or as the parent of
+// another entry, is handled. The default is TypeConflictError.
+func WithExtractorTypeConflictPolicy(policy TypeConflictPolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.typeConflictPolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorReleaseEntries removes the extractor's references to the
+// archive's entries once extraction begins, so that the memory used by each
+// file's entry can be reclaimed as soon as the file has been extracted. The
+// central directory is always read in full when the archive is opened, but
+// for archives with millions of entries this avoids holding every entry for
+// the whole of extraction. Directories, symlinks and hard links are held until
+// extraction completes, as their creation or metadata is deferred.
+//
+// The extractor can only be used to extract once: afterwards, Files and the
+// other methods that use the archive's entries see none.
+func WithExtractorReleaseEntries(release bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.releaseEntries = release
+		return nil
+	}
+}
+
+// WithExtractorMaxPathLength limits the length, in bytes, of the path each
+// entry is extracted to, including the chroot. Entries with longer paths are
+// handled according to the policy set by WithExtractorPathLengthPolicy. This
+// can be used to reject archives that would fail to extract on filesystems
+// with short path limits, such as Windows without long path support. The
+// default of 0 is unlimited.
+func WithExtractorMaxPathLength(n int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.maxPathLength = n
+		return nil
+	}
+}
+
+// WithExtractorPathLengthPolicy sets how entries with a path longer than the
+// limit set by WithExtractorMaxPathLength are handled. The default is
+// PathLengthError.
+func WithExtractorPathLengthPolicy(policy PathLengthPolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.pathLengthPolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorCaseCollisions sets whether extraction fails with
+// ErrCaseCollision when entries have names that differ only by case. The
+// check is performed before anything is extracted. The default is
+// CaseCollisionIgnore.
+func WithExtractorCaseCollisions(policy CaseCollisionPolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.caseCollisionPolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorErrorHandler sets an error handler to be called if an entry
+// fails to be created or have its metadata updated. Returning nil skips the
+// entry and continues extraction, returning any error will cause Extract() to
+// error. The handler is called from one goroutine at a time, and takes
+// precedence over WithExtractorContinueOnError. Entries that would be
+// extracted outside of the chroot and cancellation always stop extraction
+// without calling the handler.
+func WithExtractorErrorHandler(fn func(file *zip.File, err error) error) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.errorHandler = fn
+		return nil
+	}
+}
+
+// WithExtractorContinueOnError continues extraction when an entry fails to
+// extract, rather than stopping at the first error. Once every other entry has
+// been extracted, Extract returns an ExtractErrors listing each entry that
+// failed. Entries that would be extracted outside of the chroot, exceeding the
+// extraction limits and cancellation still stop extraction immediately.
+func WithExtractorContinueOnError(continueOnError bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.continueOnError = continueOnError
+		return nil
+	}
+}
+
+// WithExtractorAtomic extracts to a temporary directory alongside the chroot,
+// which replaces the chroot only once every entry has been extracted
+// successfully. Anything already at the chroot is removed once it has been
+// replaced. If extraction fails, the temporary directory is removed and the
+// chroot is left untouched.
+//
+// The temporary directory is created in the chroot's parent directory, so
+// that it can be renamed into place without copying. If the chroot is a mount
+// point, which cannot be replaced by renaming, its contents are replaced by
+// copying the extracted files instead, which isn't atomic. Atomic extraction
+// cannot be used with WithExtractorFilesystem.
+func WithExtractorAtomic(atomic bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.atomic = atomic
+		return nil
+	}
+}
+
+// WithExtractorTempDir sets the directory in which WithExtractorAtomic creates
+// its temporary directory. The default is the chroot's parent directory. The
+// directory must exist and be writable, which is checked when the extractor is
+// created.
+//
+// The temporary directory is renamed into place, which isn't possible across
+// filesystems. If the directory is on a different filesystem to the chroot,
+// the extracted files are copied into place and then removed instead, so the
+// chroot is only replaced once every file has been copied, but copying can
+// fail part way through. The directory is only used by atomic extraction.
+func WithExtractorTempDir(dir string) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.tempDir = dir
+		return nil
+	}
+}
+
+// WithExtractorRequireEmptyChroot fails extraction with ErrChrootNotEmpty if
+// the chroot already exists and is not empty, so that an archive is never
+// merged into a populated directory. The check is performed before anything
+// is created. A chroot that doesn't exist is created as usual. Requiring an
+// empty chroot cannot be used with WithExtractorFilesystem.
+func WithExtractorRequireEmptyChroot(require bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.requireEmptyChroot = require
+		return nil
+	}
+}
+
+// WithExtractorProfiling records the time spent decompressing, writing and
+// applying the metadata of each entry, which Profile returns, to help find what
+// dominates a slow extraction. Profiling adds a small overhead to every read
+// and write, so is disabled by default.
+func WithExtractorProfiling(profiling bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.profiling = profiling
+		return nil
+	}
+}
+
+// WithExtractorFlatten extracts every file to the chroot with its base name,
+// discarding the directories within the archive, like unzip's -j flag.
+// Directory entries are skipped, so their metadata isn't applied. Files with
+// the same base name are handled according to WithExtractorDuplicatePolicy.
+// Symlinks are extracted with their targets unchanged, so relative targets are
+// likely to be broken, and can be skipped with WithExtractorNoSymlinks.
+func WithExtractorFlatten(flatten bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.flatten = flatten
+		return nil
+	}
+}
+
+// WithExtractorOrderedEvents emits the events of the functions set by
+// WithExtractorLogger and WithExtractorProgress in the order of the entries
+// within the archive, rather than the order in which they're extracted, so
+// that logs are reproducible. The events of each entry are buffered until it,
+// and every entry before it, has been extracted, which uses memory for the
+// events of entries that finish out of order. Entries are still extracted
+// concurrently: only the emission of events is ordered. Events of an entry
+// after it has been emitted, such as a directory's metadata being applied once
+// everything within it has been extracted, are emitted as they occur.
+func WithExtractorOrderedEvents(ordered bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.orderedEvents = ordered
+		return nil
+	}
+}
+
+// WithExtractorAssumeCleanTarget skips removing whatever is at an entry's path
+// before it's extracted, saving a system call per entry when extracting to an
+// empty directory. Files are created exclusively, and if a file unexpectedly
+// exists, it's replaced only if it's a regular file, otherwise extraction fails
+// with ErrNotRegularFile. Symlinks and hard links fail to be created if
+// anything exists at their path. The default is to remove the path first.
+func WithExtractorAssumeCleanTarget(assume bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.assumeCleanTarget = assume
+		return nil
+	}
+}
+
+// WithExtractorFilenameEncoding sets the encoding of the names of entries that
+// don't have the UTF-8 flag set, such as those of archives created by older
+// tools using a local code page, like GBK (simplifiedchinese.GBK) or Shift-JIS
+// (japanese.ShiftJIS). The names are decoded to UTF-8 when the extractor is
+// created, so are also decoded in Files and Entries. Entries with the flag set
+// are left untouched. By default, names are used as they're stored.
+func WithExtractorFilenameEncoding(enc encoding.Encoding) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.filenameEncoding = enc
+		return nil
+	}
+}
+
+// WithExtractorUnsupportedTypePolicy sets how entries that cannot be
+// extracted, such as devices, named pipes and sockets, are handled. With
+// UnsupportedTypeError, the archive is rejected before anything is extracted.
+// The default is UnsupportedTypeSkip, which skips them silently.
+func WithExtractorUnsupportedTypePolicy(policy UnsupportedTypePolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.unsupportedTypePolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorRecordCreatedPaths records the path of every file, directory
+// and symlink created during extraction, which CreatedPaths returns, so that
+// an extraction can be audited or undone. Paths are only recorded when enabled,
+// as they're held in memory.
+func WithExtractorRecordCreatedPaths(record bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.recordCreatedPaths = record
+		return nil
+	}
+}
+
+// WithExtractorLogger sets a function that is called as each entry is
+// extracted, with the event, the entry's name and fields describing it, such
+// as the path it's extracted to, the reason it was skipped or the error that
+// occurred. The logger is called from one goroutine at a time.
+func WithExtractorLogger(fn func(event LogEvent, name string, fields map[string]interface{})) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.logger = fn
+		return nil
+	}
+}
+
+// WithExtractorSparse skips over blocks of zeros when writing files, rather
+// than writing them, so that files such as disk images are extracted as
+// sparse files on filesystems that support them. Files are still extracted
+// with their full size, and on filesystems without sparse file support the
+// skipped blocks are filled with zeros.
+func WithExtractorSparse(sparse bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.sparse = sparse
+		return nil
+	}
+}
+
+// WithExtractorRateLimit limits the rate extracted file data is written to
+// bytesPerSecond, shared across all files being extracted concurrently. Writes
+// waiting on the limit stop when extraction is cancelled. Zero or a negative
+// rate disables the limit, which is the default.
+func WithExtractorRateLimit(bytesPerSecond int64) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.rateLimit = bytesPerSecond
+		return nil
+	}
+}
+
+// WithExtractorBufferSize sets the size of the buffer used when writing each
+// file. Larger buffers reduce the number of writes for large files, whereas
+// smaller buffers use less memory when extracting many small files
+// concurrently. The default is 32 kibibytes.
+func WithExtractorBufferSize(n int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		if n <= 0 {
+			return ErrMinBufferSize
+		}
+		o.bufferSize = n
+		return nil
+	}
+}
+
+// WithExtractorFsync flushes each extracted file to stable storage before it
+// is closed, and each directory entries were extracted to once extraction has
+// finished, so that extracted data survives a power loss once Extract
+// returns. This can slow extraction considerably, especially when extracting
+// many small files, as each flush waits for the storage device.
+func WithExtractorFsync(fsync bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.fsync = fsync
+		return nil
+	}
+}
+
+// WithExtractorRestoreDOSAttributes enables restoring the read-only, hidden,
+// system and archive attributes stored in each entry's external attributes.
+// Restoring DOS attributes is supported on Windows, and is a no-op on other
+// platforms.
+func WithExtractorRestoreDOSAttributes(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.restoreDOSAttributes = restore
+		return nil
+	}
+}
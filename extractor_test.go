@@ -1,17 +1,32 @@
 package fastzip
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math/big"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/klauspost/compress/zip"
 	"github.com/klauspost/compress/zstd"
+	"github.com/saracen/zipextra"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 func testExtract(t *testing.T, filename string, files map[string]testFile) map[string]os.FileInfo {
@@ -64,6 +79,34 @@ func testExtract(t *testing.T, filename string, files map[string]testFile) map[s
 	return result
 }
 
+type testZipEntry struct {
+	name     string
+	mode     os.FileMode
+	contents string
+	extra    []byte
+}
+
+func testCreateZip(t *testing.T, entries ...testZipEntry) string {
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{Name: entry.name, Modified: fixedModTime, Extra: entry.extra}
+		hdr.SetMode(entry.mode)
+
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+
+		_, err = io.WriteString(w, entry.contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	return f.Name()
+}
+
 func TestExtractCancelContext(t *testing.T) {
 	twoMB := strings.Repeat("1", 2*1024*1024)
 	testFiles := map[string]testFile{}
@@ -103,6 +146,62 @@ func TestExtractCancelContext(t *testing.T) {
 	})
 }
 
+func TestExtractCancelContextMetadata(t *testing.T) {
+	twoMB := strings.Repeat("1", 2*1024*1024)
+	testFiles := map[string]testFile{}
+	for i := 0; i < 100; i++ {
+		testFiles[fmt.Sprintf("file_%d", i)] = testFile{mode: 0666, contents: twoMB}
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		extractDir := t.TempDir()
+		e, err := NewExtractor(filename, extractDir, WithExtractorConcurrency(1))
+		require.NoError(t, err)
+		defer e.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error)
+		go func() {
+			done <- e.Extract(ctx)
+		}()
+
+	loop:
+		for {
+			select {
+			case err = <-done:
+				break loop
+
+			default:
+				// cancel as soon as the first file (after the root directory)
+				// has been extracted
+				if _, entries := e.Written(); entries > 1 {
+					cancel()
+				}
+			}
+		}
+
+		require.ErrorIs(t, err, context.Canceled)
+
+		// any file that had its metadata applied must be complete
+		for name := range testFiles {
+			fi, err := os.Stat(filepath.Join(extractDir, name))
+			if os.IsNotExist(err) {
+				continue
+			}
+			require.NoError(t, err)
+
+			if fi.ModTime().Unix() == fixedModTime.Unix() {
+				assert.EqualValues(t, len(twoMB), fi.Size(), "file %v has metadata applied but is incomplete", name)
+			}
+		}
+	})
+}
+
 func TestExtractorWithDecompressor(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foo.go": {mode: 0666},
@@ -174,6 +273,38 @@ func TestExtractorWithChownErrorHandler(t *testing.T) {
 	})
 }
 
+func TestExtractorWithProgress(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go":     {mode: 0666, contents: "foo"},
+		"bar.go":     {mode: 0666, contents: "bar"},
+		"large_file": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 65536)},
+		"empty_dir":  {mode: os.ModeDir | 0777},
+	}
+
+	var total int64
+	for _, tf := range testFiles {
+		total += int64(len(tf.contents))
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		var last int64
+		e, err := NewExtractor(filename, t.TempDir(), WithExtractorProgress(func(name string, bytesWritten, totalBytes int64) {
+			assert.Contains(t, testFiles, name)
+			assert.GreaterOrEqual(t, bytesWritten, last)
+			assert.Equal(t, total, totalBytes)
+			last = bytesWritten
+		}))
+		require.NoError(t, err)
+		require.NoError(t, e.Extract(context.Background()))
+		require.NoError(t, e.Close())
+
+		assert.Equal(t, total, last)
+	})
+}
+
 func TestExtractorFromReader(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foo.go": {mode: 0666},
@@ -227,122 +358,3597 @@ func TestExtractorDetectSymlinkTraversal(t *testing.T) {
 	require.Error(t, e.Extract(context.Background()))
 }
 
-func aopts(options ...ArchiverOption) []ArchiverOption {
-	return options
+func TestExtractorDetectPathTraversal(t *testing.T) {
+	for _, name := range []string{
+		"../escape",
+		"../chroot-sibling/escape",
+		`..\escape`,
+		`foo\..\..\escape`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			chroot := filepath.Join(dir, "chroot")
+			archivePath := testCreateZip(t, testZipEntry{name: name, mode: 0666, contents: "escape"})
+
+			e, err := NewExtractor(archivePath, chroot)
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.Error(t, e.Extract(context.Background()))
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+
+	root := filepath.VolumeName(os.TempDir()) + string(filepath.Separator)
+	e := &Extractor{chroot: root, root: root}
+	assert.True(t, e.withinChroot(root))
+	assert.True(t, e.withinChroot(filepath.Join(root, "foo")))
+	assert.True(t, e.withinChroot(filepath.Join(root, "..foo")))
+
+	e.chroot = filepath.Join(root, "chroot")
+	e.root = e.chroot
+	assert.True(t, e.withinChroot(filepath.Join(root, "chroot", "foo")))
+	assert.False(t, e.withinChroot(filepath.Join(root, "chroot-sibling")))
+	assert.False(t, e.withinChroot(filepath.Join(root, "chroot-sibling", "foo")))
+	assert.False(t, e.withinChroot(root))
 }
 
-func benchmarkExtractOptions(b *testing.B, stdDeflate bool, ao []ArchiverOption, eo ...ExtractorOption) {
-	files := make(map[string]os.FileInfo)
-	filepath.Walk(*archiveDir, func(filename string, fi os.FileInfo, err error) error {
-		files[filename] = fi
-		return nil
-	})
+func TestExtractorSymlinkPolicy(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/bar", mode: 0666},
+		testZipEntry{name: "foo/inside", mode: os.ModeSymlink | 0777, contents: "bar"},
+		testZipEntry{name: "foo/relative", mode: os.ModeSymlink | 0777, contents: "../../etc/passwd"},
+		testZipEntry{name: "foo/absolute", mode: os.ModeSymlink | 0777, contents: "/etc/passwd"},
+	)
+
+	tests := map[string]struct {
+		policy  SymlinkPolicy
+		err     bool
+		targets map[string]string
+	}{
+		"error": {
+			policy: SymlinkError,
+			err:    true,
+		},
+		"skip": {
+			policy: SymlinkSkip,
+			targets: map[string]string{
+				"foo/inside": "bar",
+			},
+		},
+		"clamp": {
+			policy: SymlinkClamp,
+			targets: map[string]string{
+				"foo/inside":   "bar",
+				"foo/relative": filepath.Join("..", "etc", "passwd"),
+				"foo/absolute": filepath.Join("..", "etc", "passwd"),
+			},
+		},
+	}
 
-	dir := b.TempDir()
-	archiveName := filepath.Join(dir, "fastzip-benchmark-extract.zip")
-	f, err := os.Create(archiveName)
-	require.NoError(b, err)
-	defer os.Remove(f.Name())
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			dir := t.TempDir()
 
-	ao = append(ao, WithStageDirectory(dir))
-	a, err := NewArchiver(f, *archiveDir, ao...)
-	require.NoError(b, err)
+			e, err := NewExtractor(archivePath, dir, WithExtractorSymlinkPolicy(tc.policy))
+			require.NoError(t, err)
+			defer e.Close()
 
-	err = a.Archive(context.Background(), files)
-	require.NoError(b, err)
-	require.NoError(b, a.Close())
-	require.NoError(b, f.Close())
-	b.ReportAllocs()
-	b.ResetTimer()
+			err = e.Extract(context.Background())
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			for _, name := range []string{"foo/inside", "foo/relative", "foo/absolute"} {
+				target, err := os.Readlink(filepath.Join(dir, name))
+				if expected, ok := tc.targets[name]; ok {
+					require.NoError(t, err)
+					assert.Equal(t, expected, target)
+				} else {
+					assert.True(t, os.IsNotExist(err), "symlink %v should not exist", name)
+				}
+			}
+		})
+	}
+}
 
-	fi, _ := os.Stat(archiveName)
-	b.SetBytes(fi.Size())
-	for n := 0; n < b.N; n++ {
-		e, err := NewExtractor(archiveName, dir, eo...)
-		if stdDeflate {
-			e.RegisterDecompressor(zip.Deflate, StdFlateDecompressor())
+func TestExtractorSymlinkWithinSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows (symlinks require elevated privileges)")
+	}
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "d", mode: os.ModeSymlink | 0777, contents: "."},
+		testZipEntry{name: "d/link", mode: os.ModeSymlink | 0777, contents: "../escape"},
+	)
+
+	for _, policy := range []SymlinkPolicy{SymlinkError, SymlinkClamp} {
+		dir := t.TempDir()
+		e, err := NewExtractor(archivePath, dir, WithExtractorSymlinkPolicy(policy), WithExtractorTypeConflictPolicy(TypeConflictIgnore))
+		require.NoError(t, err)
+		defer e.Close()
+
+		// d/link is created within the chroot on paper, but as d links to the
+		// chroot, it would be created as link, linking outside of the chroot
+		assert.ErrorIs(t, e.Extract(context.Background()), ErrSymlinkParent)
+		_, err = os.Lstat(filepath.Join(dir, "link"))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorSymlinkPolicy(SymlinkSkip), WithExtractorTypeConflictPolicy(TypeConflictIgnore))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+	assert.Equal(t, int64(1), e.Stats().Skipped)
+	_, err = os.Lstat(filepath.Join(dir, "link"))
+	assert.True(t, os.IsNotExist(err))
+
+	// the symlink is also rejected when it was created by an earlier
+	// extraction
+	first := testCreateZip(t, testZipEntry{name: "d", mode: os.ModeSymlink | 0777, contents: "."})
+	second := testCreateZip(t, testZipEntry{name: "d/link", mode: os.ModeSymlink | 0777, contents: "../escape"})
+
+	dir = t.TempDir()
+	for i, archivePath := range []string{first, second} {
+		e, err := NewExtractor(archivePath, dir)
+		require.NoError(t, err)
+		defer e.Close()
+
+		err = e.Extract(context.Background())
+		if i == 0 {
+			require.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, ErrSymlinkParent)
 		}
-		require.NoError(b, err)
-		require.NoError(b, e.Extract(context.Background()))
 	}
+	_, err = os.Lstat(filepath.Join(dir, "link"))
+	assert.True(t, os.IsNotExist(err))
 }
 
-func BenchmarkExtractStore_1(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(1))
-}
+func TestExtractorExtractFilter(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo.txt", mode: 0666, contents: "foo"},
+		testZipEntry{name: "foo.bin", mode: 0666, contents: "foo"},
+		testZipEntry{name: "bar/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "bar/bar.txt", mode: 0666, contents: "bar"},
+		testZipEntry{name: "bar/bar.bin", mode: 0666, contents: "bar"},
+		testZipEntry{name: "baz/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "baz/baz.bin", mode: 0666, contents: "baz"},
+		testZipEntry{name: "qux/qux.bin", mode: 0666, contents: "qux"},
+	)
 
-func BenchmarkExtractStore_2(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(2))
-}
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir)
+	require.NoError(t, err)
+	defer e.Close()
 
-func BenchmarkExtractStore_4(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(4))
-}
+	require.NoError(t, e.ExtractFilter(context.Background(), func(f *zip.File) bool {
+		return strings.HasSuffix(f.Name, ".txt")
+	}))
 
-func BenchmarkExtractStore_8(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(8))
-}
+	var extracted []string
+	err = filepath.Walk(dir, func(pathname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, pathname)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
 
-func BenchmarkExtractStore_16(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(16))
-}
+		extracted = append(extracted, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			assert.Equal(t, fixedModTime.Unix(), fi.ModTime().Unix(), "directory %v mod time not equal", rel)
+		}
+		return nil
+	})
+	require.NoError(t, err)
 
-func BenchmarkExtractStandardFlate_1(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(1))
+	assert.Equal(t, []string{"bar", "bar/bar.txt", "foo.txt"}, extracted)
 }
 
-func BenchmarkExtractStandardFlate_2(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(2))
-}
+func TestExtractorWithLimits(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "foo/baz", mode: 0666, contents: "baz"},
+	)
 
-func BenchmarkExtractStandardFlate_4(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(4))
-}
+	tests := map[string]struct {
+		opts []ExtractorOption
+		err  bool
+	}{
+		"no limits":            {},
+		"max files":            {opts: []ExtractorOption{WithExtractorMaxFiles(3)}},
+		"max files exceeded":   {opts: []ExtractorOption{WithExtractorMaxFiles(2)}, err: true},
+		"max bytes":            {opts: []ExtractorOption{WithExtractorMaxTotalBytes(6)}},
+		"max bytes exceeded":   {opts: []ExtractorOption{WithExtractorMaxTotalBytes(5)}, err: true},
+		"both limits":          {opts: []ExtractorOption{WithExtractorMaxFiles(3), WithExtractorMaxTotalBytes(6)}},
+		"both limits exceeded": {opts: []ExtractorOption{WithExtractorMaxFiles(3), WithExtractorMaxTotalBytes(1)}, err: true},
+	}
 
-func BenchmarkExtractStandardFlate_8(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(8))
-}
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			dir := t.TempDir()
 
-func BenchmarkExtractStandardFlate_16(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(16))
-}
+			e, err := NewExtractor(archivePath, dir, tc.opts...)
+			require.NoError(t, err)
+			defer e.Close()
 
-func BenchmarkExtractNonStandardFlate_1(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(1))
-}
+			err = e.Extract(context.Background())
+			if !tc.err {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrExtractionLimitExceeded)
 
-func BenchmarkExtractNonStandardFlate_2(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(2))
+			// nothing should have been extracted
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
 }
 
-func BenchmarkExtractNonStandardFlate_4(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(4))
-}
+func TestExtractorWithLimitsUndeclaredSize(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
 
-func BenchmarkExtractNonStandardFlate_8(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(8))
-}
+	// create an entry whose data is larger than its declared size
+	contents := "foobarbaz"
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "foo",
+		Method:             zip.Store,
+		CompressedSize64:   uint64(len(contents)),
+		UncompressedSize64: 3,
+	})
+	require.NoError(t, err)
+	_, err = io.WriteString(w, contents)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
 
-func BenchmarkExtractNonStandardFlate_16(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(16))
-}
+	dir := t.TempDir()
+	e, err := NewExtractor(f.Name(), dir, WithExtractorMaxTotalBytes(1024))
+	require.NoError(t, err)
+	defer e.Close()
 
-func BenchmarkExtractZstd_1(b *testing.B) {
-	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(1))
+	require.ErrorIs(t, e.Extract(context.Background()), ErrExtractionLimitExceeded)
+
+	_, err = os.Stat(filepath.Join(dir, "foo"))
+	assert.True(t, os.IsNotExist(err), "partially extracted file should be removed")
 }
 
-func BenchmarkExtractZstd_2(b *testing.B) {
-	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(2))
+func TestExtractorWithOverwrite(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "new"},
+		testZipEntry{name: "bar", mode: 0666, contents: "new"},
+		testZipEntry{name: "link", mode: os.ModeSymlink | 0777, contents: "bar"},
+	)
+
+	tests := map[string]struct {
+		policy   OverwritePolicy
+		err      bool
+		contents string
+		target   string
+		skipped  int64
+	}{
+		"replace": {policy: OverwriteReplace, contents: "new", target: "bar"},
+		"skip":    {policy: OverwriteSkip, contents: "old", target: "foo", skipped: 2},
+		"error":   {policy: OverwriteError, err: true},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "foo"), []byte("old"), 0666))
+			require.NoError(t, os.Symlink("foo", filepath.Join(dir, "link")))
+
+			e, err := NewExtractor(archivePath, dir, WithExtractorOverwrite(tc.policy))
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			if tc.err {
+				require.ErrorIs(t, err, os.ErrExist)
+				return
+			}
+			require.NoError(t, err)
+
+			contents, err := os.ReadFile(filepath.Join(dir, "foo"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.contents, string(contents))
+
+			contents, err = os.ReadFile(filepath.Join(dir, "bar"))
+			require.NoError(t, err)
+			assert.Equal(t, "new", string(contents))
+
+			target, err := os.Readlink(filepath.Join(dir, "link"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.target, target)
+
+			assert.Equal(t, tc.skipped, e.Skipped())
+		})
+	}
 }
 
-func BenchmarkExtractZstd_4(b *testing.B) {
-	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(4))
+func TestExtractorWithVerifyChecksum(t *testing.T) {
+	contents := "foobar"
+	checksum := crc32.ChecksumIEEE([]byte(contents))
+
+	tests := map[string]struct {
+		crc uint32
+		err bool
+	}{
+		"valid checksum":   {crc: checksum},
+		"invalid checksum": {crc: 0xdeadbeef, err: true},
+		"zero checksum":    {crc: 0, err: true},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+			require.NoError(t, err)
+			defer f.Close()
+
+			zw := zip.NewWriter(f)
+			w, err := zw.CreateRaw(&zip.FileHeader{
+				Name:               "foo",
+				Method:             zip.Store,
+				CRC32:              tc.crc,
+				CompressedSize64:   uint64(len(contents)),
+				UncompressedSize64: uint64(len(contents)),
+			})
+			require.NoError(t, err)
+			_, err = io.WriteString(w, contents)
+			require.NoError(t, err)
+			require.NoError(t, zw.Close())
+
+			dir := t.TempDir()
+			e, err := NewExtractor(f.Name(), dir, WithExtractorVerifyChecksum(true))
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			if !tc.err {
+				require.NoError(t, err)
+				return
+			}
+
+			require.ErrorIs(t, err, zip.ErrChecksum)
+			assert.Contains(t, err.Error(), fmt.Sprintf("foo checksum mismatch, expected %08x, got %08x", tc.crc, checksum))
+
+			_, err = os.Stat(filepath.Join(dir, "foo"))
+			assert.True(t, os.IsNotExist(err), "file with invalid checksum should be removed")
+		})
+	}
 }
 
-func BenchmarkExtractZstd_8(b *testing.B) {
-	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(8))
+func TestExtractorStats(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "foo/baz", mode: 0666, contents: "bazbaz"},
+		testZipEntry{name: "foo/inside", mode: os.ModeSymlink | 0777, contents: "bar"},
+		testZipEntry{name: "foo/outside", mode: os.ModeSymlink | 0777, contents: "../../bar"},
+	)
+
+	e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorSymlinkPolicy(SymlinkSkip))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	assert.Equal(t, ExtractorStats{
+		Files:        2,
+		Directories:  1,
+		Symlinks:     1,
+		BytesWritten: 9,
+		Skipped:      1,
+	}, e.Stats())
 }
 
-func BenchmarkExtractZstd_16(b *testing.B) {
-	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(16))
+func TestExtractorWithPassword(t *testing.T) {
+	expected := map[string]string{
+		"aes128.txt":         "hello from aes-128, hello from aes-128, hello from aes-128",
+		"aes256.txt":         "hello from aes-256",
+		"aes256_deflate.txt": "hello from aes-256, hello from aes-256, hello from aes-256",
+		"plain.txt":          "hello in plaintext",
+	}
+
+	t.Run("correct password", func(t *testing.T) {
+		dir := t.TempDir()
+		e, err := NewExtractor(filepath.Join("testdata", "aes.zip"), dir, WithExtractorPassword("password"), WithExtractorVerifyChecksum(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		for name, contents := range expected {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			require.NoError(t, err)
+			assert.Equal(t, contents, string(data))
+		}
+	})
+
+	t.Run("incorrect password", func(t *testing.T) {
+		e, err := NewExtractor(filepath.Join("testdata", "aes.zip"), t.TempDir(), WithExtractorPassword("incorrect"))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.ErrorIs(t, e.Extract(context.Background()), ErrIncorrectPassword)
+	})
+
+	t.Run("no password", func(t *testing.T) {
+		e, err := NewExtractor(filepath.Join("testdata", "aes.zip"), t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.ErrorIs(t, e.Extract(context.Background()), ErrPasswordRequired)
+	})
+
+	t.Run("tampered data", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "aes.zip"))
+		require.NoError(t, err)
+
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+
+		for _, f := range zr.File {
+			if f.Name != "aes256.txt" {
+				continue
+			}
+
+			// flip a bit of the encrypted data, after the salt and password
+			// verification value
+			offset, err := f.DataOffset()
+			require.NoError(t, err)
+			data[offset+16+2] ^= 1
+		}
+
+		e, err := NewExtractorFromReader(bytes.NewReader(data), int64(len(data)), t.TempDir(), WithExtractorPassword("password"))
+		require.NoError(t, err)
+
+		require.ErrorIs(t, e.Extract(context.Background()), ErrAuthenticationFailed)
+	})
+}
+
+func TestExtractorWithPasswordZipCrypto(t *testing.T) {
+	expected := map[string]string{
+		"stored.txt":   "hello from zipcrypto",
+		"deflated.txt": strings.Repeat("hello from zipcrypto, ", 20),
+	}
+
+	t.Run("correct password", func(t *testing.T) {
+		dir := t.TempDir()
+		e, err := NewExtractor(filepath.Join("testdata", "zipcrypto.zip"), dir, WithExtractorPassword("password"), WithExtractorVerifyChecksum(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		for name, contents := range expected {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			require.NoError(t, err)
+			assert.Equal(t, contents, string(data))
+		}
+	})
+
+	t.Run("incorrect password", func(t *testing.T) {
+		e, err := NewExtractor(filepath.Join("testdata", "zipcrypto.zip"), t.TempDir(), WithExtractorPassword("incorrect"))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.ErrorIs(t, e.Extract(context.Background()), ErrIncorrectPassword)
+	})
+
+	t.Run("no password", func(t *testing.T) {
+		e, err := NewExtractor(filepath.Join("testdata", "zipcrypto.zip"), t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.ErrorIs(t, e.Extract(context.Background()), ErrPasswordRequired)
+	})
+}
+
+func TestExtractorWithRestoreXattrs(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "netbsd":
+	default:
+		t.Skip("extended attributes are not supported on", runtime.GOOS)
+	}
+
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+		"bar.go": {mode: 0666, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	attr := xattr{name: "user.fastzip", value: []byte("foobar")}
+	if err := setXattr(filepath.Join(dir, "foo.go"), attr); err != nil {
+		t.Skip("extended attributes are not supported by the filesystem:", err)
+	}
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		tests := map[string]struct {
+			restore bool
+		}{
+			"restore":    {restore: true},
+			"no restore": {restore: false},
+		}
+
+		for tn, tc := range tests {
+			t.Run(tn, func(t *testing.T) {
+				extractDir := t.TempDir()
+				e, err := NewExtractor(filename, extractDir, WithExtractorRestoreXattrs(tc.restore), WithExtractorXattrErrorHandler(func(name string, err error) error {
+					return err
+				}))
+				require.NoError(t, err)
+				defer e.Close()
+
+				require.NoError(t, e.Extract(context.Background()))
+
+				// other attributes might be added by the OS, so only check for
+				// the presence of the one set
+				attrs, err := listXattrs(filepath.Join(extractDir, "foo.go"))
+				require.NoError(t, err)
+				if tc.restore {
+					assert.Contains(t, attrs, attr)
+				} else {
+					assert.NotContains(t, attrs, attr)
+				}
+
+				attrs, err = listXattrs(filepath.Join(extractDir, "bar.go"))
+				require.NoError(t, err)
+				assert.NotContains(t, attrs, attr)
+			})
+		}
+	}, WithArchiverStoreXattrs(true))
+}
+
+func testPKWAREUnixField(link string) []byte {
+	buf := zipextra.NewBuffer([]byte{})
+	defer buf.WriteHeader(extraFieldPKWAREUnix)()
+
+	buf.Write32(uint32(fixedModTime.Unix()))
+	buf.Write32(uint32(fixedModTime.Unix()))
+	buf.Write16(0)
+	buf.Write16(0)
+	buf.WriteBytes([]byte(link))
+
+	return buf.Bytes()
+}
+
+func TestExtractorWithPreserveHardlinks(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+		testZipEntry{name: "bar", mode: 0666, extra: testPKWAREUnixField("foo")},
+		testZipEntry{name: "baz", mode: 0666, extra: testPKWAREUnixField("qux")},
+		testZipEntry{name: "qux", mode: 0666, contents: "qux"},
+	)
+
+	for _, preserve := range []bool{true, false} {
+		t.Run(fmt.Sprintf("preserve %v", preserve), func(t *testing.T) {
+			dir := t.TempDir()
+			e, err := NewExtractor(archivePath, dir, WithExtractorPreserveHardlinks(preserve))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			for link, target := range map[string]string{"bar": "foo", "baz": "qux"} {
+				lfi, err := os.Stat(filepath.Join(dir, link))
+				require.NoError(t, err)
+				tfi, err := os.Stat(filepath.Join(dir, target))
+				require.NoError(t, err)
+
+				assert.Equal(t, preserve, os.SameFile(lfi, tfi), "%v linked to %v", link, target)
+				if !preserve {
+					assert.Zero(t, lfi.Size())
+				}
+			}
+		})
+	}
+
+	t.Run("outside of chroot", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "foo", mode: 0666, extra: testPKWAREUnixField("../foo")},
+		)
+
+		e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorPreserveHardlinks(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.Error(t, e.Extract(context.Background()))
+	})
+}
+
+type memFS struct {
+	m     sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	data    bytes.Buffer
+}
+
+func (f *memFile) Write(p []byte) (int, error) { return f.data.Write(p) }
+func (f *memFile) Close() error                { return nil }
+func (f *memFile) Name() string                { return filepath.Base(f.name) }
+func (f *memFile) Size() int64                 { return int64(f.data.Len()) }
+func (f *memFile) Mode() os.FileMode           { return f.mode }
+func (f *memFile) ModTime() time.Time          { return f.modTime }
+func (f *memFile) IsDir() bool                 { return f.mode.IsDir() }
+func (f *memFile) Sys() interface{}            { return nil }
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string]*memFile)}
+}
+
+func (fs *memFS) lookup(op, name string) (*memFile, error) {
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return f, nil
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	f := &memFile{name: name, mode: perm}
+	fs.files[name] = f
+	return f, nil
+}
+
+func (fs *memFS) Mkdir(name string, perm os.FileMode) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	if _, ok := fs.files[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	fs.files[name] = &memFile{name: name, mode: os.ModeDir | perm}
+	return nil
+}
+
+func (fs *memFS) MkdirAll(name string, perm os.FileMode) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	for ; name != filepath.Dir(name); name = filepath.Dir(name) {
+		if _, ok := fs.files[name]; !ok {
+			fs.files[name] = &memFile{name: name, mode: os.ModeDir | perm}
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	if _, err := fs.lookup("remove", name); err != nil {
+		return err
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *memFS) Lstat(name string) (os.FileInfo, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	return fs.lookup("lstat", name)
+}
+
+func (fs *memFS) Symlink(oldname, newname string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	f := &memFile{name: newname, mode: os.ModeSymlink | 0777}
+	f.data.WriteString(oldname)
+	fs.files[newname] = f
+	return nil
+}
+
+func (fs *memFS) Link(oldname, newname string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	f, err := fs.lookup("link", oldname)
+	if err != nil {
+		return err
+	}
+	fs.files[newname] = f
+	return nil
+}
+
+func (fs *memFS) Lchmod(name string, mode os.FileMode) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	f, err := fs.lookup("lchmod", name)
+	if err != nil {
+		return err
+	}
+	f.mode = f.mode.Type() | mode.Perm()
+	return nil
+}
+
+func (fs *memFS) Lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	f, err := fs.lookup("lchtimes", name)
+	if err != nil {
+		return err
+	}
+	f.modTime = mtime
+	return nil
+}
+
+func (fs *memFS) Lchown(name string, uid, gid int) error {
+	return nil
+}
+
+func (fs *memFS) Lsetxattr(name, attr string, value []byte) error {
+	return nil
+}
+
+func TestExtractorWithFilesystem(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0640, contents: "bar"},
+		testZipEntry{name: "foo/baz", mode: os.ModeSymlink | 0777, contents: "bar"},
+	)
+
+	chroot := filepath.Join(t.TempDir(), "virtual")
+	fs := newMemFS()
+
+	e, err := NewExtractor(archivePath, chroot, WithExtractorFilesystem(fs))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	_, err = os.Lstat(chroot)
+	assert.True(t, os.IsNotExist(err), "nothing should be written to disk")
+
+	for name, want := range map[string]struct {
+		mode     os.FileMode
+		contents string
+	}{
+		"foo":     {os.ModeDir | 0777, ""},
+		"foo/bar": {0640, "bar"},
+		"foo/baz": {os.ModeSymlink | 0777, "bar"},
+	} {
+		fi, err := fs.Lstat(filepath.Join(chroot, filepath.FromSlash(name)))
+		require.NoError(t, err, name)
+
+		f := fi.(*memFile)
+		assert.Equal(t, want.mode, f.mode, name)
+		assert.Equal(t, want.contents, f.data.String(), name)
+		assert.True(t, fixedModTime.Equal(f.modTime), name)
+	}
+
+	t.Run("outside of chroot", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "../escape", mode: 0666, contents: "escape"},
+		)
+
+		fs := newMemFS()
+		e, err := NewExtractor(archivePath, chroot, WithExtractorFilesystem(fs))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.Error(t, e.Extract(context.Background()))
+		assert.Empty(t, fs.files)
+	})
+}
+
+func TestExtractorWithDirMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows (directory permissions are not supported)")
+	}
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "explicit/", mode: os.ModeDir | 0711},
+		testZipEntry{name: "explicit/implicit/foo", mode: 0666, contents: "foo"},
+	)
+
+	for _, mode := range []os.FileMode{0700, 0750} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			e, err := NewExtractor(archivePath, dir, WithExtractorDirMode(mode))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			fi, err := os.Lstat(filepath.Join(dir, "explicit", "implicit"))
+			require.NoError(t, err)
+			assert.Equal(t, os.ModeDir|mode, fi.Mode())
+
+			fi, err = os.Lstat(filepath.Join(dir, "explicit"))
+			require.NoError(t, err)
+			assert.Equal(t, os.ModeDir|0711, fi.Mode())
+		})
+	}
+}
+
+func TestExtractorExtractEntry(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "foo/baz", mode: os.ModeSymlink | 0777, contents: "bar"},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir)
+	require.NoError(t, err)
+	defer e.Close()
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, e.ExtractEntry("foo/bar", buf))
+	assert.Equal(t, "bar", buf.String())
+
+	rc, err := e.Open("foo/bar")
+	require.NoError(t, err)
+	contents, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, "bar", string(contents))
+
+	assert.ErrorIs(t, e.ExtractEntry("missing", io.Discard), os.ErrNotExist)
+	assert.ErrorIs(t, e.ExtractEntry("foo/", io.Discard), ErrNotRegularFile)
+	assert.ErrorIs(t, e.ExtractEntry("foo/baz", io.Discard), ErrNotRegularFile)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestExtractorWithRestorePreciseTimes(t *testing.T) {
+	mtime := fixedModTime.Add(123456700 * time.Nanosecond)
+	atime := fixedModTime.Add(-time.Hour + 700*time.Nanosecond)
+	extra := zipextra.NewNTFS(zipextra.NTFSTimeAttribute{MTime: mtime, ATime: atime, CTime: atime}).Encode()
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo", extra: extra},
+	)
+
+	for _, restore := range []bool{true, false} {
+		t.Run(fmt.Sprintf("restore %v", restore), func(t *testing.T) {
+			dir := t.TempDir()
+			e, err := NewExtractor(archivePath, dir, WithExtractorRestorePreciseTimes(restore))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			fi, err := os.Stat(filepath.Join(dir, "foo"))
+			require.NoError(t, err)
+
+			if restore {
+				assert.True(t, mtime.Equal(fi.ModTime()), "expected %v, got %v", mtime, fi.ModTime())
+			} else {
+				assert.True(t, fixedModTime.Equal(fi.ModTime()), "expected %v, got %v", fixedModTime, fi.ModTime())
+			}
+		})
+	}
+}
+
+func TestExtractorWithRestoreFileFlags(t *testing.T) {
+	const nodump = 0x00000040 // FS_NODUMP_FL
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo", extra: encodeFileFlags(nodump)},
+	)
+
+	dir := t.TempDir()
+	probe := filepath.Join(dir, "probe")
+	require.NoError(t, os.WriteFile(probe, nil, 0666))
+	if err := setFileFlags(probe, nodump); err != nil {
+		t.Skipf("setting file flags unsupported: %v", err)
+	}
+	if flags, err := getFileFlags(probe); err != nil || flags&nodump == 0 {
+		t.Skip("file flags unsupported")
+	}
+
+	for _, restore := range []bool{true, false} {
+		t.Run(fmt.Sprintf("restore %v", restore), func(t *testing.T) {
+			dir := filepath.Join(dir, fmt.Sprintf("restore-%v", restore))
+
+			e, err := NewExtractor(archivePath, dir, WithExtractorRestoreFileFlags(restore))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			flags, err := getFileFlags(filepath.Join(dir, "foo"))
+			require.NoError(t, err)
+			assert.Equal(t, restore, flags&nodump != 0)
+		})
+	}
+}
+
+func TestExtractorWithContinueOnError(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "a", mode: 0666, contents: "a"},
+		testZipEntry{name: "b", mode: 0666, contents: "b"},
+		testZipEntry{name: "c", mode: 0666, contents: "c"},
+	)
+
+	for _, continueOnError := range []bool{true, false} {
+		t.Run(fmt.Sprintf("continue %v", continueOnError), func(t *testing.T) {
+			dir := t.TempDir()
+
+			// a non-empty directory can't be replaced by a file
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "b", "blocked"), 0777))
+
+			e, err := NewExtractor(archivePath, dir, WithExtractorContinueOnError(continueOnError), WithExtractorConcurrency(1))
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			require.Error(t, err)
+
+			var errs ExtractErrors
+			if !continueOnError {
+				assert.False(t, errors.As(err, &errs))
+				return
+			}
+
+			require.True(t, errors.As(err, &errs))
+			require.Len(t, errs, 1)
+			assert.Equal(t, "b", errs[0].Name)
+
+			for _, name := range []string{"a", "c"} {
+				data, err := os.ReadFile(filepath.Join(dir, name))
+				require.NoError(t, err)
+				assert.Equal(t, name, string(data))
+			}
+		})
+	}
+
+	t.Run("chroot escape", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "a", mode: 0666, contents: "a"},
+			testZipEntry{name: "../escape", mode: 0666, contents: "escape"},
+		)
+
+		e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorContinueOnError(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		err = e.Extract(context.Background())
+		require.Error(t, err)
+
+		var errs ExtractErrors
+		assert.False(t, errors.As(err, &errs))
+	})
+}
+
+func TestExtractorWithPreserveOwnership(t *testing.T) {
+	extra := zipextra.NewInfoZIPNewUnix(big.NewInt(1000), big.NewInt(1000)).Encode()
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777, extra: extra},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar", extra: extra},
+	)
+
+	for _, preserve := range []bool{true, false} {
+		t.Run(fmt.Sprintf("preserve %v", preserve), func(t *testing.T) {
+			var chowns []string
+			e, err := NewExtractor(archivePath, t.TempDir(),
+				WithExtractorFilesystem(chownFailFS{newMemFS()}),
+				WithExtractorPreserveOwnership(preserve),
+				WithExtractorChownErrorHandler(func(name string, err error) error {
+					chowns = append(chowns, name)
+					return nil
+				}),
+			)
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			if preserve {
+				assert.ElementsMatch(t, []string{"foo/", "foo/bar"}, chowns)
+			} else {
+				assert.Empty(t, chowns)
+			}
+		})
+	}
+}
+
+// chownFailFS is a filesystem that fails to change ownership.
+type chownFailFS struct {
+	*memFS
+}
+
+func (chownFailFS) Lchown(name string, uid, gid int) error {
+	return &os.PathError{Op: "lchown", Path: name, Err: os.ErrPermission}
+}
+
+func TestExtractorEmptyDirectories(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows (directory permissions are not supported)")
+	}
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "empty/", mode: os.ModeDir | 0750},
+		testZipEntry{name: "parent/", mode: os.ModeDir | 0755},
+		testZipEntry{name: "parent/child/", mode: os.ModeDir | 0700},
+		testZipEntry{name: "parent/link", mode: os.ModeSymlink | 0777, contents: "child"},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir)
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	for name, mode := range map[string]os.FileMode{
+		"empty":        os.ModeDir | 0750,
+		"parent":       os.ModeDir | 0755,
+		"parent/child": os.ModeDir | 0700,
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.Equal(t, mode, fi.Mode(), name)
+
+		// creating the symlink within parent must not change its
+		// modification time
+		assert.True(t, fixedModTime.Equal(fi.ModTime()), "%s: expected %v, got %v", name, fixedModTime, fi.ModTime())
+	}
+}
+
+func TestExtractorCounts(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "foo/baz", mode: 0666, contents: "bazbaz"},
+		testZipEntry{name: "foo/link", mode: os.ModeSymlink | 0777, contents: "bar"},
+		testZipEntry{name: "foo/pipe", mode: os.ModeNamedPipe | 0666},
+	)
+
+	e, err := NewExtractor(archivePath, t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.Equal(t, EntryCounts{Files: 2, Directories: 1, Symlinks: 1}, e.Counts())
+	assert.EqualValues(t, 4, e.FileCount())
+	assert.EqualValues(t, 9, e.TotalUncompressedSize())
+}
+
+func TestExtractorWithAtomic(t *testing.T) {
+	parent := t.TempDir()
+	chroot := filepath.Join(parent, "chroot")
+	require.NoError(t, os.Mkdir(chroot, 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(chroot, "old"), []byte("old"), 0666))
+
+	t.Run("failure", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+			testZipEntry{name: "../escape", mode: 0666, contents: "escape"},
+		)
+
+		e, err := NewExtractor(archivePath, chroot, WithExtractorAtomic(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.Error(t, e.Extract(context.Background()))
+
+		entries, err := os.ReadDir(parent)
+		require.NoError(t, err)
+		require.Len(t, entries, 1, "temporary directory should be removed")
+
+		data, err := os.ReadFile(filepath.Join(chroot, "old"))
+		require.NoError(t, err)
+		assert.Equal(t, "old", string(data))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+			testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		)
+
+		e, err := NewExtractor(archivePath, chroot, WithExtractorAtomic(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		entries, err := os.ReadDir(parent)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		_, err = os.Lstat(filepath.Join(chroot, "old"))
+		assert.True(t, os.IsNotExist(err), "existing files should be replaced")
+
+		data, err := os.ReadFile(filepath.Join(chroot, "foo", "bar"))
+		require.NoError(t, err)
+		assert.Equal(t, "bar", string(data))
+	})
+
+	t.Run("filesystem", func(t *testing.T) {
+		archivePath := testCreateZip(t)
+
+		_, err := NewExtractor(archivePath, chroot, WithExtractorAtomic(true), WithExtractorFilesystem(newMemFS()))
+		assert.ErrorIs(t, err, ErrAtomicFilesystem)
+	})
+
+	t.Run("temp dir", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+		)
+
+		tempDir := t.TempDir()
+		e, err := NewExtractor(archivePath, chroot, WithExtractorAtomic(true), WithExtractorTempDir(tempDir))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		entries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 0)
+
+		entries, err = os.ReadDir(parent)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+
+		data, err := os.ReadFile(filepath.Join(chroot, "foo"))
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(data))
+
+		_, err = NewExtractor(archivePath, chroot, WithExtractorAtomic(true), WithExtractorTempDir(filepath.Join(tempDir, "missing")))
+		assert.Error(t, err)
+	})
+
+	t.Run("temp dir on other filesystem", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+			testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		)
+
+		tempDir := testOtherFilesystemDir(t, parent)
+		e, err := NewExtractor(archivePath, chroot, WithExtractorAtomic(true), WithExtractorTempDir(tempDir))
+		require.NoError(t, err)
+		defer e.Close()
+
+		var staged []os.DirEntry
+		require.NoError(t, e.ExtractFilter(context.Background(), func(*zip.File) bool {
+			staged, _ = os.ReadDir(tempDir)
+			return true
+		}))
+		assert.Len(t, staged, 1, "the configured temporary directory should be used")
+
+		entries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 0, "temporary directory should be removed")
+
+		entries, err = os.ReadDir(parent)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+
+		data, err := os.ReadFile(filepath.Join(chroot, "foo", "bar"))
+		require.NoError(t, err)
+		assert.Equal(t, "bar", string(data))
+	})
+}
+
+func TestExtractorWithAtomicChroot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks not supported on windows")
+	}
+
+	parent := t.TempDir()
+	chroot := filepath.Join(parent, "chroot")
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+		testZipEntry{name: "abs", mode: os.ModeSymlink | 0777, contents: filepath.Join(chroot, "foo")},
+	)
+
+	var paths []string
+	logger := func(event LogEvent, name string, fields map[string]interface{}) {
+		if path, ok := fields["path"].(string); ok {
+			paths = append(paths, path)
+		}
+	}
+
+	e, err := NewExtractor(archivePath, chroot, WithExtractorAtomic(true), WithExtractorConcurrency(1), WithExtractorLogger(logger))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+	assert.Equal(t, chroot, e.Chroot())
+
+	target, err := os.Readlink(filepath.Join(chroot, "abs"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(chroot, "foo"), target, "absolute targets within the chroot should be kept")
+
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		assert.True(t, strings.HasPrefix(path, chroot+string(filepath.Separator)), "logged path %s should be within the chroot", path)
+	}
+
+	archivePath = testCreateZip(t,
+		testZipEntry{name: "escape", mode: os.ModeSymlink | 0777, contents: filepath.Join(parent, "outside")},
+	)
+
+	e, err = NewExtractor(archivePath, chroot, WithExtractorAtomic(true))
+	require.NoError(t, err)
+	defer e.Close()
+
+	var escapeErr *ChrootEscapeError
+	require.ErrorAs(t, e.Extract(context.Background()), &escapeErr)
+	assert.Equal(t, chroot, escapeErr.Chroot)
+}
+
+// testOtherFilesystemDir returns a directory on a different filesystem to
+// dir, skipping the test if there isn't one.
+func testOtherFilesystemDir(t *testing.T, dir string) string {
+	other, err := os.MkdirTemp("/dev/shm", "fastzip-")
+	if err != nil {
+		t.Skip("no other filesystem available")
+	}
+	t.Cleanup(func() { os.RemoveAll(other) })
+
+	probe := filepath.Join(other, "probe")
+	require.NoError(t, os.Mkdir(probe, 0777))
+	if err := os.Rename(probe, filepath.Join(dir, "probe")); !errors.Is(err, syscall.EXDEV) {
+		os.Remove(filepath.Join(dir, "probe"))
+		t.Skip("no other filesystem available")
+	}
+	require.NoError(t, os.Remove(probe))
+
+	return other
+}
+
+func TestReplaceDirAcrossFilesystems(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks not supported on windows")
+	}
+
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "dst")
+	require.NoError(t, os.Mkdir(dst, 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "old"), []byte("old"), 0666))
+
+	src := filepath.Join(testOtherFilesystemDir(t, parent), "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "dir"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "dir", "file"), []byte("file"), 0640))
+	require.NoError(t, os.Symlink("dir/file", filepath.Join(src, "link")))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "dir", "file"), mtime, mtime))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "dir"), mtime, mtime))
+	require.NoError(t, os.Chmod(filepath.Join(src, "dir"), 0750))
+
+	require.NoError(t, replaceDir(src, dst))
+
+	_, err := os.Lstat(src)
+	assert.True(t, os.IsNotExist(err), "source should be removed")
+	_, err = os.Lstat(filepath.Join(dst, "old"))
+	assert.True(t, os.IsNotExist(err), "existing files should be replaced")
+
+	entries, err := os.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "backup should be removed")
+
+	data, err := os.ReadFile(filepath.Join(dst, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "file", string(data))
+
+	fi, err := os.Stat(filepath.Join(dst, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+	assert.True(t, mtime.Equal(fi.ModTime()))
+
+	fi, err = os.Stat(filepath.Join(dst, "dir"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+	assert.True(t, mtime.Equal(fi.ModTime()))
+
+	target, err := os.Readlink(filepath.Join(dst, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "dir/file", target)
+}
+
+func TestExtractorWithSparse(t *testing.T) {
+	contents := strings.Repeat("\x00", 1<<20) + "data" + strings.Repeat("\x00", 1<<20)
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "sparse", mode: 0666, contents: contents},
+		testZipEntry{name: "zeros", mode: 0666, contents: strings.Repeat("\x00", 10000)},
+		testZipEntry{name: "dense", mode: 0666, contents: "dense"},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorSparse(true))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	for name, want := range map[string]string{
+		"sparse": contents,
+		"zeros":  strings.Repeat("\x00", 10000),
+		"dense":  "dense",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.True(t, want == string(data), "%s contents differ", name)
+	}
+}
+
+func TestExtractorWithRateLimit(t *testing.T) {
+	const rate = 256 * 1024
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: strings.Repeat("a", rate/4)},
+		testZipEntry{name: "bar", mode: 0666, contents: strings.Repeat("b", rate/4)},
+	)
+
+	e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorRateLimit(rate), WithExtractorConcurrency(2))
+	require.NoError(t, err)
+	defer e.Close()
+
+	start := time.Now()
+	require.NoError(t, e.Extract(context.Background()))
+	elapsed := time.Since(start)
+
+	assert.GreaterOrEqual(t, elapsed, 400*time.Millisecond)
+	assert.Less(t, elapsed, 5*time.Second)
+
+	t.Run("cancel", func(t *testing.T) {
+		e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorRateLimit(1))
+		require.NoError(t, err)
+		defer e.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		assert.ErrorIs(t, e.Extract(ctx), context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
+
+func TestExtractorGetters(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorConcurrency(3))
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.Equal(t, dir, e.Chroot())
+	assert.Equal(t, 3, e.Concurrency())
+	assert.Equal(t, fmt.Sprintf("Extractor{chroot: %q, concurrency: 3, files: 1}", dir), e.String())
+}
+
+func TestExtractorLegacyOwnership(t *testing.T) {
+	field := func(id uint16, data ...byte) []byte {
+		return append([]byte{byte(id), byte(id >> 8), byte(len(data)), byte(len(data) >> 8)}, data...)
+	}
+
+	times := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "infozip", mode: 0666, extra: field(0x5855, append(times, 0xe8, 0x03, 0xe9, 0x03)...)},
+		testZipEntry{name: "infozip-central", mode: 0666, extra: field(0x5855, times...)},
+		testZipEntry{name: "pkware", mode: 0666, extra: field(0x000d, append(times, 0xea, 0x03, 0xeb, 0x03)...)},
+	)
+
+	fs := &chownRecordFS{memFS: newMemFS(), owners: make(map[string][2]int)}
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorFilesystem(fs))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	assert.Equal(t, map[string][2]int{
+		filepath.Join(dir, "infozip"): {1000, 1001},
+		filepath.Join(dir, "pkware"):  {1002, 1003},
+	}, fs.owners)
+}
+
+func TestExtractorWithUIDGIDMap(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "root", mode: 0666, extra: zipextra.NewInfoZIPNewUnix(big.NewInt(0), big.NewInt(0)).Encode()},
+		testZipEntry{name: "user", mode: 0666, extra: zipextra.NewInfoZIPNewUnix(big.NewInt(1000), big.NewInt(1000)).Encode()},
+	)
+
+	fs := &chownRecordFS{memFS: newMemFS(), owners: make(map[string][2]int)}
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorFilesystem(fs), WithExtractorUIDGIDMap(func(uid, gid int) (int, int) {
+		if uid == 0 {
+			return 2000, 2001
+		}
+		return uid, gid
+	}))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	assert.Equal(t, map[string][2]int{
+		filepath.Join(dir, "root"): {2000, 2001},
+		filepath.Join(dir, "user"): {1000, 1000},
+	}, fs.owners)
+}
+
+func TestExtractorWithForceOwner(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0755},
+		testZipEntry{name: "dir/root", mode: 0666, extra: zipextra.NewInfoZIPNewUnix(big.NewInt(0), big.NewInt(0)).Encode()},
+		testZipEntry{name: "unowned", mode: 0666},
+	)
+
+	for _, preserve := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preserve ownership %v", preserve), func(t *testing.T) {
+			fs := &chownRecordFS{memFS: newMemFS(), owners: make(map[string][2]int)}
+			dir := t.TempDir()
+			e, err := NewExtractor(archivePath, dir,
+				WithExtractorFilesystem(fs),
+				WithExtractorPreserveOwnership(preserve),
+				WithExtractorForceOwner(2000, 2001),
+				WithExtractorUIDGIDMap(func(uid, gid int) (int, int) {
+					t.Error("uid/gid map should not be called")
+					return uid, gid
+				}),
+			)
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			assert.Equal(t, map[string][2]int{
+				filepath.Join(dir, "dir"):         {2000, 2001},
+				filepath.Join(dir, "dir", "root"): {2000, 2001},
+				filepath.Join(dir, "unowned"):     {2000, 2001},
+			}, fs.owners)
+		})
+	}
+}
+
+// chownRecordFS is a filesystem that records ownership changes.
+type chownRecordFS struct {
+	*memFS
+	m      sync.Mutex
+	owners map[string][2]int
+}
+
+func (fs *chownRecordFS) Lchown(name string, uid, gid int) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	fs.owners[name] = [2]int{uid, gid}
+	return nil
+}
+
+func TestExtractorWithBufferSize(t *testing.T) {
+	contents := strings.Repeat("abcdefgh", 64*1024)
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: contents},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorBufferSize(100))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	data, err := os.ReadFile(filepath.Join(dir, "foo"))
+	require.NoError(t, err)
+	assert.True(t, contents == string(data))
+
+	_, err = NewExtractor(archivePath, dir, WithExtractorBufferSize(0))
+	assert.ErrorIs(t, err, ErrMinBufferSize)
+}
+
+func TestExtractorWithFsync(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "baz/qux", mode: 0666, contents: "qux"},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorFsync(true))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	for name, contents := range map[string]string{"foo/bar": "bar", "baz/qux": "qux"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, contents, string(data))
+	}
+}
+
+func TestExtractorSymlinks(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "foo/inside", mode: os.ModeSymlink | 0777, contents: "bar"},
+		testZipEntry{name: "foo/outside", mode: os.ModeSymlink | 0777, contents: "../../outside"},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir)
+	require.NoError(t, err)
+	defer e.Close()
+
+	symlinks, err := e.Symlinks()
+	require.NoError(t, err)
+	assert.Equal(t, []SymlinkEntry{
+		{Name: "foo/inside", Target: "bar"},
+		{Name: "foo/outside", Target: "../../outside", OutsideChroot: true},
+	}, symlinks)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "nothing should be extracted")
+}
+
+func TestExtractorInvalidConcurrency(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+	)
+
+	for _, n := range []int{0, -1} {
+		_, err := NewExtractor(archivePath, t.TempDir(), WithExtractorConcurrency(n))
+		assert.ErrorIs(t, err, ErrMinConcurrency, "concurrency %d", n)
+	}
+}
+
+func TestExtractorWithPreserveModTime(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+	)
+
+	for _, preserve := range []bool{true, false} {
+		t.Run(fmt.Sprintf("preserve %v", preserve), func(t *testing.T) {
+			dir := t.TempDir()
+			e, err := NewExtractor(archivePath, dir, WithExtractorPreserveModTime(preserve))
+			require.NoError(t, err)
+			defer e.Close()
+
+			start := time.Now()
+			require.NoError(t, e.Extract(context.Background()))
+
+			for _, name := range []string{"foo", "foo/bar"} {
+				fi, err := os.Stat(filepath.Join(dir, name))
+				require.NoError(t, err)
+
+				if preserve {
+					assert.True(t, fixedModTime.Equal(fi.ModTime()), name)
+				} else {
+					assert.WithinDuration(t, start, fi.ModTime(), time.Minute, name)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractorWithErrorHandler(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "a", mode: 0666, contents: "a"},
+		testZipEntry{name: "b", mode: 0666, contents: "b"},
+		testZipEntry{name: "c", mode: 0666, contents: "c"},
+	)
+
+	errAbort := errors.New("abort")
+	for _, abort := range []bool{false, true} {
+		t.Run(fmt.Sprintf("abort %v", abort), func(t *testing.T) {
+			dir := t.TempDir()
+
+			// a non-empty directory can't be replaced by a file
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "b", "blocked"), 0777))
+
+			var failed []string
+			e, err := NewExtractor(archivePath, dir, WithExtractorErrorHandler(func(file *zip.File, err error) error {
+				failed = append(failed, file.Name)
+				if abort {
+					return errAbort
+				}
+				return nil
+			}))
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			assert.Equal(t, []string{"b"}, failed)
+			if abort {
+				assert.ErrorIs(t, err, errAbort)
+				return
+			}
+
+			require.NoError(t, err)
+			for _, name := range []string{"a", "c"} {
+				_, err := os.Stat(filepath.Join(dir, name))
+				assert.NoError(t, err, name)
+			}
+		})
+	}
+}
+
+func TestExtractorWithMaxPathLength(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "short", mode: 0666, contents: "short"},
+		testZipEntry{name: long, mode: 0666, contents: "long"},
+		testZipEntry{name: long + "-dir/", mode: os.ModeDir | 0777},
+		testZipEntry{name: long + "-link", mode: os.ModeSymlink | 0777, contents: "short"},
+	)
+
+	t.Run("error", func(t *testing.T) {
+		dir := t.TempDir()
+		e, err := NewExtractor(archivePath, dir, WithExtractorMaxPathLength(len(dir)+32))
+		require.NoError(t, err)
+		defer e.Close()
+
+		assert.ErrorIs(t, e.Extract(context.Background()), ErrPathTooLong)
+
+		_, err = e.Plan(context.Background())
+		assert.ErrorIs(t, err, ErrPathTooLong)
+
+		// nothing is extracted
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		dir := t.TempDir()
+		var skipped []string
+		e, err := NewExtractor(archivePath, dir, WithExtractorMaxPathLength(len(dir)+32), WithExtractorPathLengthPolicy(PathLengthSkip),
+			WithExtractorLogger(func(event LogEvent, name string, fields map[string]interface{}) {
+				if event == LogEntrySkip && fields["reason"] == skipPathLength {
+					skipped = append(skipped, name)
+				}
+			}))
+		require.NoError(t, err)
+		defer e.Close()
+
+		planned, err := e.Plan(context.Background())
+		require.NoError(t, err)
+		require.Len(t, planned, 4)
+		assert.Equal(t, PlanCreate, planned[0].Action)
+		for _, entry := range planned[1:] {
+			assert.Equal(t, PlanSkip, entry.Action, entry.Name)
+		}
+
+		require.NoError(t, e.Extract(context.Background()))
+		assert.FileExists(t, filepath.Join(dir, "short"))
+		assert.NoFileExists(t, filepath.Join(dir, long))
+		assert.NoDirExists(t, filepath.Join(dir, long+"-dir"))
+		_, err = os.Lstat(filepath.Join(dir, long+"-link"))
+		assert.True(t, os.IsNotExist(err))
+
+		// each long entry is skipped once, including the symlink and the
+		// directory, which are handled after the files
+		assert.Equal(t, int64(3), e.Skipped())
+		assert.ElementsMatch(t, []string{long, long + "-dir/", long + "-link"}, skipped)
+	})
+}
+
+func TestExtractorWithRequireEmptyChroot(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+	)
+
+	t.Run("not empty", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "existing"), nil, 0666))
+
+		e, err := NewExtractor(archivePath, dir, WithExtractorRequireEmptyChroot(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		assert.ErrorIs(t, e.Extract(context.Background()), ErrChrootNotEmpty)
+		assert.NoDirExists(t, filepath.Join(dir, "foo"))
+	})
+
+	for _, atomic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("atomic %v", atomic), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "new")
+
+			e, err := NewExtractor(archivePath, dir, WithExtractorRequireEmptyChroot(true), WithExtractorAtomic(atomic))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+			assert.FileExists(t, filepath.Join(dir, "foo", "bar"))
+
+			// the chroot is no longer empty
+			assert.ErrorIs(t, e.Extract(context.Background()), ErrChrootNotEmpty)
+		})
+	}
+
+	t.Run("filesystem", func(t *testing.T) {
+		_, err := NewExtractor(archivePath, t.TempDir(), WithExtractorRequireEmptyChroot(true), WithExtractorFilesystem(newMemFS()))
+		assert.ErrorIs(t, err, ErrEmptyChrootFilesystem)
+	})
+}
+
+func TestExtractorDirectoryPermissionsUpFront(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows (directory permissions are not supported)")
+	}
+
+	// the directory's entry is listed after its children
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "secret/nested/file", mode: 0600, contents: "file"},
+		testZipEntry{name: "secret/nested/", mode: os.ModeDir | 0750},
+		testZipEntry{name: "secret/", mode: os.ModeDir | 0700},
+	)
+
+	fs := &parentModeFS{modes: make(map[string]os.FileMode)}
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorFilesystem(fs))
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Extract(context.Background()))
+
+	// the directories already had their permissions when the file was
+	// written
+	assert.Equal(t, os.FileMode(0700), fs.modes[filepath.Join(dir, "secret")])
+	assert.Equal(t, os.FileMode(0750), fs.modes[filepath.Join(dir, "secret", "nested")])
+
+	fi, err := os.Lstat(filepath.Join(dir, "secret", "nested"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+
+	t.Run("mode mask", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "open/file", mode: 0666, contents: "file"},
+			testZipEntry{name: "open/", mode: os.ModeDir | 0777},
+		)
+
+		fs := &parentModeFS{modes: make(map[string]os.FileMode), created: make(map[string]os.FileMode)}
+		dir := t.TempDir()
+		e, err := NewExtractor(archivePath, dir, WithExtractorFilesystem(fs), WithExtractorModeMask(0755))
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		// the directory was created with the mask applied, and so was never
+		// group or world writable whilst the file was written, regardless of
+		// the umask
+		assert.Equal(t, os.FileMode(0755), fs.created[filepath.Join(dir, "open")])
+		assert.Zero(t, fs.modes[filepath.Join(dir, "open")]&0022)
+	})
+}
+
+// parentModeFS records the permissions of each ancestor of a file when the
+// file is opened, and the permissions each directory is created with.
+type parentModeFS struct {
+	osFilesystem
+	m       sync.Mutex
+	modes   map[string]os.FileMode
+	created map[string]os.FileMode
+}
+
+func (fs *parentModeFS) Mkdir(name string, perm os.FileMode) error {
+	fs.m.Lock()
+	if fs.created != nil {
+		fs.created[name] = perm
+	}
+	fs.m.Unlock()
+
+	return fs.osFilesystem.Mkdir(name, perm)
+}
+
+func (fs *parentModeFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.m.Lock()
+	for dir := filepath.Dir(name); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if fi, err := os.Lstat(dir); err == nil {
+			fs.modes[dir] = fi.Mode().Perm()
+		}
+	}
+	fs.m.Unlock()
+
+	return fs.osFilesystem.OpenFile(name, flag, perm)
+}
+
+func TestExtractorWithLogger(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "dir/file", mode: 0666, contents: "file"},
+		testZipEntry{name: "existing", mode: 0666, contents: "new"},
+	)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing"), []byte("old"), 0666))
+
+	events := make(map[string][]LogEvent)
+	var reason interface{}
+	e, err := NewExtractor(archivePath, dir,
+		WithExtractorOverwrite(OverwriteSkip),
+		WithExtractorLogger(func(event LogEvent, name string, fields map[string]interface{}) {
+			events[name] = append(events[name], event)
+			if event == LogEntrySkip {
+				reason = fields["reason"]
+			}
+		}),
+	)
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Extract(context.Background()))
+
+	assert.Equal(t, map[string][]LogEvent{
+		"dir/":     {LogEntryStart, LogEntryDone, LogMetadataApplied},
+		"dir/file": {LogEntryStart, LogMetadataApplied, LogEntryDone},
+		"existing": {LogEntryStart, LogEntrySkip, LogEntryDone},
+	}, events)
+	assert.Equal(t, "overwrite", reason)
+}
+
+func TestExtractorAbsolutePaths(t *testing.T) {
+	for _, name := range []string{"/absolute", `\absolute`, `C:\absolute`, "c:/absolute"} {
+		t.Run(name, func(t *testing.T) {
+			archivePath := testCreateZip(t,
+				testZipEntry{name: name, mode: 0666, contents: "absolute"},
+			)
+
+			e, err := NewExtractor(archivePath, t.TempDir())
+			require.NoError(t, err)
+			defer e.Close()
+			assert.ErrorIs(t, e.Extract(context.Background()), ErrAbsolutePath)
+
+			dir := t.TempDir()
+			e, err = NewExtractor(archivePath, dir, WithExtractorAbsolutePathPolicy(AbsolutePathStrip))
+			require.NoError(t, err)
+			defer e.Close()
+			require.NoError(t, e.Extract(context.Background()))
+
+			b, err := os.ReadFile(filepath.Join(dir, "absolute"))
+			require.NoError(t, err)
+			assert.Equal(t, "absolute", string(b))
+		})
+	}
+}
+
+func TestExtractorWithMaxOpenFiles(t *testing.T) {
+	var entries []testZipEntry
+	for i := 0; i < 50; i++ {
+		entries = append(entries, testZipEntry{name: fmt.Sprintf("file-%d", i), mode: 0666, contents: strings.Repeat("x", 1024)})
+	}
+	archivePath := testCreateZip(t, entries...)
+
+	fs := &openCountFS{}
+	e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorFilesystem(fs), WithExtractorConcurrency(8), WithExtractorMaxOpenFiles(2))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+	assert.Equal(t, int64(50), e.Stats().Files)
+	assert.LessOrEqual(t, atomic.LoadInt64(&fs.max), int64(2))
+
+	_, err = NewExtractor(archivePath, t.TempDir(), WithExtractorMaxOpenFiles(0))
+	assert.ErrorIs(t, err, ErrMinOpenFiles)
+}
+
+// openCountFS records the most files open at once.
+type openCountFS struct {
+	osFilesystem
+	open, max int64
+}
+
+func (fs *openCountFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.osFilesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	n := atomic.AddInt64(&fs.open, 1)
+	for {
+		max := atomic.LoadInt64(&fs.max)
+		if n <= max || atomic.CompareAndSwapInt64(&fs.max, max, n) {
+			break
+		}
+	}
+
+	// give other workers the chance to open files
+	time.Sleep(time.Millisecond)
+
+	return openCountFile{f, fs}, nil
+}
+
+type openCountFile struct {
+	File
+	fs *openCountFS
+}
+
+func (f openCountFile) Close() error {
+	atomic.AddInt64(&f.fs.open, -1)
+	return f.File.Close()
+}
+
+func TestExtractorChrootEscapeError(t *testing.T) {
+	tests := map[string]struct {
+		entry    testZipEntry
+		opts     []ExtractorOption
+		resolved string
+		target   string
+	}{
+		"entry": {
+			entry:    testZipEntry{name: "../escape", mode: 0666},
+			resolved: "escape",
+		},
+		"symlink": {
+			entry:    testZipEntry{name: "link", mode: os.ModeSymlink | 0777, contents: "../target"},
+			resolved: "target",
+			target:   "../target",
+		},
+		"hard link": {
+			entry:    testZipEntry{name: "link", mode: 0666, extra: testPKWAREUnixField("../target")},
+			opts:     []ExtractorOption{WithExtractorPreserveHardlinks(true)},
+			resolved: "target",
+			target:   "../target",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			archivePath := testCreateZip(t, tc.entry)
+
+			dir := filepath.Join(t.TempDir(), "chroot")
+			e, err := NewExtractor(archivePath, dir, tc.opts...)
+			require.NoError(t, err)
+			defer e.Close()
+
+			var cerr *ChrootEscapeError
+			require.ErrorAs(t, e.Extract(context.Background()), &cerr)
+			assert.Equal(t, tc.entry.name, cerr.Name)
+			assert.Equal(t, dir, cerr.Chroot)
+			assert.Equal(t, filepath.Join(filepath.Dir(dir), tc.resolved), cerr.Resolved)
+			assert.Equal(t, tc.target, cerr.Target)
+			assert.Contains(t, cerr.Error(), "outside of chroot")
+		})
+	}
+}
+
+func TestExtractorBzip2(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	// "hello, bzip2\n" compressed with bzip2 -9
+	contents := "hello, bzip2\n"
+	compressed := []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xb1, 0x23, 0xde, 0x43, 0x00, 0x00,
+		0x03, 0x59, 0x80, 0x00, 0x10, 0x40, 0x04, 0x10, 0x00, 0x12, 0x64, 0xc0, 0x10, 0x20, 0x00, 0x31,
+		0x03, 0x40, 0xd0, 0x20, 0x01, 0xa6, 0x91, 0x03, 0xab, 0x6c, 0x82, 0x84, 0xf8, 0xbb, 0x92, 0x29,
+		0xc2, 0x84, 0x85, 0x89, 0x1e, 0xf2, 0x18,
+	}
+
+	zw := zip.NewWriter(f)
+	hdr := &zip.FileHeader{
+		Name:               "foo.txt",
+		Method:             MethodBzip2,
+		CRC32:              crc32.ChecksumIEEE([]byte(contents)),
+		CompressedSize64:   uint64(len(compressed)),
+		UncompressedSize64: uint64(len(contents)),
+	}
+	hdr.SetMode(0666)
+	w, err := zw.CreateRaw(hdr)
+	require.NoError(t, err)
+	_, err = w.Write(compressed)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	dir := t.TempDir()
+	e, err := NewExtractor(f.Name(), dir)
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	b, err := os.ReadFile(filepath.Join(dir, "foo.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, contents, string(b))
+}
+
+func TestExtractorWithPreserveSpecialBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows (special bits are not supported)")
+	}
+
+	const special = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "setuid", mode: os.ModeSetuid | 0755, contents: "foo"},
+		testZipEntry{name: "setgid", mode: os.ModeSetgid | 0755, contents: "bar"},
+		testZipEntry{name: "sticky/", mode: os.ModeDir | os.ModeSticky | 0777},
+	)
+
+	tests := map[string]struct {
+		preserve bool
+		modes    map[string]os.FileMode
+	}{
+		"preserve": {preserve: true, modes: map[string]os.FileMode{
+			"setuid": os.ModeSetuid,
+			"setgid": os.ModeSetgid,
+			"sticky": os.ModeSticky,
+		}},
+		"mask": {preserve: false, modes: map[string]os.FileMode{
+			"setuid": 0,
+			"setgid": 0,
+			"sticky": 0,
+		}},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			dir := t.TempDir()
+			e, err := NewExtractor(archivePath, dir, WithExtractorPreserveSpecialBits(tc.preserve))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			for name, mode := range tc.modes {
+				fi, err := os.Lstat(filepath.Join(dir, name))
+				require.NoError(t, err)
+				assert.Equal(t, mode, fi.Mode()&special, name)
+			}
+		})
+	}
+}
+
+func TestExtractorVerify(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	contents := map[string]string{"bar": "barbar", "baz": "bazbaz", "foo": "foofoo"}
+
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"bar", "baz", "foo"} {
+		crc := crc32.ChecksumIEEE([]byte(contents[name]))
+		if name == "baz" {
+			crc = 0xdeadbeef
+		}
+
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			CRC32:              crc,
+			CompressedSize64:   uint64(len(contents[name])),
+			UncompressedSize64: uint64(len(contents[name])),
+		})
+		require.NoError(t, err)
+		_, err = io.WriteString(w, contents[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	t.Run("error", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "chroot")
+		e, err := NewExtractor(f.Name(), dir)
+		require.NoError(t, err)
+		defer e.Close()
+
+		err = e.Verify(context.Background())
+		require.ErrorIs(t, err, zip.ErrChecksum)
+		assert.Contains(t, err.Error(), "baz checksum mismatch")
+
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err), "nothing should be written")
+	})
+
+	t.Run("continue on error", func(t *testing.T) {
+		e, err := NewExtractor(f.Name(), t.TempDir(), WithExtractorContinueOnError(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		err = e.Verify(context.Background())
+		var errs ExtractErrors
+		require.ErrorAs(t, err, &errs)
+		require.Len(t, errs, 1)
+		assert.Equal(t, "baz", errs[0].Name)
+
+		stats := e.Stats()
+		assert.Equal(t, int64(18), stats.BytesVerified)
+		assert.Zero(t, stats.BytesWritten)
+	})
+}
+
+func TestExtractorWithModeMask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows (permissions are not supported)")
+	}
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "dir/file", mode: 0777, contents: "foo"},
+		testZipEntry{name: "setuid", mode: os.ModeSetuid | 0755, contents: "bar"},
+		testZipEntry{name: "private", mode: 0600, contents: "baz"},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorModeMask(0755), WithExtractorPreserveSpecialBits(true))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	for name, mode := range map[string]os.FileMode{
+		"dir":      os.ModeDir | 0755,
+		"dir/file": 0755,
+		"setuid":   0755,
+		"private":  0600,
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, mode, fi.Mode(), name)
+	}
+}
+
+func TestExtractorWithNoSymlinks(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0755},
+		testZipEntry{name: "dir/target", mode: 0640, contents: "contents"},
+		testZipEntry{name: "link", mode: os.ModeSymlink | 0777, contents: "dir/target"},
+		testZipEntry{name: "dir/chained", mode: os.ModeSymlink | 0777, contents: "../link"},
+	)
+
+	tests := map[string]struct {
+		policy  NoSymlinksPolicy
+		err     error
+		mode    os.FileMode
+		skipped int64
+	}{
+		"off":   {policy: NoSymlinksOff, mode: os.ModeSymlink | 0777},
+		"skip":  {policy: NoSymlinksSkip, skipped: 2},
+		"error": {policy: NoSymlinksError, err: ErrSymlinkNotAllowed},
+		"copy":  {policy: NoSymlinksCopy, mode: 0640},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			dir := t.TempDir()
+			e, err := NewExtractor(archivePath, dir, WithExtractorNoSymlinks(tc.policy))
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.skipped, e.Skipped())
+
+			for _, name := range []string{"link", "dir/chained"} {
+				fi, err := os.Lstat(filepath.Join(dir, name))
+				if tc.skipped > 0 {
+					assert.True(t, os.IsNotExist(err), name)
+					continue
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tc.mode, fi.Mode()&(os.ModeSymlink|os.ModePerm), name)
+
+				b, err := os.ReadFile(filepath.Join(dir, name))
+				require.NoError(t, err)
+				assert.Equal(t, "contents", string(b), name)
+			}
+		})
+	}
+
+	t.Run("copy directory", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "dir/", mode: os.ModeDir | 0755},
+			testZipEntry{name: "link", mode: os.ModeSymlink | 0777, contents: "dir"},
+		)
+
+		e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorNoSymlinks(NoSymlinksCopy))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.ErrorIs(t, e.Extract(context.Background()), ErrSymlinkTargetNotFile)
+	})
+
+	t.Run("copy outside of chroot", func(t *testing.T) {
+		archivePath := testCreateZip(t,
+			testZipEntry{name: "link", mode: os.ModeSymlink | 0777, contents: "../outside"},
+		)
+
+		e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorNoSymlinks(NoSymlinksCopy))
+		require.NoError(t, err)
+		defer e.Close()
+
+		var cerr *ChrootEscapeError
+		require.ErrorAs(t, e.Extract(context.Background()), &cerr)
+	})
+}
+
+func TestExtractorWithDuplicatePolicy(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0755},
+		testZipEntry{name: "dir/foo", mode: 0666, contents: "first"},
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0755},
+		testZipEntry{name: "dir/../dir/foo", mode: 0666, contents: "second"},
+	)
+
+	tests := map[string]struct {
+		policy   DuplicatePolicy
+		contents string
+		err      error
+	}{
+		"last wins":  {policy: DuplicateLastWins, contents: "second"},
+		"first wins": {policy: DuplicateFirstWins, contents: "first"},
+		"error":      {policy: DuplicateError, err: ErrDuplicateEntry},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			dir := t.TempDir()
+			e, err := NewExtractor(archivePath, dir, WithExtractorDuplicatePolicy(tc.policy))
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				assert.Contains(t, err.Error(), "dir/../dir/foo is a duplicate of dir/foo")
+
+				_, err = os.Stat(filepath.Join(dir, "dir"))
+				assert.True(t, os.IsNotExist(err), "nothing should be extracted")
+				return
+			}
+			require.NoError(t, err)
+
+			b, err := os.ReadFile(filepath.Join(dir, "dir", "foo"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.contents, string(b))
+			assert.Equal(t, int64(1), e.Stats().Files)
+		})
+	}
+}
+
+func TestExtractorUnsupportedMethods(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for i, method := range []uint16{zip.Store, zip.Deflate, 200, MethodBzip2, 100, 200} {
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:   fmt.Sprintf("file%d", i),
+			Method: method,
+		})
+		require.NoError(t, err)
+		_, err = w.Write(nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	e, err := NewExtractor(f.Name(), t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.Equal(t, []uint16{100, 200}, e.UnsupportedMethods())
+
+	e.RegisterDecompressor(200, io.NopCloser)
+	assert.Equal(t, []uint16{100}, e.UnsupportedMethods())
+}
+
+func TestExtractorWithReleaseEntries(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0750},
+		testZipEntry{name: "dir/foo", mode: 0666, contents: "foo"},
+		testZipEntry{name: "bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "link", mode: os.ModeSymlink | 0777, contents: "bar"},
+	)
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archivePath, dir, WithExtractorReleaseEntries(true), WithExtractorFsync(true))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+	assert.Empty(t, e.Files())
+
+	fi, err := os.Stat(filepath.Join(dir, "dir"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+
+	for name, contents := range map[string]string{"dir/foo": "foo", "bar": "bar", "link": "bar"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, contents, string(b), name)
+	}
+
+	target, err := os.Readlink(filepath.Join(dir, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "bar", target)
+}
+
+func TestExtractorWithRestoreAccessTime(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("access times are updated lazily on windows")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "src", "file")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	require.NoError(t, os.WriteFile(path, []byte("contents"), 0666))
+
+	// the access time is after the modification time, so that relatime
+	// mounts don't update it when the file is read for archiving
+	atime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(path, atime, atime.Add(-time.Hour)))
+
+	archivePath := filepath.Join(dir, "archive.zip")
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	a, err := NewArchiver(f, filepath.Dir(path), WithArchiverStoreAccessTime(true))
+	require.NoError(t, err)
+	fi, err := os.Lstat(path)
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), map[string]os.FileInfo{path: fi}))
+	require.NoError(t, a.Close())
+	require.NoError(t, f.Close())
+
+	for _, restore := range []bool{false, true} {
+		t.Run(fmt.Sprintf("restore %v", restore), func(t *testing.T) {
+			out := t.TempDir()
+			e, err := NewExtractor(archivePath, out, WithExtractorRestoreAccessTime(restore))
+			require.NoError(t, err)
+			require.NoError(t, e.Extract(context.Background()))
+			require.NoError(t, e.Close())
+
+			extracted := filepath.Join(out, "file")
+			fi, err := os.Lstat(extracted)
+			require.NoError(t, err)
+			got, _, err := fileTimes(extracted, fi)
+			require.NoError(t, err)
+
+			if restore {
+				assert.True(t, got.Equal(atime), "expected %v, got %v", atime, got)
+			} else {
+				assert.True(t, got.After(atime.Add(time.Minute)))
+			}
+		})
+	}
+}
+
+func TestExtractorFS(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "baz/qux/quux", mode: 0666, contents: "quux"},
+	)
+
+	e, err := NewExtractor(archivePath, t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+
+	fsys := e.FS()
+
+	var walked []string
+	require.NoError(t, fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		walked = append(walked, fmt.Sprintf("%s %v", path, d.IsDir()))
+		return nil
+	}))
+	assert.Equal(t, []string{
+		". true",
+		"baz true",
+		"baz/qux true",
+		"baz/qux/quux false",
+		"foo true",
+		"foo/bar false",
+	}, walked)
+
+	data, err := fs.ReadFile(fsys, "baz/qux/quux")
+	require.NoError(t, err)
+	assert.Equal(t, "quux", string(data))
+
+	_, err = fsys.Open("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestExtractorWithProfiling(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: strings.Repeat("bar", 1<<16)},
+	)
+
+	for _, profiling := range []bool{false, true} {
+		t.Run(fmt.Sprintf("profiling %v", profiling), func(t *testing.T) {
+			e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorProfiling(profiling))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			profiles := e.Profile()
+			if !profiling {
+				assert.Empty(t, profiles)
+				return
+			}
+
+			require.Contains(t, profiles, "foo/bar")
+			assert.NotZero(t, profiles["foo/bar"].Decompress)
+			assert.NotZero(t, profiles["foo/bar"].Write)
+			assert.NotZero(t, profiles["foo/bar"].Metadata)
+
+			require.Contains(t, profiles, "foo/")
+			assert.Zero(t, profiles["foo/"].Decompress)
+			assert.NotZero(t, profiles["foo/"].Metadata)
+		})
+	}
+}
+
+func TestExtractorWithFlatten(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/a.txt", mode: 0666, contents: "foo"},
+		testZipEntry{name: "foo/bar/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar/b.txt", mode: 0666, contents: "b"},
+		testZipEntry{name: "baz/a.txt", mode: 0666, contents: "baz"},
+	)
+
+	t.Run("last wins", func(t *testing.T) {
+		dir := t.TempDir()
+		e, err := NewExtractor(archivePath, dir, WithExtractorFlatten(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			assert.False(t, entry.IsDir())
+			names = append(names, entry.Name())
+		}
+		assert.Equal(t, []string{"a.txt", "b.txt"}, names)
+
+		data, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "baz", string(data))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorFlatten(true), WithExtractorDuplicatePolicy(DuplicateError))
+		require.NoError(t, err)
+		defer e.Close()
+
+		assert.ErrorIs(t, e.Extract(context.Background()), ErrDuplicateEntry)
+	})
+}
+
+func TestExtractorReuse(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "foo/baz", mode: os.ModeSymlink | 0777, contents: "bar"},
+	)
+
+	t.Run("sequential", func(t *testing.T) {
+		dir := t.TempDir()
+		e, err := NewExtractor(archivePath, dir)
+		require.NoError(t, err)
+		defer e.Close()
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, e.Extract(context.Background()))
+			assert.Equal(t, ExtractorStats{Files: 1, Directories: 1, Symlinks: 1, BytesWritten: 3}, e.Stats())
+
+			data, err := os.ReadFile(filepath.Join(dir, "foo", "baz"))
+			require.NoError(t, err)
+			assert.Equal(t, "bar", string(data))
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var e *Extractor
+		var errs []error
+		e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorLogger(func(event LogEvent, name string, fields map[string]interface{}) {
+			if event == LogEntryStart {
+				_, planErr := e.Plan(context.Background())
+				errs = append(errs, e.Extract(context.Background()), e.Verify(context.Background()), planErr)
+			}
+		}))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+		require.NotEmpty(t, errs)
+		for _, err := range errs {
+			assert.ErrorIs(t, err, ErrExtractionInProgress)
+		}
+
+		require.NoError(t, e.Verify(context.Background()))
+		_, err = e.Plan(context.Background())
+		require.NoError(t, err)
+	})
+}
+
+func TestExtractorDirectoryChownErrorHandler(t *testing.T) {
+	entries := []testZipEntry{}
+	var names []string
+	dir := ""
+	for i := 0; i < 8; i++ {
+		dir += fmt.Sprintf("d%d/", i)
+		entries = append(entries,
+			testZipEntry{name: dir, mode: os.ModeDir | 0777},
+			testZipEntry{name: dir + "file", mode: 0666, contents: "file"},
+		)
+		names = append(names, dir, dir+"file")
+	}
+	archivePath := testCreateZip(t, entries...)
+
+	errChown := errors.New("chown failed")
+
+	t.Run("handled", func(t *testing.T) {
+		var handling int32
+		var handled []string
+		e, err := NewExtractor(archivePath, t.TempDir(),
+			WithExtractorFilesystem(failChownFS{newMemFS(), errChown}),
+			WithExtractorForceOwner(1000, 1000),
+			WithExtractorChownErrorHandler(func(name string, err error) error {
+				assert.Equal(t, int32(1), atomic.AddInt32(&handling, 1))
+				defer atomic.AddInt32(&handling, -1)
+
+				assert.ErrorIs(t, err, errChown)
+				handled = append(handled, name)
+				return nil
+			}))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+		assert.ElementsMatch(t, names, handled)
+	})
+
+	for _, name := range []string{"d0/d1/d2/", "d0/d1/d2/file"} {
+		t.Run("failed "+name, func(t *testing.T) {
+			e, err := NewExtractor(archivePath, t.TempDir(),
+				WithExtractorFilesystem(failChownFS{newMemFS(), errChown}),
+				WithExtractorForceOwner(1000, 1000),
+				WithExtractorChownErrorHandler(func(n string, err error) error {
+					if n == name {
+						return err
+					}
+					return nil
+				}))
+			require.NoError(t, err)
+			defer e.Close()
+
+			assert.ErrorIs(t, e.Extract(context.Background()), errChown)
+		})
+	}
+}
+
+type failChownFS struct {
+	*memFS
+	err error
+}
+
+func (fs failChownFS) Lchown(name string, uid, gid int) error {
+	return fs.err
+}
+
+func TestExtractorSelfExtracting(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+	)
+
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	// the offsets of the archive are relative to the start of the zip data,
+	// rather than the start of the file, as with 7-Zip's SFX stubs
+	sfxPath := filepath.Join(t.TempDir(), "archive.exe")
+	stub := append([]byte("MZ"), bytes.Repeat([]byte{0x90}, 4094)...)
+	require.NoError(t, os.WriteFile(sfxPath, append(stub, data...), 0666))
+
+	dir := t.TempDir()
+	e, err := NewExtractor(sfxPath, dir)
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	contents, err := os.ReadFile(filepath.Join(dir, "foo", "bar"))
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(contents))
+}
+
+func TestExtractorLchmodNotSupported(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+		testZipEntry{name: "bar", mode: os.ModeSymlink | 0777, contents: "foo"},
+	)
+
+	e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorFilesystem(noLchmodFS{newMemFS()}))
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.ErrorIs(t, e.Extract(context.Background()), syscall.ENOTSUP)
+
+	// symlink permissions are ignored, so not being able to set them is
+	// tolerated
+	e, err = NewExtractor(archivePath, t.TempDir(), WithExtractorFilesystem(noLchmodFS{newMemFS()}))
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.NoError(t, e.ExtractFilter(context.Background(), func(file *zip.File) bool {
+		return file.Mode()&os.ModeSymlink != 0
+	}))
+}
+
+type noLchmodFS struct {
+	*memFS
+}
+
+func (fs noLchmodFS) Lchmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "lchmod", Path: name, Err: syscall.ENOTSUP}
+}
+
+func TestExtractorWithOrderedEvents(t *testing.T) {
+	entries := []testZipEntry{{name: "dir/", mode: os.ModeDir | 0777}}
+	for i := 0; i < 64; i++ {
+		// earlier files are larger, so that they finish after later files
+		entries = append(entries, testZipEntry{
+			name:     fmt.Sprintf("dir/file_%02d", i),
+			mode:     0666,
+			contents: strings.Repeat("x", (64-i)*16*1024),
+		})
+	}
+	archivePath := testCreateZip(t, entries...)
+
+	index := make(map[string]int)
+	for i, entry := range entries {
+		index[entry.name] = i
+	}
+
+	var order []int
+	e, err := NewExtractor(archivePath, t.TempDir(),
+		WithExtractorConcurrency(8),
+		WithExtractorOrderedEvents(true),
+		WithExtractorLogger(func(event LogEvent, name string, fields map[string]interface{}) {
+			// directory metadata is applied once everything within them
+			// has been extracted
+			if event == LogMetadataApplied && strings.HasSuffix(name, "/") {
+				return
+			}
+			order = append(order, index[name])
+		}),
+		WithExtractorProgress(func(name string, bytesWritten, totalBytes int64) {
+			order = append(order, index[name])
+		}),
+	)
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	assert.True(t, sort.IntsAreSorted(order), "events should be in archive order")
+	assert.Equal(t, len(entries)-1, order[len(order)-1])
+}
+
+func TestExtractorWithOrderedEventsProgressOnly(t *testing.T) {
+	var entries []testZipEntry
+	for i := 0; i < 16; i++ {
+		entries = append(entries, testZipEntry{name: fmt.Sprintf("file_%02d", i), mode: 0666, contents: "file"})
+	}
+	archivePath := testCreateZip(t, entries...)
+
+	var reported int64
+	var opened []int64
+	fs := openHookFS{fn: func(name string) {
+		opened = append(opened, atomic.LoadInt64(&reported))
+	}}
+
+	e, err := NewExtractor(archivePath, t.TempDir(),
+		WithExtractorConcurrency(1),
+		WithExtractorFilesystem(fs),
+		WithExtractorOrderedEvents(true),
+		WithExtractorProgress(func(name string, bytesWritten, totalBytes int64) {
+			atomic.AddInt64(&reported, 1)
+		}),
+	)
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	// without a logger, entries are still completed, so each file's progress
+	// is reported before the next file is written rather than being buffered
+	// until extraction finishes
+	require.Len(t, opened, len(entries))
+	for i, n := range opened {
+		assert.Equal(t, int64(i), n)
+	}
+	assert.Equal(t, int64(len(entries)), reported)
+}
+
+// openHookFS calls fn before each file is opened.
+type openHookFS struct {
+	osFilesystem
+	fn func(name string)
+}
+
+func (fs openHookFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.fn(name)
+	return fs.osFilesystem.OpenFile(name, flag, perm)
+}
+
+func TestExtractorEntries(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "dir/file", mode: 0640, contents: "file"},
+		testZipEntry{name: "dir/empty", mode: 0666},
+		testZipEntry{name: "dir/link", mode: os.ModeSymlink | 0777, contents: "file"},
+		testZipEntry{name: "dir/fifo", mode: os.ModeNamedPipe | 0666},
+	)
+
+	e, err := NewExtractor(archivePath, t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+
+	entries := e.Entries()
+	require.Len(t, entries, 5)
+
+	type class struct{ regular, dir, symlink bool }
+	expected := []class{{dir: true}, {regular: true}, {regular: true}, {symlink: true}, {}}
+	for i, entry := range entries {
+		file := e.Files()[i]
+		assert.Equal(t, file.Name, entry.Name)
+		assert.Equal(t, file.Mode(), entry.Mode)
+		assert.Equal(t, file.Modified, entry.Modified)
+		assert.Equal(t, expected[i], class{entry.IsRegular, entry.IsDir, entry.IsSymlink}, entry.Name)
+	}
+
+	assert.EqualValues(t, 4, entries[1].UncompressedSize)
+	assert.EqualValues(t, 4, entries[1].CompressedSize)
+	assert.Equal(t, 1.0, entries[1].Ratio)
+	assert.Equal(t, 1.0, entries[2].Ratio)
+	assert.Equal(t, zip.Store, entries[1].Method)
+}
+
+func TestExtractorWithAssumeCleanTarget(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+		testZipEntry{name: "bar", mode: os.ModeSymlink | 0777, contents: "foo"},
+	)
+
+	t.Run("clean", func(t *testing.T) {
+		dir := t.TempDir()
+		e, err := NewExtractor(archivePath, dir, WithExtractorAssumeCleanTarget(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		data, err := os.ReadFile(filepath.Join(dir, "bar"))
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(data))
+	})
+
+	t.Run("existing file", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "foo"), []byte("existing contents"), 0666))
+
+		e, err := NewExtractor(archivePath, dir, WithExtractorAssumeCleanTarget(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.ExtractFilter(context.Background(), func(file *zip.File) bool {
+			return file.Name == "foo"
+		}))
+
+		data, err := os.ReadFile(filepath.Join(dir, "foo"))
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(data))
+	})
+
+	t.Run("existing symlink", func(t *testing.T) {
+		dir := t.TempDir()
+		outside := filepath.Join(t.TempDir(), "outside")
+		require.NoError(t, os.WriteFile(outside, []byte("outside"), 0666))
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "foo")))
+
+		e, err := NewExtractor(archivePath, dir, WithExtractorAssumeCleanTarget(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		assert.ErrorIs(t, e.Extract(context.Background()), ErrNotRegularFile)
+
+		data, err := os.ReadFile(outside)
+		require.NoError(t, err)
+		assert.Equal(t, "outside", string(data), "files shouldn't be written through symlinks")
+	})
+}
+
+func TestExtractorWithFilenameEncoding(t *testing.T) {
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String("中文/文件.txt")
+	require.NoError(t, err)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, hdr := range []*zip.FileHeader{
+		{Name: gbk, NonUTF8: true},
+		{Name: "日本語.txt"},
+	} {
+		hdr.SetMode(0666)
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, "contents")
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	dir := t.TempDir()
+	e, err := NewExtractor(f.Name(), dir, WithExtractorFilenameEncoding(simplifiedchinese.GBK))
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.Equal(t, "中文/文件.txt", e.Files()[0].Name)
+	assert.Equal(t, "日本語.txt", e.Files()[1].Name)
+
+	require.NoError(t, e.Extract(context.Background()))
+
+	for _, name := range []string{filepath.Join("中文", "文件.txt"), "日本語.txt"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, "contents", string(data))
+	}
+}
+
+func TestExtractFile(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+	)
+
+	dir := t.TempDir()
+	stats, err := ExtractFile(archivePath, dir)
+	require.NoError(t, err)
+	assert.Equal(t, ExtractorStats{Files: 1, Directories: 1, BytesWritten: 3}, stats)
+
+	data, err := os.ReadFile(filepath.Join(dir, "foo", "bar"))
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(data))
+
+	_, err = ExtractFile(filepath.Join(dir, "missing.zip"), dir)
+	assert.True(t, os.IsNotExist(err))
+
+	t.Run("close error", func(t *testing.T) {
+		zr, err := zip.OpenReader(archivePath)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		errClose := errors.New("close failed")
+		e, err := newExtractor(&zr.Reader, closerFunc(func() error { return errClose }), t.TempDir(), nil)
+		require.NoError(t, err)
+
+		stats, err := extractAndClose(e)
+		assert.ErrorIs(t, err, errClose)
+		assert.EqualValues(t, 1, stats.Files)
+	})
+}
+
+type closerFunc func() error
+
+func (fn closerFunc) Close() error {
+	return fn()
+}
+
+func TestExtractorWithUnsupportedTypePolicy(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: 0666, contents: "foo"},
+		testZipEntry{name: "fifo", mode: os.ModeNamedPipe | 0666},
+	)
+
+	for _, policy := range []UnsupportedTypePolicy{UnsupportedTypeSkip, UnsupportedTypeError, UnsupportedTypeLog} {
+		t.Run(fmt.Sprintf("policy %d", policy), func(t *testing.T) {
+			dir := t.TempDir()
+
+			var skipped []string
+			e, err := NewExtractor(archivePath, dir,
+				WithExtractorUnsupportedTypePolicy(policy),
+				WithExtractorLogger(func(event LogEvent, name string, fields map[string]interface{}) {
+					if event == LogEntrySkip {
+						skipped = append(skipped, fmt.Sprintf("%s %v", name, fields["reason"]))
+					}
+				}),
+			)
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			if policy == UnsupportedTypeError {
+				assert.ErrorIs(t, err, ErrUnsupportedType)
+				_, err = os.Lstat(filepath.Join(dir, "foo"))
+				assert.True(t, os.IsNotExist(err), "nothing should be extracted")
+				return
+			}
+			require.NoError(t, err)
+
+			_, err = os.Lstat(filepath.Join(dir, "fifo"))
+			assert.True(t, os.IsNotExist(err))
+
+			if policy == UnsupportedTypeLog {
+				assert.Equal(t, []string{"fifo unsupported type"}, skipped)
+				assert.EqualValues(t, 1, e.Stats().Skipped)
+			} else {
+				assert.Empty(t, skipped)
+				assert.EqualValues(t, 0, e.Stats().Skipped)
+			}
+		})
+	}
+}
+
+func TestExtractorWithRecordCreatedPaths(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "existing/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "foo/baz/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/baz/qux", mode: 0666, contents: "qux"},
+		testZipEntry{name: "foo/link", mode: os.ModeSymlink | 0777, contents: "bar"},
+	)
+
+	for _, atomic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("atomic %v", atomic), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "chroot")
+			if !atomic {
+				require.NoError(t, os.MkdirAll(filepath.Join(dir, "existing"), 0777))
+			}
+
+			e, err := NewExtractor(archivePath, dir, WithExtractorRecordCreatedPaths(true), WithExtractorAtomic(atomic))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			expected := []string{
+				filepath.Join(dir, "foo"),
+				filepath.Join(dir, "foo", "bar"),
+				filepath.Join(dir, "foo", "baz"),
+				filepath.Join(dir, "foo", "baz", "qux"),
+				filepath.Join(dir, "foo", "link"),
+			}
+			if atomic {
+				expected = append([]string{filepath.Join(dir, "existing")}, expected...)
+			}
+			assert.Equal(t, expected, e.CreatedPaths())
+
+			for _, path := range e.CreatedPaths() {
+				_, err := os.Lstat(path)
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	e, err := NewExtractor(archivePath, t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+	assert.Empty(t, e.CreatedPaths())
+}
+
+func TestExtractorReaderAt(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	contents := strings.Repeat("0123456789", 1000)
+
+	zw := zip.NewWriter(f)
+	_, err = zw.Create("dir/")
+	require.NoError(t, err)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("file%d", method),
+			Method: method,
+		})
+		require.NoError(t, err)
+		_, err = io.WriteString(w, contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	e, err := NewExtractor(f.Name(), t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+
+	r, err := e.ReaderAt(fmt.Sprintf("file%d", zip.Store))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), r.Size())
+
+	buf := make([]byte, 10)
+	_, err = r.ReadAt(buf, 5005)
+	require.NoError(t, err)
+	assert.Equal(t, "5678901234", string(buf))
+
+	_, err = e.ReaderAt(fmt.Sprintf("file%d", zip.Deflate))
+	assert.ErrorIs(t, err, ErrNotStored)
+
+	_, err = e.ReaderAt("dir/")
+	assert.ErrorIs(t, err, ErrNotRegularFile)
+
+	_, err = e.ReaderAt("missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestExtractorWithTypeConflictPolicy(t *testing.T) {
+	tests := map[string][]testZipEntry{
+		"directory entry": {
+			{name: "foo", mode: 0666, contents: "foo"},
+			{name: "foo/", mode: os.ModeDir | 0777},
+		},
+		"parent directory": {
+			{name: "foo", mode: 0666, contents: "foo"},
+			{name: "foo/bar", mode: 0666, contents: "bar"},
+		},
+		"parent directory first": {
+			{name: "foo/bar", mode: 0666, contents: "bar"},
+			{name: "foo", mode: os.ModeSymlink | 0777, contents: "foo"},
+		},
+	}
+
+	for tn, entries := range tests {
+		t.Run(tn, func(t *testing.T) {
+			archivePath := testCreateZip(t, entries...)
+
+			e, err := NewExtractor(archivePath, t.TempDir())
+			require.NoError(t, err)
+			defer e.Close()
+
+			assert.ErrorIs(t, e.Extract(context.Background()), ErrTypeConflict)
+			assert.Equal(t, ExtractorStats{}, e.Stats())
+
+			dir := t.TempDir()
+			e, err = NewExtractor(archivePath, dir, WithExtractorTypeConflictPolicy(TypeConflictDirectoryWins))
+			require.NoError(t, err)
+			defer e.Close()
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			fi, err := os.Lstat(filepath.Join(dir, "foo"))
+			require.NoError(t, err)
+			assert.True(t, fi.IsDir())
+		})
+	}
+
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+	)
+
+	e, err := NewExtractor(archivePath, t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.NoError(t, e.Extract(context.Background()))
+}
+
+type mkdirAllCountFS struct {
+	*memFS
+	n *int64
+}
+
+func (fs mkdirAllCountFS) MkdirAll(name string, perm os.FileMode) error {
+	atomic.AddInt64(fs.n, 1)
+	return fs.memFS.MkdirAll(name, perm)
+}
+
+func TestExtractorCreatesParentsOnce(t *testing.T) {
+	var entries []testZipEntry
+	for i := 0; i < 16; i++ {
+		entries = append(entries,
+			testZipEntry{name: fmt.Sprintf("a/b/c/file%d", i), mode: 0666, contents: "foo"},
+			testZipEntry{name: fmt.Sprintf("a/b/d/file%d", i), mode: 0666, contents: "bar"},
+		)
+	}
+	entries = append(entries, testZipEntry{name: "a/file", mode: 0666, contents: "baz"})
+	archivePath := testCreateZip(t, entries...)
+
+	var n int64
+	fs := mkdirAllCountFS{newMemFS(), &n}
+
+	e, err := NewExtractor(archivePath, t.TempDir(), WithExtractorFilesystem(fs))
+	require.NoError(t, err)
+	defer e.Close()
+
+	require.NoError(t, e.Extract(context.Background()))
+	assert.Equal(t, int64(len(entries)), e.Stats().Files)
+
+	// a/b/c and a/b/d are each created once, and a was created with them
+	assert.Equal(t, int64(2), n)
+}
+
+func TestExtractorIsZip64EndRecord(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("foo")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "foo")
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	data := buf.Bytes()
+	e, err := NewExtractorFromReader(bytes.NewReader(data), int64(len(data)), t.TempDir())
+	require.NoError(t, err)
+	assert.False(t, e.IsZip64())
+
+	// rewrite the end of central directory record with a Zip64 end of
+	// central directory record, without any entry using a Zip64 extra field
+	end, _, err := readDirectoryEnd(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.False(t, end.zip64)
+
+	dirEnd := end.offset + end.size
+	buf.Truncate(int(dirEnd))
+	end.zip64 = true
+	require.NoError(t, writeDirectoryEnd(&buf, end, dirEnd))
+
+	data = buf.Bytes()
+	e, err = NewExtractorFromReader(bytes.NewReader(data), int64(len(data)), t.TempDir())
+	require.NoError(t, err)
+	assert.True(t, e.IsZip64())
+
+	archivePath := filepath.Join(t.TempDir(), "archive.zip")
+	require.NoError(t, os.WriteFile(archivePath, data, 0666))
+
+	e, err = NewExtractor(archivePath, t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.True(t, e.IsZip64())
+	require.NoError(t, e.Extract(context.Background()))
+}
+
+func TestExtractorPlan(t *testing.T) {
+	archivePath := testCreateZip(t,
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/bar", mode: 0666, contents: "bar"},
+		testZipEntry{name: "foo/existing", mode: 0666, contents: "new"},
+		testZipEntry{name: "foo/inside", mode: os.ModeSymlink | 0777, contents: "bar"},
+		testZipEntry{name: "foo/outside", mode: os.ModeSymlink | 0777, contents: "../../outside"},
+	)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "foo"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "foo", "existing"), []byte("old"), 0666))
+
+	e, err := NewExtractor(archivePath, dir, WithExtractorSymlinkPolicy(SymlinkSkip), WithExtractorOverwrite(OverwriteSkip))
+	require.NoError(t, err)
+	defer e.Close()
+
+	planned, err := e.Plan(context.Background())
+	require.NoError(t, err)
+
+	actions := make(map[string]PlanAction)
+	for _, entry := range planned {
+		actions[entry.Name] = entry.Action
+		assert.Equal(t, filepath.Join(dir, filepath.FromSlash(entry.Name)), entry.Path)
+		if entry.Name == "foo/inside" {
+			assert.Equal(t, "bar", entry.Target)
+		}
+	}
+
+	assert.Equal(t, map[string]PlanAction{
+		"foo/":         PlanUpdate,
+		"foo/bar":      PlanCreate,
+		"foo/existing": PlanSkip,
+		"foo/inside":   PlanCreate,
+		"foo/outside":  PlanSkip,
+	}, actions)
+
+	entries, err := os.ReadDir(filepath.Join(dir, "foo"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "plan should not modify the filesystem")
+	assert.Zero(t, e.Stats())
+
+	t.Run("checks", func(t *testing.T) {
+		tests := map[string]struct {
+			entries []testZipEntry
+			opts    []ExtractorOption
+		}{
+			"outside of chroot": {
+				entries: []testZipEntry{{name: "../escape", mode: 0666}},
+			},
+			"symlink outside of chroot": {
+				entries: []testZipEntry{{name: "foo", mode: os.ModeSymlink | 0777, contents: "../escape"}},
+			},
+			"limit exceeded": {
+				entries: []testZipEntry{{name: "foo", mode: 0666}, {name: "bar", mode: 0666}},
+				opts:    []ExtractorOption{WithExtractorMaxFiles(1)},
+			},
+			"overwrite error": {
+				entries: []testZipEntry{{name: "foo/existing", mode: 0666}},
+				opts:    []ExtractorOption{WithExtractorOverwrite(OverwriteError)},
+			},
+		}
+
+		for tn, tc := range tests {
+			t.Run(tn, func(t *testing.T) {
+				e, err := NewExtractor(testCreateZip(t, tc.entries...), dir, tc.opts...)
+				require.NoError(t, err)
+				defer e.Close()
+
+				_, err = e.Plan(context.Background())
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestExtractorWithCaseCollisions(t *testing.T) {
+	colliding := testCreateZip(t,
+		testZipEntry{name: "README.md", mode: 0666, contents: "upper"},
+		testZipEntry{name: "readme.md", mode: 0666, contents: "lower"},
+	)
+	directories := testCreateZip(t,
+		testZipEntry{name: "Foo/", mode: os.ModeDir | 0777},
+		testZipEntry{name: "foo/", mode: os.ModeDir | 0777},
+	)
+
+	for _, policy := range []CaseCollisionPolicy{CaseCollisionIgnore, CaseCollisionAuto, CaseCollisionAlways} {
+		t.Run(fmt.Sprintf("policy %d", policy), func(t *testing.T) {
+			e, err := NewExtractor(colliding, t.TempDir(), WithExtractorCaseCollisions(policy))
+			require.NoError(t, err)
+			defer e.Close()
+
+			expectErr := policy == CaseCollisionAlways || (policy == CaseCollisionAuto && e.caseInsensitive())
+
+			_, err = e.Plan(context.Background())
+			if expectErr {
+				assert.ErrorIs(t, err, ErrCaseCollision)
+				assert.ErrorIs(t, e.Extract(context.Background()), ErrCaseCollision)
+				assert.Zero(t, e.Stats())
+			} else {
+				assert.NoError(t, err)
+				assert.NoError(t, e.Extract(context.Background()))
+			}
+
+			e, err = NewExtractor(directories, t.TempDir(), WithExtractorCaseCollisions(policy))
+			require.NoError(t, err)
+			defer e.Close()
+
+			assert.NoError(t, e.Extract(context.Background()))
+		})
+	}
+}
+
+func TestExtractorWithLimiter(t *testing.T) {
+	files := make(map[string]testFile)
+	for i := 0; i < 16; i++ {
+		files[fmt.Sprintf("foo_%d.go", i)] = testFile{mode: 0666, contents: "foo"}
+	}
+
+	archiveFiles, dir := testCreateFiles(t, files)
+	testCreateArchive(t, dir, archiveFiles, func(filename, chroot string) {
+		sem := make(chan struct{}, 2)
+
+		wg, ctx := errgroup.WithContext(context.Background())
+		for i := 0; i < 4; i++ {
+			wg.Go(func() error {
+				e, err := NewExtractor(filename, t.TempDir(), WithExtractorLimiter(sem))
+				if err != nil {
+					return err
+				}
+				defer e.Close()
+
+				return e.Extract(ctx)
+			})
+		}
+		require.NoError(t, wg.Wait())
+		assert.Len(t, sem, 0, "all slots should be released")
+
+		// with every slot in use, extraction blocks until its context is done
+		sem <- struct{}{}
+		sem <- struct{}{}
+
+		e, err := NewExtractor(filename, t.TempDir(), WithExtractorLimiter(sem))
+		require.NoError(t, err)
+		defer e.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, e.Extract(ctx), context.DeadlineExceeded)
+
+		_, err = NewExtractor(filename, t.TempDir(), WithExtractorLimiter(nil))
+		assert.ErrorIs(t, err, ErrMinConcurrency)
+	})
+}
+
+func aopts(options ...ArchiverOption) []ArchiverOption {
+	return options
+}
+
+func benchmarkExtractOptions(b *testing.B, stdDeflate bool, ao []ArchiverOption, eo ...ExtractorOption) {
+	files := make(map[string]os.FileInfo)
+	filepath.Walk(*archiveDir, func(filename string, fi os.FileInfo, err error) error {
+		files[filename] = fi
+		return nil
+	})
+
+	dir := b.TempDir()
+	archiveName := filepath.Join(dir, "fastzip-benchmark-extract.zip")
+	f, err := os.Create(archiveName)
+	require.NoError(b, err)
+	defer os.Remove(f.Name())
+
+	ao = append(ao, WithStageDirectory(dir))
+	a, err := NewArchiver(f, *archiveDir, ao...)
+	require.NoError(b, err)
+
+	err = a.Archive(context.Background(), files)
+	require.NoError(b, err)
+	require.NoError(b, a.Close())
+	require.NoError(b, f.Close())
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	fi, _ := os.Stat(archiveName)
+	b.SetBytes(fi.Size())
+	for n := 0; n < b.N; n++ {
+		e, err := NewExtractor(archiveName, dir, eo...)
+		if stdDeflate {
+			e.RegisterDecompressor(zip.Deflate, StdFlateDecompressor())
+		}
+		require.NoError(b, err)
+		require.NoError(b, e.Extract(context.Background()))
+	}
+}
+
+func BenchmarkExtractStore_1(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(1))
+}
+
+func BenchmarkExtractStore_2(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(2))
+}
+
+func BenchmarkExtractStore_4(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(4))
+}
+
+func BenchmarkExtractStore_8(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(8))
+}
+
+func BenchmarkExtractStore_16(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(16))
+}
+
+func BenchmarkExtractStandardFlate_1(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(1))
+}
+
+func BenchmarkExtractStandardFlate_2(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(2))
+}
+
+func BenchmarkExtractStandardFlate_4(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(4))
+}
+
+func BenchmarkExtractStandardFlate_8(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(8))
+}
+
+func BenchmarkExtractStandardFlate_16(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(16))
+}
+
+func BenchmarkExtractNonStandardFlate_1(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(1))
+}
+
+func BenchmarkExtractNonStandardFlate_2(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(2))
+}
+
+func BenchmarkExtractNonStandardFlate_4(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(4))
+}
+
+func BenchmarkExtractNonStandardFlate_8(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(8))
+}
+
+func BenchmarkExtractNonStandardFlate_16(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(16))
+}
+
+func BenchmarkExtractZstd_1(b *testing.B) {
+	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(1))
+}
+
+func BenchmarkExtractZstd_2(b *testing.B) {
+	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(2))
+}
+
+func BenchmarkExtractZstd_4(b *testing.B) {
+	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(4))
+}
+
+func BenchmarkExtractZstd_8(b *testing.B) {
+	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(8))
+}
+
+func BenchmarkExtractZstd_16(b *testing.B) {
+	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(16))
+}
+
+func BenchmarkExtractBufferSize_4k(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(1), WithExtractorBufferSize(4*1024))
+}
+
+func BenchmarkExtractBufferSize_1m(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(1), WithExtractorBufferSize(1024*1024))
+}
+
+// discardFS discards everything extracted to it.
+type discardFS struct{}
+
+type discardFile struct{ io.Writer }
+
+func (discardFile) Close() error { return nil }
+
+func (discardFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return discardFile{io.Discard}, nil
+}
+func (discardFS) Mkdir(name string, perm os.FileMode) error    { return nil }
+func (discardFS) MkdirAll(name string, perm os.FileMode) error { return nil }
+func (discardFS) Remove(name string) error                     { return nil }
+func (discardFS) Lstat(name string) (os.FileInfo, error) {
+	return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+}
+func (discardFS) Symlink(oldname, newname string) error                                { return nil }
+func (discardFS) Link(oldname, newname string) error                                   { return nil }
+func (discardFS) Lchmod(name string, mode os.FileMode) error                           { return nil }
+func (discardFS) Lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error { return nil }
+func (discardFS) Lchown(name string, uid, gid int) error                               { return nil }
+func (discardFS) Lsetxattr(name, attr string, value []byte) error                      { return nil }
+
+// benchmarkExtractManyEntries extracts an archive with many small entries,
+// reporting the heap still in use once extraction completes, whilst the
+// extractor remains open.
+func benchmarkExtractManyEntries(b *testing.B, release bool) {
+	const entries = 100000
+
+	f, err := os.Create(filepath.Join(b.TempDir(), "many.zip"))
+	require.NoError(b, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for i := 0; i < entries; i++ {
+		hdr := &zip.FileHeader{Name: fmt.Sprintf("dir%d/file%d", i%100, i), Method: zip.Store}
+		hdr.SetMode(0666)
+		_, err := zw.CreateHeader(hdr)
+		require.NoError(b, err)
+	}
+	require.NoError(b, zw.Close())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		e, err := NewExtractor(f.Name(), b.TempDir(), WithExtractorFilesystem(discardFS{}), WithExtractorReleaseEntries(release))
+		require.NoError(b, err)
+		require.NoError(b, e.Extract(context.Background()))
+
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		b.ReportMetric(float64(ms.HeapAlloc)/entries, "heap-B/entry")
+
+		require.NoError(b, e.Close())
+	}
+}
+
+func BenchmarkExtractManyEntries(b *testing.B) {
+	benchmarkExtractManyEntries(b, false)
+}
+
+func BenchmarkExtractManyEntriesReleased(b *testing.B) {
+	benchmarkExtractManyEntries(b, true)
+}
+
+func benchmarkExtractAssumeCleanTarget(b *testing.B, assume bool) {
+	const entries = 10000
+
+	f, err := os.Create(filepath.Join(b.TempDir(), "many.zip"))
+	require.NoError(b, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for i := 0; i < entries; i++ {
+		hdr := &zip.FileHeader{Name: fmt.Sprintf("dir%d/file%d", i%100, i), Method: zip.Store}
+		hdr.SetMode(0666)
+		_, err := zw.CreateHeader(hdr)
+		require.NoError(b, err)
+	}
+	require.NoError(b, zw.Close())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		e, err := NewExtractor(f.Name(), b.TempDir(), WithExtractorAssumeCleanTarget(assume))
+		require.NoError(b, err)
+		require.NoError(b, e.Extract(context.Background()))
+		require.NoError(b, e.Close())
+	}
+}
+
+func BenchmarkExtractRemoveFirst(b *testing.B) {
+	benchmarkExtractAssumeCleanTarget(b, false)
+}
+
+func BenchmarkExtractAssumeCleanTarget(b *testing.B) {
+	benchmarkExtractAssumeCleanTarget(b, true)
+}
+
+func BenchmarkExtractDeepParents(b *testing.B) {
+	const entries = 10000
+
+	f, err := os.Create(filepath.Join(b.TempDir(), "deep.zip"))
+	require.NoError(b, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for i := 0; i < entries; i++ {
+		hdr := &zip.FileHeader{Name: fmt.Sprintf("a/b/c/d/e/f/g/dir%d/file%d", i%10, i), Method: zip.Store}
+		hdr.SetMode(0666)
+		_, err := zw.CreateHeader(hdr)
+		require.NoError(b, err)
+	}
+	require.NoError(b, zw.Close())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		e, err := NewExtractor(f.Name(), b.TempDir())
+		require.NoError(b, err)
+		require.NoError(b, e.Extract(context.Background()))
+		require.NoError(b, e.Close())
+	}
 }
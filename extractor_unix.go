@@ -1,10 +1,13 @@
+//go:build !windows
 // +build !windows
 
 package fastzip
 
 import (
+	"math"
 	"os"
 	"runtime"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -20,7 +23,7 @@ func lchmod(name string, mode os.FileMode) error {
 		flags = unix.AT_SYMLINK_NOFOLLOW
 	}
 
-	err := unix.Fchmodat(unix.AT_FDCWD, name, uint32(mode), flags)
+	err := unix.Fchmodat(unix.AT_FDCWD, name, syscallMode(mode), flags)
 	if err != nil {
 		return &os.PathError{Op: "lchmod", Path: name, Err: err}
 	}
@@ -28,12 +31,28 @@ func lchmod(name string, mode os.FileMode) error {
 	return nil
 }
 
+// syscallMode returns the unix mode bits of mode, which for the setuid, setgid
+// and sticky bits differ from those of os.FileMode.
+func syscallMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	return m
+}
+
 func lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error {
-	at := unix.NsecToTimeval(atime.UnixNano())
-	mt := unix.NsecToTimeval(mtime.UnixNano())
-	tv := [2]unix.Timeval{at, mt}
+	at := unix.NsecToTimespec(atime.UnixNano())
+	mt := unix.NsecToTimespec(mtime.UnixNano())
+	ts := [2]unix.Timespec{at, mt}
 
-	err := unix.Lutimes(name, tv[:])
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, name, ts[:], unix.AT_SYMLINK_NOFOLLOW)
 	if err != nil {
 		return &os.PathError{Op: "lchtimes", Path: name, Err: err}
 	}
@@ -41,6 +60,51 @@ func lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error {
 	return nil
 }
 
+// lchctime is a no-op, as creation times cannot be set on unix.
+func lchctime(name string, mode os.FileMode, ctime time.Time) error {
+	return nil
+}
+
 func lchown(name string, uid, gid int) error {
 	return os.Lchown(name, uid, gid)
 }
+
+// copyOwnership sets the owner of name to that of fi, ignoring any error.
+func copyOwnership(name string, fi os.FileInfo) {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(name, int(stat.Uid), int(stat.Gid))
+	}
+}
+
+func syncDir(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// setDOSAttributes is a no-op, as DOS attributes are only supported on
+// Windows.
+func setDOSAttributes(name string, mode os.FileMode, attrs uint32) error {
+	return nil
+}
+
+// defaultMaxOpenFiles returns half of the soft limit on open files, leaving
+// the rest for the archive and the rest of the process, or 0 if there's no
+// limit.
+func defaultMaxOpenFiles() int {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0
+	}
+
+	// an unlimited soft limit converts to a negative value
+	n := int64(rlim.Cur) / 2
+	if n <= 0 || n > math.MaxInt32 {
+		return 0
+	}
+	return int(n)
+}
@@ -1,3 +1,4 @@
+//go:build windows
 // +build windows
 
 package fastzip
@@ -5,6 +6,8 @@ package fastzip
 import (
 	"os"
 	"time"
+
+	"golang.org/x/sys/windows"
 )
 
 func lchmod(name string, mode os.FileMode) error {
@@ -26,3 +29,62 @@ func lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error {
 func lchown(name string, uid, gid int) error {
 	return nil
 }
+
+// copyOwnership is a no-op, as ownership is not preserved on Windows.
+func copyOwnership(name string, fi os.FileInfo) {}
+
+func lchctime(name string, mode os.FileMode, ctime time.Time) error {
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	pathp, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return &os.PathError{Op: "lchctime", Path: name, Err: err}
+	}
+
+	h, err := windows.CreateFile(pathp, windows.FILE_WRITE_ATTRIBUTES, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return &os.PathError{Op: "lchctime", Path: name, Err: err}
+	}
+	defer windows.CloseHandle(h)
+
+	ft := windows.NsecToFiletime(ctime.UnixNano())
+	if err := windows.SetFileTime(h, &ft, nil, nil); err != nil {
+		return &os.PathError{Op: "lchctime", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// syncDir is a no-op, as directories cannot be flushed on Windows.
+func syncDir(name string) error {
+	return nil
+}
+
+func setDOSAttributes(name string, mode os.FileMode, attrs uint32) error {
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	pathp, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return &os.PathError{Op: "setattributes", Path: name, Err: err}
+	}
+
+	attrs &= dosAttributeMask
+	if attrs == 0 {
+		attrs = windows.FILE_ATTRIBUTE_NORMAL
+	}
+
+	if err := windows.SetFileAttributes(pathp, attrs); err != nil {
+		return &os.PathError{Op: "setattributes", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// defaultMaxOpenFiles returns 0, as there's no limit on open files.
+func defaultMaxOpenFiles() int {
+	return 0
+}
@@ -0,0 +1,53 @@
+//go:build windows
+// +build windows
+
+package fastzip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/windows"
+)
+
+func TestExtractorWithRestoreDOSAttributes(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "hidden")
+	require.NoError(t, os.WriteFile(name, []byte("hidden"), 0666))
+
+	pathp, err := windows.UTF16PtrFromString(name)
+	require.NoError(t, err)
+	require.NoError(t, windows.SetFileAttributes(pathp, windows.FILE_ATTRIBUTE_HIDDEN))
+
+	fi, err := os.Lstat(name)
+	require.NoError(t, err)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir)
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), map[string]os.FileInfo{name: fi}))
+	require.NoError(t, a.Close())
+
+	for _, restore := range []bool{true, false} {
+		chroot := t.TempDir()
+		e, err := NewExtractor(f.Name(), chroot, WithExtractorRestoreDOSAttributes(restore))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		pathp, err := windows.UTF16PtrFromString(filepath.Join(chroot, "hidden"))
+		require.NoError(t, err)
+
+		attrs, err := windows.GetFileAttributes(pathp)
+		require.NoError(t, err)
+		assert.Equal(t, restore, attrs&windows.FILE_ATTRIBUTE_HIDDEN != 0)
+	}
+}
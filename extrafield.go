@@ -0,0 +1,92 @@
+package fastzip
+
+import (
+	"time"
+
+	"github.com/saracen/zipextra"
+)
+
+const (
+	// extraFieldPKWAREUnix is the PKWARE Unix extra field.
+	extraFieldPKWAREUnix uint16 = 0x000d
+
+	// extraFieldInfoZIPUnix is the original Info-ZIP Unix extra field,
+	// superseded by zipextra.ExtraFieldUnixN.
+	extraFieldInfoZIPUnix uint16 = 0x5855
+)
+
+// pkwareUnix is the PKWARE Unix extra field. For hard and symbolic links, data
+// holds the name of the linked to file.
+type pkwareUnix struct {
+	atime time.Time
+	mtime time.Time
+	uid   int
+	gid   int
+	data  []byte
+}
+
+func parsePKWAREUnix(ef zipextra.ExtraField) (field pkwareUnix, err error) {
+	buf := zipextra.NewBuffer(ef)
+	if buf.Available() < 12 {
+		return field, zipextra.ErrInvalidExtraFieldFormat
+	}
+
+	field.atime = time.Unix(int64(buf.Read32()), 0)
+	field.mtime = time.Unix(int64(buf.Read32()), 0)
+	field.uid = int(buf.Read16())
+	field.gid = int(buf.Read16())
+	field.data = buf.ReadBytes(buf.Available())
+
+	return field, nil
+}
+
+// hardlinkTarget returns the name of the file a hard link entry links to, or
+// an empty string if the entry isn't a hard link.
+func hardlinkTarget(extra []byte) (string, error) {
+	fields, err := zipextra.Parse(extra)
+	if err != nil {
+		return "", err
+	}
+
+	ef, ok := fields[extraFieldPKWAREUnix]
+	if !ok {
+		return "", nil
+	}
+
+	field, err := parsePKWAREUnix(ef)
+	if err != nil {
+		return "", err
+	}
+
+	return string(field.data), nil
+}
+
+// ownership returns the uid and gid stored in the extra fields, preferring the
+// Info-ZIP New Unix field and falling back to the older Info-ZIP Unix and
+// PKWARE Unix fields. The Info-ZIP Unix field only holds the uid and gid in the
+// local file header, so it is only used if they're present.
+func ownership(fields map[uint16]zipextra.ExtraField) (uid, gid int, ok bool, err error) {
+	if ef, ok := fields[zipextra.ExtraFieldUnixN]; ok {
+		unix, err := ef.InfoZIPNewUnix()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		return int(unix.Uid.Int64()), int(unix.Gid.Int64()), true, nil
+	}
+
+	if ef, ok := fields[extraFieldInfoZIPUnix]; ok && len(ef) >= 12 {
+		buf := zipextra.NewBuffer(ef)
+		buf.Skip(8) // atime and mtime
+		return int(buf.Read16()), int(buf.Read16()), true, nil
+	}
+
+	if ef, ok := fields[extraFieldPKWAREUnix]; ok {
+		field, err := parsePKWAREUnix(ef)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		return field.uid, field.gid, true, nil
+	}
+
+	return 0, 0, false, nil
+}
@@ -0,0 +1,39 @@
+package fastzip
+
+import (
+	"github.com/saracen/zipextra"
+)
+
+// ExtraFieldFileFlags is the ID of the extra field fastzip uses to store file
+// flags, such as those set by chattr on Linux.
+//
+// The field's data is a version (1 byte, currently 1), followed by the flags
+// (4 bytes, little-endian) as returned by the FS_IOC_GETFLAGS ioctl.
+const ExtraFieldFileFlags uint16 = 0x6c66
+
+const fileFlagsVersion = 1
+
+// encodeFileFlags encodes file flags as an extra field.
+func encodeFileFlags(flags uint32) []byte {
+	if flags == 0 {
+		return nil
+	}
+
+	buf := zipextra.NewBuffer([]byte{})
+	defer buf.WriteHeader(ExtraFieldFileFlags)()
+
+	buf.Write8(fileFlagsVersion)
+	buf.Write32(flags)
+
+	return buf.Bytes()
+}
+
+// decodeFileFlags decodes file flags from an extra field.
+func decodeFileFlags(ef zipextra.ExtraField) (uint32, error) {
+	buf := zipextra.NewBuffer(ef)
+	if buf.Available() < 5 || buf.Read8() != fileFlagsVersion {
+		return 0, zipextra.ErrInvalidExtraFieldFormat
+	}
+
+	return buf.Read32(), nil
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package fastzip
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// userModifiableFileFlags are the flags that can be changed with
+// FS_IOC_SETFLAGS (FS_FL_USER_MODIFIABLE). Other flags, such as FS_EXTENT_FL,
+// describe how a filesystem stores the file and are not archived.
+const userModifiableFileFlags = 0x000380ff
+
+func getFileFlags(path string) (uint32, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err == unix.ENOTTY || err == unix.ENOTSUP {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, &os.PathError{Op: "getflags", Path: path, Err: err}
+	}
+
+	return flags & userModifiableFileFlags, nil
+}
+
+func setFileFlags(path string, flags uint32) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+
+	current, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err == unix.ENOTTY || err == unix.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "getflags", Path: path, Err: err}
+	}
+
+	flags = current&^userModifiableFileFlags | flags&userModifiableFileFlags
+	if flags == current {
+		return nil
+	}
+
+	if err := unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags)); err != nil {
+		return &os.PathError{Op: "setflags", Path: path, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fastzip
+
+func getFileFlags(path string) (uint32, error) {
+	return 0, nil
+}
+
+func setFileFlags(path string, flags uint32) error {
+	return nil
+}
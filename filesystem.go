@@ -0,0 +1,122 @@
+package fastzip
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Filesystem is the filesystem an Extractor extracts to. The paths provided
+// are absolute and have already been checked to be within the chroot.
+type Filesystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	Lstat(name string) (os.FileInfo, error)
+	Symlink(oldname, newname string) error
+	Link(oldname, newname string) error
+
+	// Lchmod, Lchtimes, Lchown and Lsetxattr do not follow symlinks. The
+	// mode provided to Lchtimes is the file's mode, for implementations that
+	// need to handle symlinks differently.
+	Lchmod(name string, mode os.FileMode) error
+	Lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error
+	Lchown(name string, uid, gid int) error
+	Lsetxattr(name, attr string, value []byte) error
+}
+
+// File is a file opened for writing by a Filesystem.
+type File interface {
+	io.WriteCloser
+}
+
+// creationTimer is implemented by filesystems that support setting a file's
+// creation time.
+type creationTimer interface {
+	lchctime(name string, mode os.FileMode, ctime time.Time) error
+}
+
+// fileFlagger is implemented by filesystems that support setting file flags.
+type fileFlagger interface {
+	setFileFlags(name string, mode os.FileMode, flags uint32) error
+}
+
+// dosAttributer is implemented by filesystems that support setting DOS file
+// attributes.
+type dosAttributer interface {
+	setDOSAttributes(name string, mode os.FileMode, attrs uint32) error
+}
+
+// dirSyncer is implemented by filesystems that support flushing a directory
+// to stable storage.
+type dirSyncer interface {
+	syncDir(name string) error
+}
+
+// osFilesystem is the operating system's filesystem.
+type osFilesystem struct{}
+
+func (osFilesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFilesystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (osFilesystem) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (osFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFilesystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFilesystem) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (osFilesystem) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFilesystem) Lchmod(name string, mode os.FileMode) error {
+	return lchmod(name, mode)
+}
+
+func (osFilesystem) Lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error {
+	return lchtimes(name, mode, atime, mtime)
+}
+
+func (osFilesystem) lchctime(name string, mode os.FileMode, ctime time.Time) error {
+	return lchctime(name, mode, ctime)
+}
+
+func (osFilesystem) setDOSAttributes(name string, mode os.FileMode, attrs uint32) error {
+	return setDOSAttributes(name, mode, attrs)
+}
+
+func (osFilesystem) syncDir(name string) error {
+	return syncDir(name)
+}
+
+func (osFilesystem) setFileFlags(name string, mode os.FileMode, flags uint32) error {
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	return setFileFlags(name, flags)
+}
+
+func (osFilesystem) Lchown(name string, uid, gid int) error {
+	return lchown(name, uid, gid)
+}
+
+func (osFilesystem) Lsetxattr(name, attr string, value []byte) error {
+	return setXattr(name, xattr{name: attr, value: value})
+}
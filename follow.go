@@ -0,0 +1,156 @@
+package fastzip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrSymlinkCycle         = errors.New("symlink cycle")
+	ErrSymlinkOutsideChroot = errors.New("symlink target is outside of the chroot")
+)
+
+// followSymlinks replaces each symlink with its target, as set by
+// WithArchiverFollowSymlinks. A symlink to a directory is replaced by the
+// directory and everything within it, which is walked and archived beneath the
+// symlink's name. The entries are returned in name order.
+func (a *Archiver) followSymlinks(entries []archiveEntry) ([]archiveEntry, error) {
+	var root string
+	if a.options.followSymlinksWithinChroot {
+		var err error
+		if root, err = filepath.EvalSymlinks(a.chroot); err != nil {
+			return nil, err
+		}
+	}
+
+	followed := make([]archiveEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.path == "" || entry.fi.Mode()&os.ModeSymlink == 0 {
+			followed = append(followed, entry)
+			continue
+		}
+
+		ancestors, err := dirAncestors(filepath.Dir(entry.path))
+		if err != nil {
+			return nil, err
+		}
+
+		if followed, err = a.follow(followed, entry, root, ancestors); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(followed, func(i, j int) bool {
+		return followed[i].name < followed[j].name
+	})
+
+	return followed, nil
+}
+
+// follow appends the target of the symlink entry to entries. ancestors are the
+// directories that the symlink is within, including those reached by
+// following other symlinks, and a target that is one of them is a cycle.
+func (a *Archiver) follow(entries []archiveEntry, entry archiveEntry, root string, ancestors []os.FileInfo) ([]archiveEntry, error) {
+	fi, err := os.Stat(entry.path)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, fmt.Errorf("%s: %w", entry.path, ErrSymlinkCycle)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := filepath.EvalSymlinks(entry.path)
+	if err != nil {
+		return nil, err
+	}
+	if root != "" && !withinDir(root, target) {
+		return nil, fmt.Errorf("%s links to %s: %w", entry.path, target, ErrSymlinkOutsideChroot)
+	}
+
+	entry.path, entry.fi = target, fi
+	entries = append(entries, entry)
+	if !fi.IsDir() {
+		return entries, nil
+	}
+
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor, fi) {
+			return nil, fmt.Errorf("%s links to %s, which contains it: %w", entry.path, target, ErrSymlinkCycle)
+		}
+	}
+
+	return a.followDir(entries, entry.name, target, root, append(ancestors[:len(ancestors):len(ancestors)], fi))
+}
+
+// followDir appends the contents of dir to entries, named beneath name,
+// following any symlinks within it.
+func (a *Archiver) followDir(entries []archiveEntry, name, dir, root string, ancestors []os.FileInfo) ([]archiveEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, de := range dirEntries {
+		path := filepath.Join(dir, de.Name())
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		child := archiveEntry{name: filepath.Join(name, de.Name()), path: path, fi: fi}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			entries, err = a.follow(entries, child, root, ancestors)
+
+		case fi.IsDir():
+			entries = append(entries, child)
+			entries, err = a.followDir(entries, child.name, path, root, append(ancestors[:len(ancestors):len(ancestors)], fi))
+
+		default:
+			entries = append(entries, child)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// dirAncestors returns dir and each of its parent directories.
+func dirAncestors(dir string) ([]os.FileInfo, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ancestors []os.FileInfo
+	for {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		ancestors = append(ancestors, fi)
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ancestors, nil
+		}
+		dir = parent
+	}
+}
+
+// withinDir returns whether path is dir or is within it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -6,8 +6,10 @@ require (
 	github.com/klauspost/compress v1.16.5
 	github.com/saracen/zipextra v0.0.0-20220303013732-0187cb0159ea
 	github.com/stretchr/testify v1.8.3
+	golang.org/x/crypto v0.9.0
 	golang.org/x/sync v0.2.0
 	golang.org/x/sys v0.8.0
+	golang.org/x/text v0.9.0
 )
 
 require (
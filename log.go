@@ -0,0 +1,173 @@
+package fastzip
+
+import (
+	"github.com/klauspost/compress/zip"
+)
+
+// LogEvent is an event logged by the function set by WithExtractorLogger.
+type LogEvent string
+
+const (
+	// LogEntryStart is logged before an entry is extracted.
+	LogEntryStart LogEvent = "entry start"
+
+	// LogEntryDone is logged once an entry has been extracted, or skipped.
+	LogEntryDone LogEvent = "entry done"
+
+	// LogEntrySkip is logged when an entry is skipped, with the reason.
+	LogEntrySkip LogEvent = "entry skip"
+
+	// LogEntryError is logged when an entry fails to be extracted, and
+	// whether extraction continues depends on the error handling options.
+	LogEntryError LogEvent = "entry error"
+
+	// LogMetadataApplied is logged once an entry's metadata has been
+	// applied.
+	LogMetadataApplied LogEvent = "metadata applied"
+)
+
+// Reasons an entry is skipped, logged in the "reason" field of LogEntrySkip.
+const (
+	skipOverwrite       = "overwrite"
+	skipSymlink         = "symlink"
+	skipPathLength      = "path length"
+	skipUnsupportedType = "unsupported type"
+)
+
+// log calls the logger, if set, with fields built from key/value pairs.
+func (e *Extractor) log(event LogEvent, file *zip.File, keyvals ...interface{}) {
+	complete := event == LogEntryDone || event == LogEntryError
+	if e.options.logger == nil {
+		// the entry is still completed, so that the events of other
+		// callbacks, such as progress, are emitted
+		if complete {
+			e.complete(file)
+		}
+		return
+	}
+
+	fields := make(map[string]interface{}, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if key, ok := keyvals[i].(string); ok {
+			fields[key] = keyvals[i+1]
+		}
+	}
+
+	// paths are logged as they'll be once extracted, rather than within the
+	// temporary directory of an atomic extraction
+	if path, ok := fields["path"].(string); ok {
+		fields["path"] = e.chrootPath(path)
+	}
+
+	e.emit(file, complete, func() {
+		e.options.logger(event, file.Name, fields)
+	})
+}
+
+// orderedEvents buffers the events of entries, so that they're emitted in the
+// order of the entries within the archive rather than the order in which
+// they're extracted. The events of an entry are emitted once it, and every
+// entry before it, is complete.
+type orderedEvents struct {
+	files    []*zip.File
+	index    map[*zip.File]int
+	pending  [][]func()
+	complete []bool
+	next     int
+}
+
+func newOrderedEvents(files []*zip.File) *orderedEvents {
+	o := &orderedEvents{
+		files:    make([]*zip.File, len(files)),
+		index:    make(map[*zip.File]int, len(files)),
+		pending:  make([][]func(), len(files)),
+		complete: make([]bool, len(files)),
+	}
+	for i, file := range files {
+		if file.Mode()&irregularModes == 0 {
+			o.files[i] = file
+			o.index[file] = i
+		}
+	}
+	return o
+}
+
+// emit calls fn, which calls a user's callback for an event of file, or when
+// WithExtractorOrderedEvents is enabled, buffers it until the events before it
+// have been emitted. complete is whether file has no further events. Events of
+// entries that have already been emitted, such as the metadata of directories
+// being applied, are emitted immediately.
+func (e *Extractor) emit(file *zip.File, complete bool, fn func()) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	o := e.ordered
+	if o == nil {
+		fn()
+		return
+	}
+
+	i, ok := o.index[file]
+	if !ok {
+		fn()
+		return
+	}
+
+	o.pending[i] = append(o.pending[i], fn)
+	if !complete {
+		return
+	}
+	o.complete[i] = true
+
+	for o.next < len(o.complete) && o.complete[o.next] {
+		o.flush(o.next)
+		o.next++
+	}
+}
+
+// complete marks file as having no further events.
+func (e *Extractor) complete(file *zip.File) {
+	e.emit(file, true, func() {})
+}
+
+// flushEvents emits every buffered event, in order, such as those of entries
+// that were never completed because extraction failed.
+func (e *Extractor) flushEvents() {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if e.ordered == nil {
+		return
+	}
+	for i := e.ordered.next; i < len(e.ordered.pending); i++ {
+		e.ordered.flush(i)
+	}
+	e.ordered = nil
+}
+
+// flush emits the buffered events of the entry at i, after which any further
+// events of the entry are emitted immediately.
+func (o *orderedEvents) flush(i int) {
+	for _, fn := range o.pending[i] {
+		fn()
+	}
+	o.pending[i] = nil
+
+	delete(o.index, o.files[i])
+	o.files[i] = nil
+}
+
+// logEntry logs the start of an entry's extraction, calls fn to extract it,
+// and then logs whether it succeeded.
+func (e *Extractor) logEntry(file *zip.File, path string, fn func() error) error {
+	e.log(LogEntryStart, file, "path", path, "mode", file.Mode())
+
+	err := fn()
+	if err != nil {
+		e.log(LogEntryError, file, "path", path, "error", err)
+	} else {
+		e.log(LogEntryDone, file, "path", path)
+	}
+
+	return err
+}
@@ -0,0 +1,74 @@
+package fastzip
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ExtractFile extracts the archive filename to chroot, closing the extractor
+// once done, and returns the statistics of the extraction. It's the equivalent
+// of creating an extractor with NewExtractor, calling Extract and then Close.
+func ExtractFile(filename, chroot string, opts ...ExtractorOption) (ExtractorStats, error) {
+	e, err := NewExtractor(filename, chroot, opts...)
+	if err != nil {
+		return ExtractorStats{}, err
+	}
+
+	return extractAndClose(e)
+}
+
+func extractAndClose(e *Extractor) (stats ExtractorStats, err error) {
+	defer dclose(e, &err)
+
+	err = e.Extract(context.Background())
+	return e.Stats(), err
+}
+
+// ArchiveDir archives the directory src, and everything within it, to a new
+// archive dest. If dest is within src, it's not archived itself.
+func ArchiveDir(dest, src string, opts ...ArchiverOption) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	return archiveDirTo(f, dest, src, opts)
+}
+
+func archiveDirTo(w io.WriteCloser, dest, src string, opts []ArchiverOption) (err error) {
+	defer dclose(w, &err)
+
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]os.FileInfo)
+	err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if abs != dest {
+			files[path] = fi
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	a, err := NewArchiver(w, src, opts...)
+	if err != nil {
+		return err
+	}
+	defer dclose(a, &err)
+
+	return a.Archive(context.Background(), files)
+}
@@ -0,0 +1,184 @@
+package fastzip
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// PlanAction is the action extraction would take for an entry.
+type PlanAction int
+
+const (
+	// PlanCreate creates a new file, directory or symlink.
+	PlanCreate PlanAction = iota
+
+	// PlanReplace removes an existing file or symlink and replaces it.
+	PlanReplace
+
+	// PlanUpdate updates the metadata of an existing directory.
+	PlanUpdate
+
+	// PlanSkip skips the entry, because of the overwrite, symlink or path
+	// length policy.
+	PlanSkip
+)
+
+// PlannedEntry is an entry that would be extracted and the action taken.
+type PlannedEntry struct {
+	// Name is the entry's name within the archive.
+	Name string
+
+	// Path is the path the entry would be extracted to.
+	Path string
+
+	// Mode is the entry's mode, including its type.
+	Mode os.FileMode
+
+	// Target is the target of symlinks, after the symlink policy has been
+	// applied, and the path hard links link to. It is empty for other
+	// entries.
+	Target string
+
+	Action PlanAction
+}
+
+// Plan returns the entries that Extract would extract, and the action taken
+// for each, without modifying the filesystem. All of the checks performed by
+// Extract, such as the extraction limits, the chroot and the symlink and
+// overwrite policies, are applied, and Plan returns the same error that
+// extraction would fail with before writing anything.
+//
+// Existing files are checked as they are when Plan is called. Plan cannot be
+// called whilst an extraction or Verify is in progress, and returns
+// ErrExtractionInProgress if it is.
+func (e *Extractor) Plan(ctx context.Context) ([]PlannedEntry, error) {
+	return e.PlanFilter(ctx, nil)
+}
+
+// PlanFilter is like Plan, but only for the entries that ExtractFilter would
+// extract with the filter provided.
+func (e *Extractor) PlanFilter(ctx context.Context, filter func(*zip.File) bool) ([]PlannedEntry, error) {
+	if !e.begin() {
+		return nil, ErrExtractionInProgress
+	}
+	defer e.end()
+
+	files, err := e.prepare(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	planned := make([]PlannedEntry, 0, len(files))
+	for _, file := range files {
+		if file.Mode()&irregularModes != 0 {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		path, err := e.destination(file)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := PlannedEntry{Name: file.Name, Path: path, Mode: file.Mode()}
+
+		switch {
+		case e.pathTooLong(path):
+			entry.Action = PlanSkip
+
+		case file.Mode()&os.ModeSymlink != 0 && e.options.noSymlinksPolicy == NoSymlinksSkip:
+			entry.Action = PlanSkip
+
+		case file.Mode()&os.ModeSymlink != 0 && e.options.noSymlinksPolicy == NoSymlinksError:
+			return nil, fmt.Errorf("%s: %w", file.Name, ErrSymlinkNotAllowed)
+
+		case file.Mode()&os.ModeSymlink != 0:
+			var skip bool
+			entry.Target, skip, err = e.symlinkTarget(path, file)
+			if err != nil {
+				return nil, err
+			}
+			if skip {
+				entry.Action = PlanSkip
+				break
+			}
+			entry.Action, err = e.overwriteAction(path)
+
+		case file.Mode().IsDir():
+			_, err = e.options.fs.Lstat(path)
+			switch {
+			case err == nil:
+				entry.Action = PlanUpdate
+			case os.IsNotExist(err):
+				err = nil
+			}
+
+		default:
+			if e.options.preserveHardlinks {
+				target, err := e.hardlinkPath(file)
+				if err != nil {
+					return nil, err
+				}
+				if target != path {
+					entry.Target = target
+				}
+			}
+			entry.Action, err = e.overwriteAction(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		planned = append(planned, entry)
+	}
+
+	return planned, nil
+}
+
+// SymlinkEntry is a symlink within the archive.
+type SymlinkEntry struct {
+	// Name is the symlink's name within the archive.
+	Name string
+
+	// Target is the symlink's target, as stored in the archive.
+	Target string
+
+	// OutsideChroot is whether the target resolves outside of the chroot, in
+	// which case the symlink policy is applied when it's extracted.
+	OutsideChroot bool
+}
+
+// Symlinks returns the symlinks within the archive and their targets, without
+// modifying the filesystem.
+func (e *Extractor) Symlinks() ([]SymlinkEntry, error) {
+	var symlinks []SymlinkEntry
+	for _, file := range e.zr.File {
+		if file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		path, err := e.destination(file)
+		if err != nil {
+			return nil, err
+		}
+
+		target, err := e.readSymlink(file)
+		if err != nil {
+			return nil, err
+		}
+
+		symlinks = append(symlinks, SymlinkEntry{
+			Name:          file.Name,
+			Target:        target,
+			OutsideChroot: !e.withinChroot(resolveSymlink(path, target)),
+		})
+	}
+
+	return symlinks, nil
+}
@@ -0,0 +1,78 @@
+package fastzip
+
+import (
+	"io"
+	"time"
+)
+
+// EntryProfile is the time spent extracting an entry, recorded when
+// WithExtractorProfiling is enabled.
+type EntryProfile struct {
+	// Decompress is the time spent opening, reading and decompressing the
+	// entry's data.
+	Decompress time.Duration
+
+	// Write is the time spent writing the entry's data, including syncing it
+	// when WithExtractorFsync is enabled.
+	Write time.Duration
+
+	// Metadata is the time spent applying the entry's metadata, such as its
+	// times, ownership and mode.
+	Metadata time.Duration
+}
+
+// Profile returns the time spent extracting each entry, by name, when
+// WithExtractorProfiling is enabled. Entries that were skipped, or haven't yet
+// been extracted, are not included.
+func (e *Extractor) Profile() map[string]EntryProfile {
+	e.profileMu.Lock()
+	defer e.profileMu.Unlock()
+
+	profiles := make(map[string]EntryProfile, len(e.profiles))
+	for name, profile := range e.profiles {
+		profiles[name] = profile
+	}
+	return profiles
+}
+
+// addProfile adds the times of p to those recorded for the entry name.
+func (e *Extractor) addProfile(name string, p EntryProfile) {
+	e.profileMu.Lock()
+	defer e.profileMu.Unlock()
+
+	if e.profiles == nil {
+		e.profiles = make(map[string]EntryProfile)
+	}
+
+	profile := e.profiles[name]
+	profile.Decompress += p.Decompress
+	profile.Write += p.Write
+	profile.Metadata += p.Metadata
+	e.profiles[name] = profile
+}
+
+// timedReader adds the time spent reading to d.
+type timedReader struct {
+	r io.Reader
+	d *time.Duration
+}
+
+func (r timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.r.Read(p)
+	*r.d += time.Since(start)
+	return n, err
+}
+
+// timedWriter adds the time spent writing to d.
+type timedWriter struct {
+	w io.Writer
+	d *time.Duration
+}
+
+func (w timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.w.Write(p)
+	*w.d += time.Since(start)
+	return n, err
+}
@@ -0,0 +1,66 @@
+package fastzip
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the number of bytes per second. The
+// bucket holds at most a second's worth of tokens and starts empty.
+type rateLimiter struct {
+	m      sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSecond), last: time.Now()}
+}
+
+// wait waits until n bytes can be written, or ctx is cancelled.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.m.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	// tokens are reserved even if they're not yet available, so that
+	// concurrent writers wait their turn
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.m.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateWriter limits the rate it writes to the underlying writer.
+type rateWriter struct {
+	w   io.Writer
+	l   *rateLimiter
+	ctx context.Context
+}
+
+func (w rateWriter) Write(p []byte) (int, error) {
+	if err := w.l.wait(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
@@ -2,6 +2,7 @@ package fastzip
 
 import (
 	"bufio"
+	"compress/bzip2"
 	"io"
 	"sync"
 
@@ -92,6 +93,18 @@ func ZstdDecompressor() func(r io.Reader) io.ReadCloser {
 	}
 }
 
+// MethodBzip2 is the zip method ID of bzip2 compression.
+const MethodBzip2 uint16 = 12
+
+// Bzip2Decompressor returns a bzip2 zip.Decompressor, using the standard
+// library's decoder. There is no corresponding compressor, as the standard
+// library can only decompress bzip2.
+func Bzip2Decompressor() func(r io.Reader) io.ReadCloser {
+	return func(r io.Reader) io.ReadCloser {
+		return io.NopCloser(bzip2.NewReader(r))
+	}
+}
+
 func newFlateWriterPool(level int, newWriterFn func(w io.Writer, level int) (flater, error)) *sync.Pool {
 	pool := &sync.Pool{}
 	pool.New = func() interface{} {
@@ -0,0 +1,66 @@
+package fastzip
+
+import (
+	"io"
+)
+
+const sparseBlockSize = 4096
+
+// sparseFile is a file that can be written sparsely.
+type sparseFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+}
+
+// sparseWriter writes to a file, seeking past blocks of zeros instead of
+// writing them, creating holes.
+type sparseWriter struct {
+	f      sparseFile
+	offset int64
+	hole   bool
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := sparseBlockSize
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if isZero(p[:n]) {
+			if _, err := w.f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+			w.hole = true
+		} else {
+			if _, err := w.f.Write(p[:n]); err != nil {
+				return written, err
+			}
+			w.hole = false
+		}
+
+		w.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// finish extends the file to its full size if it ends with a hole.
+func (w *sparseWriter) finish() error {
+	if !w.hole {
+		return nil
+	}
+	return w.f.Truncate(w.offset)
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,490 @@
+package fastzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zip"
+)
+
+const (
+	splitSignature     = 0x08074b50
+	splitOnceSignature = 0x30304b50
+
+	// splitHeaderSlack is reserved in addition to each local file header's
+	// name and extra fields, for the fixed-size part of the header, the
+	// extended timestamp added by the zip writer and the data descriptor of
+	// the previous entry.
+	splitHeaderSlack = 30 + 9 + 24
+
+	minSplitSize = 64 * 1024
+)
+
+var ErrSplitSize = errors.New("split size must be between 64 KiB and 4 GiB")
+
+// NewArchiverSplit returns a new Archiver that writes a split archive, where
+// no file, or volume, exceeds size bytes. Volumes are named after filename,
+// using the Info-ZIP convention: for archive.zip, the volumes are archive.z01,
+// archive.z02 and so on, with the last, containing the central directory,
+// named archive.zip. Entries are split across volumes, but local file headers
+// and central directory records are never split.
+//
+// The archive is only complete once Close has been called, and can be
+// extracted with NewExtractorSplit.
+func NewArchiverSplit(filename, chroot string, size int64, opts ...ArchiverOption) (*Archiver, error) {
+	if size < minSplitSize || size > uint32max {
+		return nil, ErrSplitSize
+	}
+
+	w := &splitWriter{
+		filename: filename,
+		base:     strings.TrimSuffix(filename, filepath.Ext(filename)),
+		size:     size,
+	}
+	if err := w.next(); err != nil {
+		return nil, err
+	}
+
+	// the spanning signature precedes the first local file header
+	var sig [4]byte
+	binary.LittleEndian.PutUint32(sig[:], splitSignature)
+	if _, err := w.Write(sig[:]); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+
+	a, err := NewArchiver(w, chroot, append(opts, WithArchiverOffset(int64(len(sig))))...)
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	a.splitting = w
+	w.forceZip64 = a.options.forceZip64
+
+	return a, nil
+}
+
+// splitWriter writes to a sequence of volumes, each no larger than size.
+type splitWriter struct {
+	filename string
+	base     string
+	size     int64
+
+	f       *os.File
+	names   []string
+	starts  []int64 // the offset each volume starts at
+	written int64   // written to the current volume
+	total   int64   // written to all volumes
+
+	// capture holds what is written once the central directory is being
+	// written, so that it can be rewritten with disk numbers.
+	capture    *bytes.Buffer
+	forceZip64 bool
+}
+
+func volumeName(base string, disk int) string {
+	return fmt.Sprintf("%s.z%02d", base, disk+1)
+}
+
+func (w *splitWriter) next() error {
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			return err
+		}
+	}
+
+	name := volumeName(w.base, len(w.names))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	w.f = f
+	w.names = append(w.names, name)
+	w.starts = append(w.starts, w.total)
+	w.written = 0
+
+	return nil
+}
+
+// disk returns the number of the current volume.
+func (w *splitWriter) disk() uint32 {
+	return uint32(len(w.names) - 1)
+}
+
+// reserve starts a new volume if fewer than n bytes remain in the current
+// one.
+func (w *splitWriter) reserve(n int64) error {
+	if n > w.size {
+		return fmt.Errorf("%d byte record exceeds split size", n)
+	}
+	if w.written+n <= w.size {
+		return nil
+	}
+	return w.next()
+}
+
+func (w *splitWriter) Write(p []byte) (int, error) {
+	if w.capture != nil {
+		return w.capture.Write(p)
+	}
+
+	var written int
+	for len(p) > 0 {
+		if w.written == w.size {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+
+		n := int64(len(p))
+		if remaining := w.size - w.written; n > remaining {
+			n = remaining
+		}
+
+		m, err := w.f.Write(p[:n])
+		written += m
+		w.written += int64(m)
+		w.total += int64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[m:]
+	}
+
+	return written, nil
+}
+
+// reserveHeader ensures that the local file header for hdr is written to a
+// single volume of split archives.
+func (a *Archiver) reserveHeader(hdr *zip.FileHeader) error {
+	if a.splitting == nil {
+		return nil
+	}
+
+	// flush the zip writer so that the volume's size is up to date
+	if err := a.zw.Flush(); err != nil {
+		return err
+	}
+
+	return a.splitting.reserve(int64(splitHeaderSlack + len(hdr.Name) + len(hdr.Extra)))
+}
+
+// close closes the zip writer, capturing the central directory it writes, and
+// then writes the central directory with each record's disk number and
+// offset relative to that disk.
+func (w *splitWriter) close(zw *zip.Writer) (err error) {
+	defer func() {
+		if w.f != nil {
+			dclose(w.f, &err)
+		}
+	}()
+
+	if err := zw.Flush(); err != nil {
+		return err
+	}
+
+	start, captured, end, err := captureDirectory(zw, &w.capture, w.total)
+	if err != nil {
+		return err
+	}
+
+	dirStart := int64(end.offset) - start
+	if _, err := w.Write(captured[:dirStart]); err != nil {
+		return err
+	}
+	dir := captured[dirStart : dirStart+int64(end.size)]
+
+	end = directoryEnd{comment: end.comment, zip64: w.forceZip64}
+	for b := dir; len(b) > 0; {
+		n, err := directoryRecordLen(b)
+		if err != nil {
+			return err
+		}
+
+		r, err := readDirectoryRecord(b[:n])
+		if err != nil {
+			return err
+		}
+
+		// map the continuous offset the zip writer used to a disk
+		disk := sort.Search(len(w.starts), func(i int) bool { return w.starts[i] > int64(r.offset) }) - 1
+		r.disk, r.offset = uint32(disk), r.offset-uint64(w.starts[disk])
+
+		rec, err := writeDirectoryRecord(b[:n], r, w.forceZip64)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+
+		if err := w.reserve(int64(len(rec))); err != nil {
+			return err
+		}
+		if end.records == 0 {
+			end.dirDisk = w.disk()
+			end.offset = uint64(w.written)
+		}
+		if w.disk() != end.disk {
+			end.disk = w.disk()
+			end.diskRecords = 0
+		}
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+
+		end.records++
+		end.diskRecords++
+		end.size += uint64(len(rec))
+	}
+
+	if end.records == 0 {
+		end.dirDisk = w.disk()
+		end.offset = uint64(w.written)
+	}
+
+	// the end records are kept together on the last disk
+	if err := w.reserve(int64(directory64EndLen + directory64LocLen + directoryEndLen + len(end.comment))); err != nil {
+		return err
+	}
+	if w.disk() != end.disk {
+		end.disk = w.disk()
+		end.diskRecords = 0
+	}
+	if err := writeDirectoryEnd(w, end, uint64(w.written)); err != nil {
+		return err
+	}
+
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+
+	// an archive that fits within a single volume is marked as such
+	if len(w.names) == 1 {
+		if err := markSingleVolume(w.names[0]); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(w.names[len(w.names)-1], w.filename)
+}
+
+func markSingleVolume(name string) (err error) {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dclose(f, &err)
+
+	var sig [4]byte
+	binary.LittleEndian.PutUint32(sig[:], splitOnceSignature)
+	_, err = f.WriteAt(sig[:], 0)
+	return err
+}
+
+// NewExtractorSplit returns a new extractor for the split archive filename,
+// the last volume of the archive, such as one written by NewArchiverSplit. The
+// other volumes are expected alongside it, named using the Info-ZIP
+// convention: for archive.zip, the other volumes are archive.z01, archive.z02
+// and so on. Archives that are not split are extracted as with NewExtractor.
+func NewExtractorSplit(filename, chroot string, opts ...ExtractorOption) (*Extractor, error) {
+	last, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := last.Stat()
+	if err != nil {
+		last.Close()
+		return nil, err
+	}
+
+	end, _, err := readDirectoryEnd(last, fi.Size())
+	if err != nil {
+		last.Close()
+		return nil, err
+	}
+
+	if end.disk == 0 {
+		last.Close()
+		return NewExtractor(filename, chroot, opts...)
+	}
+
+	volumes := &multiReaderAt{}
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for disk := 0; disk < int(end.disk); disk++ {
+		f, err := os.Open(volumeName(base, disk))
+		if err == nil {
+			err = volumes.addFile(f)
+		}
+		if err != nil {
+			last.Close()
+			volumes.Close()
+			return nil, err
+		}
+	}
+	volumes.add(last, fi.Size())
+
+	e, err := newExtractorSplit(volumes, end, chroot, opts)
+	if err != nil {
+		volumes.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// newExtractorSplit reads the split archive as if its volumes were a single
+// archive, by appending a central directory with offsets relative to the
+// start of the first volume.
+func newExtractorSplit(volumes *multiReaderAt, end directoryEnd, chroot string, opts []ExtractorOption) (*Extractor, error) {
+	if int(end.dirDisk) >= len(volumes.starts) {
+		return nil, zip.ErrFormat
+	}
+
+	dir := make([]byte, end.size)
+	if _, err := volumes.ReadAt(dir, volumes.starts[end.dirDisk]+int64(end.offset)); err != nil {
+		return nil, err
+	}
+
+	size := volumes.size()
+
+	tail := new(bytes.Buffer)
+	for b := dir; len(b) > 0; {
+		n, err := directoryRecordLen(b)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := readDirectoryRecord(b[:n])
+		if err != nil {
+			return nil, err
+		}
+		if int(r.disk) >= len(volumes.starts) {
+			return nil, zip.ErrFormat
+		}
+		r.disk, r.offset = 0, uint64(volumes.starts[r.disk])+r.offset
+
+		rec, err := writeDirectoryRecord(b[:n], r, false)
+		if err != nil {
+			return nil, err
+		}
+		tail.Write(rec)
+		b = b[n:]
+	}
+
+	dirSize := uint64(tail.Len())
+	err := writeDirectoryEnd(tail, directoryEnd{
+		diskRecords: end.records,
+		records:     end.records,
+		size:        dirSize,
+		offset:      uint64(size),
+		comment:     end.comment,
+	}, uint64(size)+dirSize)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &multiReaderAt{}
+	r.starts = append(r.starts, volumes.starts...)
+	r.sizes = append(r.sizes, volumes.sizes...)
+	r.readers = append(r.readers, volumes.readers...)
+	r.add(bytes.NewReader(tail.Bytes()), int64(tail.Len()))
+
+	zr, err := zip.NewReader(r, r.size())
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := newExtractor(zr, volumes, chroot, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.zip64End = end.zip64
+
+	return e, nil
+}
+
+// multiReaderAt concatenates readers of known sizes.
+type multiReaderAt struct {
+	readers []io.ReaderAt
+	starts  []int64
+	sizes   []int64
+}
+
+func (r *multiReaderAt) add(ra io.ReaderAt, size int64) {
+	r.starts = append(r.starts, r.size())
+	r.sizes = append(r.sizes, size)
+	r.readers = append(r.readers, ra)
+}
+
+// addFile adds f, which is closed by Close even if it cannot be sized.
+func (r *multiReaderAt) addFile(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.add(f, fi.Size())
+
+	return nil
+}
+
+func (r *multiReaderAt) size() int64 {
+	if len(r.starts) == 0 {
+		return 0
+	}
+	return r.starts[len(r.starts)-1] + r.sizes[len(r.sizes)-1]
+}
+
+func (r *multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	i := sort.Search(len(r.starts), func(i int) bool { return r.starts[i] > off }) - 1
+	if off < 0 || i < 0 {
+		return 0, io.EOF
+	}
+
+	var read int
+	for ; i < len(r.readers) && len(p) > 0; i++ {
+		rel := off - r.starts[i]
+		n := int64(len(p))
+		if remaining := r.sizes[i] - rel; n > remaining {
+			n = remaining
+		}
+		if n <= 0 {
+			continue
+		}
+
+		m, err := r.readers[i].ReadAt(p[:n], rel)
+		read += m
+		off += int64(m)
+		p = p[m:]
+		if err != nil && !(err == io.EOF && int64(m) == n) {
+			return read, err
+		}
+	}
+
+	if len(p) > 0 {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Close closes the volumes.
+func (r *multiReaderAt) Close() error {
+	var err error
+	for _, ra := range r.readers {
+		if c, ok := ra.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
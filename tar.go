@@ -0,0 +1,137 @@
+package fastzip
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/saracen/zipextra"
+)
+
+// ArchiveTar archives the members of the tar stream read from r, preserving
+// their names, modes, modification times and ownership, so that a tar archive
+// can be converted without first extracting it. Regular files, directories and
+// symlinks are supported, and other members, including hard links, are handled
+// according to WithArchiverUnsupportedTypePolicy.
+//
+// As the stream is read sequentially, entries are written in the order they
+// appear and are not compressed concurrently. Parent directories that the
+// stream does not contain are not added. Patterns set by WithArchiverExcludes,
+// the time set by WithArchiverModifiedAfter, and the functions set by
+// WithArchiverNameFunc, WithArchiverMethodFunc, WithArchiverCommentFunc and
+// WithArchiverContentFunc, are used as they are by Archive. The chroot is not
+// used.
+func (a *Archiver) ArchiveTar(ctx context.Context, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := a.archiveTarMember(ctx, tr, th); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *Archiver) archiveTarMember(ctx context.Context, tr *tar.Reader, th *tar.Header) error {
+	switch th.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink:
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		return a.unsupported(th.Name)
+	}
+
+	name := path.Clean(th.Name)
+	if name == "." || name == "/" {
+		return nil
+	}
+
+	if a.options.nameFunc != nil {
+		renamed, err := a.options.nameFunc(name)
+		if err != nil {
+			return err
+		}
+		if renamed == "" {
+			return nil
+		}
+		name = path.Clean(renamed)
+	}
+
+	if !validName(name) {
+		return fmt.Errorf("%s is not a valid archive name", name)
+	}
+
+	if a.excluded(name) {
+		return nil
+	}
+
+	fi := th.FileInfo()
+	if fi.IsDir() && !a.options.storeEmptyDirs {
+		return nil
+	}
+
+	if !a.modifiedAfter(fi) {
+		return nil
+	}
+
+	hdr := &zip.FileHeader{}
+	fileInfoHeader(name, fi, hdr)
+	if a.options.deterministic {
+		hdr.Modified = a.options.modifiedEpoch
+	} else {
+		hdr.Extra = append(hdr.Extra, zipextra.NewInfoZIPNewUnix(big.NewInt(int64(th.Uid)), big.NewInt(int64(th.Gid))).Encode()...)
+		if a.options.storeAccessTime && !th.AccessTime.IsZero() {
+			hdr.Extra = append(hdr.Extra, zipextra.NewNTFS(zipextra.NTFSTimeAttribute{MTime: th.ModTime, ATime: th.AccessTime, CTime: th.ModTime}).Encode()...)
+		}
+	}
+	if a.options.commentFunc != nil {
+		hdr.Comment = a.options.commentFunc(name)
+	}
+	hdr.NonUTF8 = !a.options.utf8Names
+
+	if fi.Mode().IsRegular() && hdr.UncompressedSize64 > 0 {
+		var err error
+		if hdr.Method, err = a.method(name, fi); err != nil {
+			return err
+		}
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	w, err := a.createHeader(fi, hdr)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode().IsDir():
+	case fi.Mode()&os.ModeSymlink != 0:
+		_, err = io.WriteString(w, th.Linkname)
+	default:
+		var r io.Reader = tr
+		if a.options.contentFunc != nil {
+			if r, err = a.options.contentFunc(hdr.Name, tr); err != nil {
+				return err
+			}
+		}
+		_, err = io.Copy(countWriter{w, &a.written, ctx}, r)
+	}
+	incOnSuccess(&a.entries, err)
+	return err
+}
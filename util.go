@@ -32,3 +32,16 @@ func (w countWriter) Write(p []byte) (n int, err error) {
 	}
 	return n, err
 }
+
+// contextWriter stops writing once its context is cancelled.
+type contextWriter struct {
+	w   io.Writer
+	ctx context.Context
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
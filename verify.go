@@ -0,0 +1,88 @@
+package fastzip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/sync/errgroup"
+)
+
+// Verify reads and decompresses every file and symlink in the archive,
+// concurrently, to check that their data matches their stored CRC32, without
+// writing anything to the chroot. It is the equivalent of unzip -t.
+//
+// Verify returns the first error encountered, or when
+// WithExtractorContinueOnError is enabled, the errors of every entry that
+// failed as ExtractErrors. The uncompressed bytes read are reported by Stats
+// as BytesVerified. Verify cannot be called during an extraction, and returns
+// ErrExtractionInProgress if it is.
+func (e *Extractor) Verify(ctx context.Context) (err error) {
+	if !e.begin() {
+		return ErrExtractionInProgress
+	}
+	defer e.end()
+
+	atomic.StoreInt64(&e.verified, 0)
+
+	limiter := e.options.limiter
+	if limiter == nil {
+		limiter = make(chan struct{}, e.options.concurrency)
+	}
+
+	errs := &entryErrors{enabled: e.options.continueOnError, handler: e.options.errorHandler, handlerMu: &e.m}
+
+	wg, gctx := errgroup.WithContext(ctx)
+	defer func() {
+		if werr := wg.Wait(); werr != nil {
+			err = werr
+		}
+	}()
+
+	for _, file := range e.zr.File {
+		if file.Mode()&irregularModes != 0 || file.Mode().IsDir() {
+			continue
+		}
+
+		select {
+		case limiter <- struct{}{}:
+		case <-gctx.Done():
+			return gctx.Err()
+		}
+
+		file := file
+		wg.Go(func() error {
+			defer func() { <-limiter }()
+			return errs.record(file, e.verifyFile(gctx, file))
+		})
+	}
+
+	if err := wg.Wait(); err != nil {
+		return err
+	}
+
+	return errs.err()
+}
+
+// verifyFile reads a file's data, discarding it, and checks its checksum.
+func (e *Extractor) verifyFile(ctx context.Context, file *zip.File) (err error) {
+	r, err := e.openFile(file)
+	if err != nil {
+		return err
+	}
+	defer dclose(r, &err)
+
+	crc := crc32.NewIEEE()
+	_, err = io.Copy(countWriter{crc, &e.verified, ctx}, r)
+	if storesChecksum(file) && (err == nil || errors.Is(err, zip.ErrChecksum)) {
+		if sum := crc.Sum32(); sum != file.CRC32 {
+			return fmt.Errorf("%s checksum mismatch, expected %08x, got %08x: %w", file.Name, file.CRC32, sum, zip.ErrChecksum)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,88 @@
+package fastzip
+
+import (
+	"github.com/saracen/zipextra"
+)
+
+// ExtraFieldXattrs is the ID of the extra field fastzip uses to store
+// extended attributes.
+//
+// The field's data is a version (1 byte, currently 1), followed by each
+// attribute's name length (2 bytes), name, value length (2 bytes) and value.
+// Integers are little-endian.
+const ExtraFieldXattrs uint16 = 0x7861
+
+const xattrsVersion = 1
+
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// encodeXattrs encodes extended attributes as an extra field. Attributes that
+// would cause the field to exceed the maximum extra field size are omitted.
+func encodeXattrs(attrs []xattr) []byte {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	const maxSize = 0xffff
+
+	buf := zipextra.NewBuffer([]byte{})
+	defer buf.WriteHeader(ExtraFieldXattrs)()
+
+	size := 1
+	buf.Write8(xattrsVersion)
+	for _, attr := range attrs {
+		n := 2 + len(attr.name) + 2 + len(attr.value)
+		if size+n > maxSize {
+			continue
+		}
+		size += n
+
+		buf.Write16(uint16(len(attr.name)))
+		buf.WriteBytes([]byte(attr.name))
+		buf.Write16(uint16(len(attr.value)))
+		buf.WriteBytes(attr.value)
+	}
+
+	return buf.Bytes()
+}
+
+// decodeXattrs decodes extended attributes from an extra field.
+func decodeXattrs(ef zipextra.ExtraField) ([]xattr, error) {
+	buf := zipextra.NewBuffer(ef)
+	if buf.Available() < 1 || buf.Read8() != xattrsVersion {
+		return nil, zipextra.ErrInvalidExtraFieldFormat
+	}
+
+	var attrs []xattr
+	for buf.Available() > 0 {
+		name, ok := readXattrData(buf)
+		if !ok {
+			return nil, zipextra.ErrInvalidExtraFieldFormat
+		}
+
+		value, ok := readXattrData(buf)
+		if !ok {
+			return nil, zipextra.ErrInvalidExtraFieldFormat
+		}
+
+		attrs = append(attrs, xattr{name: string(name), value: value})
+	}
+
+	return attrs, nil
+}
+
+func readXattrData(buf *zipextra.Buffer) ([]byte, bool) {
+	if buf.Available() < 2 {
+		return nil, false
+	}
+
+	size := int(buf.Read16())
+	if buf.Available() < size {
+		return nil, false
+	}
+
+	return buf.ReadBytes(size), true
+}
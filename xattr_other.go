@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package fastzip
+
+func listXattrs(path string) ([]xattr, error) {
+	return nil, nil
+}
+
+func setXattr(path string, attr xattr) error {
+	return nil
+}
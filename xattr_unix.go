@@ -0,0 +1,57 @@
+//go:build linux || darwin || freebsd || netbsd
+// +build linux darwin freebsd netbsd
+
+package fastzip
+
+import (
+	"bytes"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func listXattrs(path string) ([]xattr, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	names := make([]byte, size)
+	if size, err = unix.Llistxattr(path, names); err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+	}
+
+	var attrs []xattr
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(path, string(name), value); err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+
+		attrs = append(attrs, xattr{name: string(name), value: value[:size]})
+	}
+
+	return attrs, nil
+}
+
+func setXattr(path string, attr xattr) error {
+	if err := unix.Lsetxattr(path, attr.name, attr.value, 0); err != nil {
+		return &os.PathError{Op: "lsetxattr", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package fastzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zip"
+)
+
+const (
+	directoryHeaderSignature = 0x02014b50
+	directoryHeaderLen       = 46
+	zip64ExtraID             = 0x0001
+	zip64Version             = 45
+)
+
+// directoryRecord is the sizes and location of a central directory record's
+// entry, with the values of the Zip64 extended information extra field used
+// in place of any that overflow.
+type directoryRecord struct {
+	usize  uint64
+	csize  uint64
+	offset uint64
+	disk   uint32
+}
+
+// directoryRecordLen returns the length of the central directory record at
+// the start of b.
+func directoryRecordLen(b []byte) (int, error) {
+	if len(b) < directoryHeaderLen || binary.LittleEndian.Uint32(b) != directoryHeaderSignature {
+		return 0, zip.ErrFormat
+	}
+
+	n := directoryHeaderLen +
+		int(binary.LittleEndian.Uint16(b[28:])) +
+		int(binary.LittleEndian.Uint16(b[30:])) +
+		int(binary.LittleEndian.Uint16(b[32:]))
+	if n > len(b) {
+		return 0, zip.ErrFormat
+	}
+
+	return n, nil
+}
+
+// directoryRecordFields splits a central directory record into its name,
+// extra fields and comment.
+func directoryRecordFields(rec []byte) (name, extra, comment []byte) {
+	n := int(binary.LittleEndian.Uint16(rec[28:]))
+	m := int(binary.LittleEndian.Uint16(rec[30:]))
+
+	b := rec[directoryHeaderLen:]
+	return b[:n], b[n : n+m], b[n+m:]
+}
+
+// zip64Extra returns the data of the Zip64 extended information extra field,
+// whether it is present, and the other extra fields.
+func zip64Extra(extra []byte) (zip64 []byte, ok bool, others []byte) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+
+		if id == zip64ExtraID {
+			zip64, ok = extra[4:4+size], true
+		} else {
+			others = append(others, extra[:4+size]...)
+		}
+		extra = extra[4+size:]
+	}
+	return zip64, ok, others
+}
+
+// readDirectoryRecord reads the sizes and location of a central directory
+// record.
+func readDirectoryRecord(rec []byte) (directoryRecord, error) {
+	r := directoryRecord{
+		csize:  uint64(binary.LittleEndian.Uint32(rec[20:])),
+		usize:  uint64(binary.LittleEndian.Uint32(rec[24:])),
+		disk:   uint32(binary.LittleEndian.Uint16(rec[34:])),
+		offset: uint64(binary.LittleEndian.Uint32(rec[42:])),
+	}
+
+	_, extra, _ := directoryRecordFields(rec)
+	zip64, _, _ := zip64Extra(extra)
+
+	// the values present are in a fixed order, and only present if the
+	// corresponding value of the record overflows
+	for _, v := range []*uint64{&r.usize, &r.csize, &r.offset} {
+		if *v != uint32max {
+			continue
+		}
+		if len(zip64) < 8 {
+			return r, zip.ErrFormat
+		}
+		*v = binary.LittleEndian.Uint64(zip64)
+		zip64 = zip64[8:]
+	}
+	if r.disk == uint16max {
+		if len(zip64) < 4 {
+			return r, zip.ErrFormat
+		}
+		r.disk = binary.LittleEndian.Uint32(zip64)
+	}
+
+	return r, nil
+}
+
+// writeDirectoryRecord returns a copy of a central directory record with its
+// sizes and location replaced by those of r, adding or removing them from the
+// Zip64 extended information extra field as needed. If forceZip64 is true,
+// the sizes and offset are always stored in the Zip64 extra field.
+func writeDirectoryRecord(rec []byte, r directoryRecord, forceZip64 bool) ([]byte, error) {
+	name, extra, comment := directoryRecordFields(rec)
+	_, _, others := zip64Extra(extra)
+
+	fixed := make([]byte, directoryHeaderLen)
+	copy(fixed, rec)
+
+	var data []byte
+	for _, v := range []struct {
+		value uint64
+		pos   int
+	}{{r.usize, 24}, {r.csize, 20}, {r.offset, 42}} {
+		if !forceZip64 && v.value < uint32max {
+			binary.LittleEndian.PutUint32(fixed[v.pos:], uint32(v.value))
+			continue
+		}
+
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], v.value)
+		data = append(data, b[:]...)
+		binary.LittleEndian.PutUint32(fixed[v.pos:], uint32max)
+	}
+
+	if r.disk >= uint16max {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], r.disk)
+		data = append(data, b[:]...)
+		binary.LittleEndian.PutUint16(fixed[34:], uint16max)
+	} else {
+		binary.LittleEndian.PutUint16(fixed[34:], uint16(r.disk))
+	}
+
+	if len(data) > 0 {
+		var b [4]byte
+		binary.LittleEndian.PutUint16(b[:], zip64ExtraID)
+		binary.LittleEndian.PutUint16(b[2:], uint16(len(data)))
+		others = append(others, b[:]...)
+		others = append(others, data...)
+
+		if binary.LittleEndian.Uint16(fixed[6:]) < zip64Version {
+			binary.LittleEndian.PutUint16(fixed[6:], zip64Version)
+		}
+	}
+	if len(others) > uint16max {
+		return nil, zip.ErrFormat
+	}
+	binary.LittleEndian.PutUint16(fixed[30:], uint16(len(others)))
+
+	out := make([]byte, 0, len(fixed)+len(name)+len(others)+len(comment))
+	out = append(out, fixed...)
+	out = append(out, name...)
+	out = append(out, others...)
+	out = append(out, comment...)
+
+	return out, nil
+}
+
+// zip64Writer writes to w, capturing what is written once the central
+// directory is being written, so that it can be rewritten to use Zip64
+// records.
+type zip64Writer struct {
+	w       io.Writer
+	written int64
+	capture *bytes.Buffer
+}
+
+func (w *zip64Writer) Write(p []byte) (int, error) {
+	if w.capture != nil {
+		return w.capture.Write(p)
+	}
+
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// close closes the zip writer, and then writes the central directory it
+// wrote with every record using Zip64 extra fields, followed by the Zip64
+// end of central directory record. The offset is the offset the zip writer
+// was created with.
+func (w *zip64Writer) close(zw *zip.Writer, offset int64) error {
+	if err := zw.Flush(); err != nil {
+		return err
+	}
+
+	start, captured, end, err := captureDirectory(zw, &w.capture, offset+w.written)
+	if err != nil {
+		return err
+	}
+
+	dirStart := int64(end.offset) - start
+	if _, err := w.Write(captured[:dirStart]); err != nil {
+		return err
+	}
+
+	dir, err := forceZip64Directory(captured[dirStart : dirStart+int64(end.size)])
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(dir); err != nil {
+		return err
+	}
+
+	end.size = uint64(len(dir))
+	end.zip64 = true
+
+	return writeDirectoryEnd(w, end, end.offset+end.size)
+}
+
+// forceZip64Directory rewrites the records of a central directory to use
+// Zip64 extra fields.
+func forceZip64Directory(dir []byte) ([]byte, error) {
+	out := make([]byte, 0, len(dir))
+	for len(dir) > 0 {
+		n, err := directoryRecordLen(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := readDirectoryRecord(dir[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		rec, err := writeDirectoryRecord(dir[:n], r, true)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec...)
+		dir = dir[n:]
+	}
+
+	return out, nil
+}
+
+// captureDirectory closes the zip writer, capturing what it writes, which is
+// the last entry's data descriptor followed by the central directory, and
+// returns the offset that it begins at, what was captured and the end of
+// central directory record. The offset provided is the offset the zip writer
+// has reached, after flushing.
+func captureDirectory(zw *zip.Writer, capture **bytes.Buffer, start int64) (int64, []byte, directoryEnd, error) {
+	*capture = new(bytes.Buffer)
+	err := zw.Close()
+	captured := (*capture).Bytes()
+	*capture = nil
+	if err != nil {
+		return 0, nil, directoryEnd{}, err
+	}
+
+	end, _, err := readDirectoryEnd(tailReaderAt{captured, start}, start+int64(len(captured)))
+	if err != nil {
+		return 0, nil, end, err
+	}
+
+	dirStart := int64(end.offset) - start
+	if dirStart < 0 || dirStart+int64(end.size) > int64(len(captured)) {
+		return 0, nil, end, zip.ErrFormat
+	}
+
+	return start, captured, end, nil
+}
+
+// tailReaderAt reads b, the end of data which begins at offset, reading
+// zeros before it.
+type tailReaderAt struct {
+	b      []byte
+	offset int64
+}
+
+func (r tailReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for ; off < r.offset && n < len(p); off++ {
+		p[n] = 0
+		n++
+	}
+	if off-r.offset >= int64(len(r.b)) {
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	m := copy(p[n:], r.b[off-r.offset:])
+	if n+m < len(p) {
+		return n + m, io.EOF
+	}
+	return n + m, nil
+}
+
+// hasZip64End returns whether the archive read from r has a Zip64 end of
+// central directory record.
+func hasZip64End(r io.ReaderAt, size int64) bool {
+	end, _, err := readDirectoryEnd(r, size)
+	return err == nil && end.zip64
+}